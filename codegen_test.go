@@ -2,11 +2,15 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strings"
 	"testing"
 )
 
@@ -34,6 +38,14 @@ func repoRoot(t *testing.T) string {
 // `go build ./...`. The result captures the generator's output and the
 // build's stderr so tests can assert on either.
 func runCodegen(t *testing.T, srcs map[string]string, supportFiles map[string]string) *codegenResult {
+	t.Helper()
+	return runCodegenWith(t, GenOptions{}, srcs, supportFiles)
+}
+
+// runCodegenWith is runCodegen with extra options for Generate; the
+// files, package and output, which is tmp/templates_gen.go, are filled
+// in.
+func runCodegenWith(t *testing.T, opts GenOptions, srcs map[string]string, supportFiles map[string]string) *codegenResult {
 	t.Helper()
 	tmp := t.TempDir()
 	root := repoRoot(t)
@@ -69,11 +81,12 @@ func runCodegen(t *testing.T, srcs map[string]string, supportFiles map[string]st
 	}
 
 	var buf bytes.Buffer
-	if err := Generate(GenOptions{
-		Filenames:   templatePaths,
-		PackageName: "testpkg",
-		Output:      &buf,
-	}); err != nil {
+	opts.Filenames = templatePaths
+	opts.PackageName = "testpkg"
+	opts.Output = &buf
+	opts.OutputPath = filepath.Join(tmp, "templates_gen.go")
+	opts.Dir = tmp
+	if err := Generate(opts); err != nil {
 		return &codegenResult{TmpDir: tmp, BuildErr: err}
 	}
 	generated := buf.String()
@@ -103,6 +116,49 @@ func runCodegen(t *testing.T, srcs map[string]string, supportFiles map[string]st
 	}
 }
 
+// runDriver is runCodegen for tests that render: it adds the driver
+// program main as driver/main.go, requires the module to build, runs
+// the driver and returns what it printed to stdout.
+func runDriver(t *testing.T, srcs map[string]string, supportFiles map[string]string, main string) (*codegenResult, string) {
+	t.Helper()
+	return runDriverWith(t, GenOptions{}, srcs, supportFiles, main)
+}
+
+// runDriverWith is runDriver with extra options for Generate.
+func runDriverWith(t *testing.T, opts GenOptions, srcs map[string]string, supportFiles map[string]string, main string) (*codegenResult, string) {
+	t.Helper()
+	support := map[string]string{"driver/main.go": main}
+	for path, content := range supportFiles {
+		support[path] = content
+	}
+	res := runCodegenWith(t, opts, srcs, support)
+	if res.BuildErr != nil {
+		t.Fatalf("build failed: %v\nstderr:\n%s\n\ngenerated:\n%s", res.BuildErr, res.BuildStderr, res.Generated)
+	}
+
+	run := exec.Command("go", "run", "./driver")
+	run.Dir = res.TmpDir
+	var stdout, stderr bytes.Buffer
+	run.Stdout = &stdout
+	run.Stderr = &stderr
+	if err := run.Run(); err != nil {
+		t.Fatalf("driver failed: %v\nstderr:\n%s\n\ngenerated:\n%s", err, stderr.String(), res.Generated)
+	}
+	return res, stdout.String()
+}
+
+// driverMain returns a driver program whose main runs body, importing
+// testpkg and imports.
+func driverMain(body string, imports ...string) string {
+	var b strings.Builder
+	b.WriteString("package main\n\nimport (\n")
+	for _, path := range append(imports, "testpkg") {
+		fmt.Fprintf(&b, "\t%q\n", path)
+	}
+	fmt.Fprintf(&b, ")\n\nfunc main() {\n%s}\n", body)
+	return b.String()
+}
+
 // TestHarnessSmoke: the existing example templates (re-used as raw strings
 // here) must compile through the harness. This is the safety net for
 // every subsequent codegen test.
@@ -195,6 +251,120 @@ func TestLineDirectivesAttributeErrors(t *testing.T) {
 	}
 }
 
+// TestLinePaths checks the ways //line directives can name templates.
+// All but absolute paths keep the generated code free of the machine's
+// directories.
+func TestLinePaths(t *testing.T) {
+	srcs := map[string]string{"site_page.html": "<h1>{{.Title}}</h1>"}
+	for _, tc := range []struct {
+		name string
+		opts GenOptions
+		want string // the first directive; empty for none
+	}{
+		{name: "output", opts: GenOptions{LinePaths: LinePathsOutput}, want: "\n//line site_page.html:1\n"},
+		{name: "module", opts: GenOptions{LinePaths: LinePathsModule}, want: "\n//line site_page.html:1\n"},
+		{name: "trimmed", opts: GenOptions{LinePaths: LinePathsModule, TrimLinePrefix: "site_"}, want: "\n//line page.html:1\n"},
+		{name: "none", opts: GenOptions{LinePaths: LinePathsNone}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res := runCodegenWith(t, tc.opts, srcs, nil)
+			if res.BuildErr != nil {
+				t.Fatalf("build failed: %v\nstderr:\n%s", res.BuildErr, res.BuildStderr)
+			}
+			if strings.Contains(res.Generated, res.TmpDir) {
+				t.Errorf("generated code refers to %s:\n%s", res.TmpDir, res.Generated)
+			}
+			if tc.want == "" {
+				if strings.Contains(res.Generated, "//line") {
+					t.Errorf("expected no //line directives:\n%s", res.Generated)
+				}
+			} else if !strings.Contains(res.Generated, tc.want) {
+				t.Errorf("expected %q in:\n%s", tc.want, res.Generated)
+			}
+		})
+	}
+
+	err := Generate(GenOptions{Filenames: []string{"x.html"}, LinePaths: LinePathsOutput, Output: &bytes.Buffer{}})
+	if err == nil || !strings.Contains(err.Error(), "need an output file") {
+		t.Errorf("output-relative paths without an output file: %v", err)
+	}
+}
+
+// TestExamplesUpToDate regenerates examples/templates.go the way the
+// Taskfile does and fails when the committed file differs, so a change
+// to the emitters can't leave it stale.
+func TestExamplesUpToDate(t *testing.T) {
+	filenames, err := filepath.Glob(filepath.Join("examples", "*.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := filepath.Abs(filepath.Join("examples", "templates.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got bytes.Buffer
+	if err := Generate(GenOptions{
+		Filenames:   filenames,
+		PackageName: "examples",
+		Output:      &got,
+		LinePaths:   LinePathsOutput,
+		OutputPath:  output,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("examples/templates.go is stale; regenerate it with task")
+	}
+}
+
+// TestGeneratedIsFormatted checks generated code needs no separate
+// gofmt step.
+func TestGeneratedIsFormatted(t *testing.T) {
+	srcs := map[string]string{
+		"page.html": "{{range $i, $v := .Items}}{{if $v}}<b>{{$i}}</b>{{else}}-{{end}}{{end}}",
+	}
+	res := runCodegen(t, srcs, nil)
+	if res.BuildErr != nil {
+		t.Fatalf("build failed: %v\nstderr:\n%s", res.BuildErr, res.BuildStderr)
+	}
+	formatted, err := format.Source([]byte(res.Generated))
+	if err != nil {
+		t.Fatalf("format: %v", err)
+	}
+	if string(formatted) != res.Generated {
+		t.Fatalf("generated code is not gofmt-formatted:\n%s", res.Generated)
+	}
+}
+
+// TestFormatGeneratedErrors checks syntax errors in generated code are
+// reported at the template position its //line directives give.
+func TestFormatGeneratedErrors(t *testing.T) {
+	src := "package p\n\nfunc f() {\n\n//line /abs/page.html:7\n\tx := )\n}\n\nvar y = ]\n"
+	_, err := formatGenerated([]byte(src), map[string]string{"/abs/page.html": "page.html"})
+	var diags Diagnostics
+	if !errors.As(err, &diags) || len(diags) != 2 {
+		t.Fatalf("expected 2 diagnostics, got %v", err)
+	}
+	if d := diags[0]; d.File != "page.html" || d.Line != 7 || !strings.Contains(d.Message, "generated code: expected operand") {
+		t.Errorf("first diagnostic = %+v", d)
+	}
+	// The directive still applies after the function ends, so the second
+	// error is attributed to page.html too.
+	if d := diags[1]; d.File != "page.html" || d.Line != 10 {
+		t.Errorf("second diagnostic = %+v", d)
+	}
+
+	_, err = formatGenerated([]byte("package p\n\nvar y = ]\n"), nil)
+	if err == nil || !strings.Contains(err.Error(), `generated code: line 3: expected operand, found ']' in "var y = ]"`) {
+		t.Errorf("unpositioned error = %v", err)
+	}
+}
+
 // TestDynamicFallback confirms that templates without directives still
 // emit the legacy reflection-based runtime helpers. This guards the
 // Phase 1 backwards-compat contract: existing templates keep working
@@ -214,3 +384,164 @@ func TestDynamicFallback(t *testing.T) {
 		t.Fatalf("expected legacy CallFunc in generated source:\n%s", res.Generated)
 	}
 }
+
+// TestDynamicNesting renders nested blocks through dynamic code. Text
+// with two tabs in a row must survive nesting unchanged, and piped
+// values are passed after a function's own arguments.
+func TestDynamicNesting(t *testing.T) {
+	srcs := map[string]string{
+		"nested.html": "{{range .Items}}{{if .}}{{with .}}[{{.}}]{{end}}{{end}}{{end}}",
+		"calls.html":  "{{if .}}{{with .}}{{template \"a\t\tb\" .}}{{.Name | printf \"%s!\"}}{{end}}{{end}}",
+	}
+	res, out := runDriver(t, srcs, nil, driverMain(`
+	data := map[string]any{"Items": []any{"a", "", "b"}}
+	if err := testpkg.Parsed.ExecuteTemplate(os.Stdout, "nested.html", data); err != nil {
+		panic(err)
+	}
+`, "os"))
+	for _, want := range []string{
+		"\n\t\t\t\t// Include template: a\t\tb\n",
+		`t.CallFunc("printf", "%s!", result`,
+	} {
+		if !bytes.Contains([]byte(res.Generated), []byte(want)) {
+			t.Errorf("expected %q in:\n%s", want, res.Generated)
+		}
+	}
+
+	if want := "[a][b]"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+// TestDynamicLoopControl renders {{break}} and {{continue}} through
+// dynamic code. Skipping the rest of a body must still restore dot,
+// both for the next iteration and after the loop.
+func TestDynamicLoopControl(t *testing.T) {
+	_, out := runDriver(t, map[string]string{
+		"loop.html": `{{range .}}{{with .}}{{if contains "b" .}}{{continue}}{{end}}{{if contains "d" .}}{{break}}{{end}}{{.}}{{end}}{{end}}|{{len .}}`,
+	}, nil, driverMain(`
+	testpkg.Parsed.Funcs(template.FuncMap{"contains": func(substr, s string) bool { return strings.Contains(s, substr) }})
+	data := []any{"a", "b", "c", "d", "e"}
+	if err := testpkg.Parsed.ExecuteTemplate(os.Stdout, "loop.html", data); err != nil {
+		panic(err)
+	}
+`, "os", "strings", "text/template"))
+	if want := "ac|5"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+// TestDynamicRedeclare checks dynamic code declares a variable again in
+// the same scope, as text/template may, at the top level and in the
+// bodies of {{with}}, {{range}} and {{if}}, and declares the variables of
+// {{with}} and {{if}} pipelines for both branches. A variable declared
+// inside a block shadows the outer one only until its {{end}}.
+func TestDynamicRedeclare(t *testing.T) {
+	srcs := map[string]string{
+		"top.html":   `{{$x := 1}}{{$x := 2}}{{$x}};`,
+		"with.html":  `{{$x := 0}}{{with .a}}{{$x := 1}}{{$x := .}}{{$x}}{{end}}{{$x}};`,
+		"range.html": `{{range $i, $v := .b}}{{$v := $i}}{{$v := printf "%d%d" $v $i}}{{$v}}{{end}};`,
+		"if.html":    `{{$x := 0}}{{if $x := .a}}{{$x := printf "%s!" $x}}{{$x}}{{else}}{{$x}}{{end}}{{$x}};`,
+		"decl.html":  `{{with $y := .a}}{{$y}}{{end}}{{with $y := .c}}{{else}}[{{$y}}]{{end}};`,
+	}
+	_, out := runDriver(t, srcs, nil, driverMain(`
+	data := map[string]any{"a": "A", "b": []any{"p", "q"}, "c": ""}
+	for _, name := range []string{"top.html", "with.html", "range.html", "if.html", "decl.html"} {
+		if err := testpkg.Parsed.ExecuteTemplate(os.Stdout, name, data); err != nil {
+			panic(err)
+		}
+	}
+`, "os"))
+	if want := "2;A0;0011;A!0;A[];"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+// TestDynamicFieldErrors checks dynamic code fails field lookups where
+// html/template does, through a stored nil or a field a struct lacks,
+// but prints nothing for a missing map key.
+func TestDynamicFieldErrors(t *testing.T) {
+	_, out := runDriver(t, map[string]string{
+		"field.html": `[{{.A.B}}]`,
+	}, nil, driverMain(`
+	type page struct{ Title string }
+	for _, data := range []any{
+		map[string]any{},
+		map[string]any{"A": nil},
+		map[string]any{"A": (*page)(nil)},
+		page{},
+	} {
+		err := testpkg.Parsed.ExecuteTemplate(os.Stdout, "field.html", data)
+		fmt.Printf(" %v;", err)
+	}
+`, "fmt", "os"))
+	want := "[] <nil>;[ nil pointer evaluating interface {}.B;[ nil pointer evaluating *main.page.B;[ can't evaluate field A in type main.page;"
+	if out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+// TestDynamicRangeSizeLinear guards that a range body is emitted once,
+// so each level of nesting adds the same amount of generated code
+// rather than doubling it.
+func TestDynamicRangeSizeLinear(t *testing.T) {
+	lines := make([]int, 5)
+	for depth := 1; depth < len(lines); depth++ {
+		src := strings.Repeat("{{range .}}", depth) + "{{.}}" + strings.Repeat("{{end}}", depth)
+		path := filepath.Join(t.TempDir(), "nested.html")
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := Generate(GenOptions{Filenames: []string{path}, PackageName: "p", Output: &buf}); err != nil {
+			t.Fatalf("depth %d: %v", depth, err)
+		}
+		lines[depth] = strings.Count(buf.String(), "\n")
+	}
+	step := lines[2] - lines[1]
+	for depth := 3; depth < len(lines); depth++ {
+		if got := lines[depth] - lines[depth-1]; got != step {
+			t.Errorf("depth %d added %d lines, depth 2 added %d (lines by depth: %v)", depth, got, step, lines[1:])
+		}
+	}
+
+	_, out := runDriver(t, map[string]string{
+		"nested.html": "{{range .}}{{range .}}{{range $k, $v := .}}{{$k}}={{$v}};{{else}}none{{end}}{{end}}{{end}}",
+	}, nil, driverMain(`
+	data := []any{[]any{map[string]any{"b": 2, "a": 1}, map[string]any{}}}
+	if err := testpkg.Parsed.ExecuteTemplate(os.Stdout, "nested.html", data); err != nil {
+		panic(err)
+	}
+`, "os"))
+	if want := "a=1;b=2;none"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+// TestDynamicDeepNesting checks deeply nested blocks build and render:
+// helper variables of inner blocks must not clash with or shadow those
+// of outer ones, sibling ranges may declare the same variables, inner
+// ranges may shadow outer ones, and range variables may go unused.
+func TestDynamicDeepNesting(t *testing.T) {
+	srcs := map[string]string{
+		"a.html": `{{range $i, $v := .}}{{with $v}}{{range .}}{{if .}}{{with .}}{{.}}{{else}}-{{end}}{{end}}{{else}}e{{end}}{{end}}{{end}};`,
+		"b.html": `{{with .}}{{with .}}{{range $k, $v := .}}{{range $j, $w := $v}}{{if $w}}{{$k}}{{$w}}{{end}}{{end}}{{end}}{{end}}{{end}};`,
+		"c.html": `{{range .}}{{range .}}{{with .}}{{with .}}{{range $x := .}}x{{end}}{{end}}{{end}}{{end}}{{else}}e{{end}};`,
+		"d.html": `{{range $i, $x := .p}}{{$i}}{{$x}}{{end}}{{range $i, $x := .q}}{{$i}}{{end}}{{range $x := .p}}{{$x}}{{end}};`,
+		"e.html": `{{range $x := .r}}{{range $x := .}}{{$x}}{{end}}{{end}};`,
+	}
+	_, out := runDriver(t, srcs, nil, driverMain(`
+	data := map[string]any{"p": []any{"a", "", "b"}, "q": []any{}}
+	for _, name := range []string{"a.html", "b.html", "c.html", "d.html"} {
+		if err := testpkg.Parsed.ExecuteTemplate(os.Stdout, name, data); err != nil {
+			panic(err)
+		}
+	}
+	if err := testpkg.Parsed.ExecuteTemplate(os.Stdout, "e.html", map[string]any{"r": []any{[]any{1, 2}, []any{3}}}); err != nil {
+		panic(err)
+	}
+`, "os"))
+	if want := "ab;papb;xx;0a12bab;123;"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
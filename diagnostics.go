@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Diagnostic is one problem found while generating code, positioned in
+// a template the way go vet reports positions in Go files.
+type Diagnostic struct {
+	File    string // template file name; empty when the message says
+	Line    int    // 1-based; 0 when unknown
+	Col     int    // 1-based byte column; 0 when unknown
+	Message string
+}
+
+// String formats d as "file:line:col: message", leaving out the parts
+// that are unknown.
+func (d Diagnostic) String() string {
+	var b strings.Builder
+	if d.File != "" {
+		b.WriteString(d.File)
+		if d.Line > 0 {
+			fmt.Fprintf(&b, ":%d", d.Line)
+			if d.Col > 0 {
+				fmt.Fprintf(&b, ":%d", d.Col)
+			}
+		}
+		b.WriteString(": ")
+	}
+	b.WriteString(d.Message)
+	return b.String()
+}
+
+// Diagnostics are all the problems a generation run found. Generate
+// returns them together as its error, one per line, instead of stopping
+// at the first.
+type Diagnostics []Diagnostic
+
+func (ds Diagnostics) Error() string {
+	lines := make([]string, len(ds))
+	for i, d := range ds {
+		lines[i] = d.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// add records err. Diagnostics, even wrapped, are added as they are;
+// any other error becomes a diagnostic whose message carries its own
+// position, if any.
+func (ds *Diagnostics) add(err error) {
+	var more Diagnostics
+	if errors.As(err, &more) {
+		*ds = append(*ds, more...)
+		return
+	}
+	*ds = append(*ds, Diagnostic{Message: err.Error()})
+}
+
+// lineError is a typed codegen error positioned at a template line. Its
+// message ends with " (line N)" for errors that are reported as they
+// are.
+type lineError struct {
+	line int
+	err  error
+}
+
+func (e *lineError) Error() string { return fmt.Sprintf("%v (line %d)", e.err, e.line) }
+
+func (e *lineError) Unwrap() error { return e.err }
+
+// errorAtLine formats an error like fmt.Errorf, positioned at line.
+func errorAtLine(line int, format string, args ...any) error {
+	return &lineError{line: line, err: fmt.Errorf(format, args...)}
+}
+
+// atLine positions err at line.
+func atLine(line int, err error) error {
+	return &lineError{line: line, err: err}
+}
+
+// nodeDiagnostic positions err, returned while emitting the node at pos
+// of file. The error's own line is more precise than the node's line
+// when the node spans several lines, so it wins; the column is only
+// known when both agree.
+func nodeDiagnostic(file string, idx *LineIndex, pos int64, err error) Diagnostic {
+	d := Diagnostic{File: file, Message: err.Error()}
+	if idx != nil {
+		d.Line, d.Col = idx.LineNumberAt(pos), idx.ColumnAt(pos)
+	}
+	var le *lineError
+	if errors.As(err, &le) {
+		if le.line != d.Line {
+			d.Line, d.Col = le.line, 0
+		}
+		d.Message = le.err.Error()
+	}
+	return d
+}
@@ -1,40 +1,137 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"go/token"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
 // Directives are opt-in metadata declared by a template via Go template
-// comments: {{/* @data ... */}}, {{/* @funcs ... */}}, {{/* @import ... */}}.
+// comments: {{/* @data ... */}}, {{/* @funcs ... */}}, {{/* @import ... */}}
+// and {{/* @param ... */}}.
 // They are recognized by a pre-scan over the raw template source (the
 // html/template parser may strip some comments before we see them).
 type Directives struct {
 	// DataTypeRef is the value of {{/* @data <ref> */}} where <ref> is
 	// either a fully-qualified path like "github.com/foo/bar.MyType" or a
 	// short form like "alias.MyType" (requires a matching @import entry).
-	// Empty when the template does not opt into typed mode.
+	// Generic types take type arguments, as in "alias.Page[alias.User]";
+	// see ParseTypeRef. Empty when the template does not opt into typed
+	// mode here; Go source can still declare its type, see
+	// DiscoverTemplateTypes.
 	DataTypeRef string
 
+	// DataLine is the 1-based source line of the @data directive, so
+	// errors about the declared type can point at it.
+	DataLine int
+
 	// FuncsAlias maps an alias name to a Go import path. Each entry comes
 	// from one {{/* @funcs <alias>=<import-path> */}} directive.
 	FuncsAlias map[string]string
 
+	// Params are the {{/* @param <name> <type-ref> */}} directives, in
+	// order. Each becomes a parameter of the typed render function,
+	// bound as $name in the template.
+	Params []ParamDirective
+
 	// Imports maps an alias name to a Go import path. Each entry comes
 	// from one {{/* @import <alias>=<import-path> */}} directive. Used to
 	// resolve short @data type refs.
 	Imports map[string]string
+
+	// Defines maps the name of a {{define}} block to the @data directive
+	// that opens its body, as in
+	//
+	//	{{define "row"}}{{/* @data alias.Row */}}...{{end}}
+	//
+	// Such a block is typed on its own, whatever the file declares.
+	Defines map[string]DefineDirective
+}
+
+// DefineDirective is a @data directive scoped to one {{define}} block.
+type DefineDirective struct {
+	DataTypeRef string // parsed like Directives.DataTypeRef
+	Line        int
+}
+
+// ParamDirective is one {{/* @param <name> <type-ref> */}} directive.
+type ParamDirective struct {
+	Name    string // without the leading $
+	TypeRef string // parsed like DataTypeRef
+	Line    int
 }
 
 // Typed reports whether the template opts into typed codegen.
 func (d Directives) Typed() bool {
-	return d.DataTypeRef != ""
+	return d.DataTypeRef != "" || len(d.Params) > 0
 }
 
 // directiveRE matches a single template-comment directive, tolerating the
 // {{- ... -}} whitespace-trim variants.
-var directiveRE = regexp.MustCompile(`\{\{-?\s*/\*\s*@(data|funcs|import)\s+(.*?)\s*\*/\s*-?\}\}`)
+var directiveRE = regexp.MustCompile(`\{\{-?\s*/\*\s*@(data|funcs|import|param)\s+(.*?)\s*\*/\s*-?\}\}`)
+
+// blockRE matches the start of an action that opens or closes a block.
+var blockRE = regexp.MustCompile(`\{\{-?\s*(if|range|with|block|define|end)\b`)
+
+// defineHeadRE matches a whole {{define "name"}} action.
+var defineHeadRE = regexp.MustCompile(`^\{\{-?\s*define\s+("(?:[^"\\]|\\.)*"|` + "`[^`]*`" + `)\s*-?\}\}`)
+
+// defineSpan is the body of one {{define}} block: raw[body:end].
+type defineSpan struct {
+	name      string
+	body, end int
+}
+
+// defineSpans finds the {{define}} blocks of raw by matching block
+// actions with their {{end}}. Malformed nesting is left for the parser
+// to report.
+func defineSpans(raw []byte) []defineSpan {
+	var spans []defineSpan
+	var open []int // index into spans, or -1 for other blocks
+	for _, m := range blockRE.FindAllSubmatchIndex(raw, -1) {
+		switch string(raw[m[2]:m[3]]) {
+		case "end":
+			if len(open) == 0 {
+				continue
+			}
+			if i := open[len(open)-1]; i >= 0 {
+				spans[i].end = m[0]
+			}
+			open = open[:len(open)-1]
+		case "define":
+			h := defineHeadRE.FindSubmatchIndex(raw[m[0]:])
+			if h == nil {
+				open = append(open, -1)
+				continue
+			}
+			name, err := strconv.Unquote(string(raw[m[0]+h[2] : m[0]+h[3]]))
+			if err != nil {
+				open = append(open, -1)
+				continue
+			}
+			spans = append(spans, defineSpan{name: name, body: m[0] + h[1], end: len(raw)})
+			open = append(open, len(spans)-1)
+		default:
+			open = append(open, -1)
+		}
+	}
+	return spans
+}
+
+// enclosingDefine returns the innermost span containing offset.
+func enclosingDefine(spans []defineSpan, offset int) (defineSpan, bool) {
+	var found defineSpan
+	ok := false
+	for _, s := range spans {
+		if s.body <= offset && offset < s.end {
+			found, ok = s, true
+		}
+	}
+	return found, ok
+}
 
 // ParseDirectives extracts all comtmpl directives from the raw bytes of a
 // template file. Unknown @-directives are reported as errors so typos
@@ -43,12 +140,37 @@ func ParseDirectives(raw []byte) (Directives, error) {
 	dirs := Directives{
 		FuncsAlias: map[string]string{},
 		Imports:    map[string]string{},
+		Defines:    map[string]DefineDirective{},
 	}
 
-	matches := directiveRE.FindAllSubmatch(raw, -1)
+	spans := defineSpans(raw)
+	matches := directiveRE.FindAllSubmatchIndex(raw, -1)
 	for _, m := range matches {
-		kind := string(m[1])
-		value := strings.TrimSpace(string(m[2]))
+		kind := string(raw[m[2]:m[3]])
+		value := strings.TrimSpace(string(raw[m[4]:m[5]]))
+
+		// A @data inside a define body belongs to that block. @import
+		// and @funcs apply to the whole file wherever they are written.
+		if span, ok := enclosingDefine(spans, m[0]); ok && kind != "import" && kind != "funcs" {
+			name := span.name
+			if kind != "data" {
+				return dirs, fmt.Errorf("@%s can't be scoped to {{define %q}}; only @data can", kind, name)
+			}
+			if len(bytes.TrimSpace(raw[span.body:m[0]])) > 0 {
+				return dirs, fmt.Errorf("@data for {{define %q}} must open its body", name)
+			}
+			if value == "" {
+				return dirs, fmt.Errorf("@data directive requires a type reference (e.g. %q)", "github.com/foo.MyType")
+			}
+			if prev, dup := dirs.Defines[name]; dup {
+				return dirs, fmt.Errorf("duplicate @data for {{define %q}}: %q (previous: %q)", name, value, prev.DataTypeRef)
+			}
+			dirs.Defines[name] = DefineDirective{
+				DataTypeRef: value,
+				Line:        bytes.Count(raw[:m[0]], []byte("\n")) + 1,
+			}
+			continue
+		}
 
 		switch kind {
 		case "data":
@@ -59,6 +181,7 @@ func ParseDirectives(raw []byte) (Directives, error) {
 				return dirs, fmt.Errorf("@data directive requires a type reference (e.g. %q)", "github.com/foo.MyType")
 			}
 			dirs.DataTypeRef = value
+			dirs.DataLine = bytes.Count(raw[:m[0]], []byte("\n")) + 1
 
 		case "funcs":
 			alias, path, ok := splitAliasEqPath(value)
@@ -70,6 +193,26 @@ func ParseDirectives(raw []byte) (Directives, error) {
 			}
 			dirs.FuncsAlias[alias] = path
 
+		case "param":
+			name, ref := value, ""
+			if i := strings.IndexAny(value, " \t"); i >= 0 {
+				name, ref = value[:i], strings.TrimSpace(value[i+1:])
+			}
+			name = strings.TrimPrefix(name, "$")
+			if !token.IsIdentifier(name) || ref == "" {
+				return dirs, fmt.Errorf("@param directive must be <name> <type-ref>, got %q", value)
+			}
+			for _, p := range dirs.Params {
+				if p.Name == name {
+					return dirs, fmt.Errorf("duplicate @param %q", name)
+				}
+			}
+			dirs.Params = append(dirs.Params, ParamDirective{
+				Name:    name,
+				TypeRef: ref,
+				Line:    bytes.Count(raw[:m[0]], []byte("\n")) + 1,
+			})
+
 		case "import":
 			alias, path, ok := splitAliasEqPath(value)
 			if !ok {
@@ -81,6 +224,9 @@ func ParseDirectives(raw []byte) (Directives, error) {
 			dirs.Imports[alias] = path
 		}
 	}
+	if dirs.DataTypeRef != "" && len(dirs.Params) > 0 {
+		return dirs, fmt.Errorf("@param can't be combined with @data; declare the data as another @param")
+	}
 	return dirs, nil
 }
 
@@ -106,7 +252,103 @@ func splitAliasEqPath(s string) (alias, path string, ok bool) {
 func SplitDataTypeRef(ref string) (pathOrAlias, typeName string, err error) {
 	idx := strings.LastIndexByte(ref, '.')
 	if idx <= 0 || idx == len(ref)-1 {
-		return "", "", fmt.Errorf("@data ref %q is not of the form <import-path-or-alias>.<TypeName>", ref)
+		return "", "", fmt.Errorf("%q is not of the form <import-path-or-alias>.<TypeName>", ref)
 	}
 	return ref[:idx], ref[idx+1:], nil
 }
+
+// TypeRef is a parsed @data type reference. Named types may carry type
+// arguments, which are themselves TypeRefs:
+//
+//	github.com/acme/web.Page[github.com/acme/web.User]
+//	web.Pair[string, []*web.User]
+type TypeRef struct {
+	// Elem is set for "*T" and "[]T" refs; the fields below are then
+	// empty.
+	Elem  *TypeRef
+	Slice bool // with Elem: "[]T" rather than "*T"
+
+	// PathOrAlias is the import path or @import alias of a named type,
+	// or empty for predeclared types such as string.
+	PathOrAlias string
+	Name        string
+	Args        []TypeRef
+}
+
+// ParseTypeRef parses a type reference of a @data or @param directive
+// or an asType call. Errors don't name the directive; callers do.
+func ParseTypeRef(ref string) (TypeRef, error) {
+	parsed, rest, err := parseTypeRef(ref)
+	if err != nil {
+		return TypeRef{}, err
+	}
+	if rest = strings.TrimSpace(rest); rest != "" {
+		return TypeRef{}, fmt.Errorf("unexpected %q after the type", rest)
+	}
+	return parsed, nil
+}
+
+// parseTypeRef parses one type from the front of s and returns the
+// unparsed remainder. Each "*" or "[]" prefix wraps the type after it,
+// so "*[]T" is a pointer to a slice.
+func parseTypeRef(s string) (TypeRef, string, error) {
+	s = strings.TrimSpace(s)
+	var slice bool
+	switch {
+	case strings.HasPrefix(s, "*"):
+		s = s[1:]
+	case strings.HasPrefix(s, "[]"):
+		s, slice = s[2:], true
+	default:
+		return parseNamedTypeRef(s)
+	}
+	elem, rest, err := parseTypeRef(s)
+	if err != nil {
+		return TypeRef{}, "", err
+	}
+	return TypeRef{Elem: &elem, Slice: slice}, rest, nil
+}
+
+// parseNamedTypeRef parses a named type, with any type arguments, from
+// the front of s and returns the unparsed remainder.
+func parseNamedTypeRef(s string) (TypeRef, string, error) {
+	end := strings.IndexAny(s, "[],")
+	if end < 0 {
+		end = len(s)
+	}
+	name := strings.TrimSpace(s[:end])
+	rest := s[end:]
+	var ref TypeRef
+	if strings.Contains(name, ".") {
+		pathOrAlias, typeName, err := SplitDataTypeRef(name)
+		if err != nil {
+			return TypeRef{}, "", err
+		}
+		ref = TypeRef{PathOrAlias: pathOrAlias, Name: typeName}
+	} else if name != "" {
+		ref = TypeRef{Name: name}
+	} else {
+		return TypeRef{}, "", fmt.Errorf("missing type name at %q", s)
+	}
+
+	if !strings.HasPrefix(rest, "[") {
+		return ref, rest, nil
+	}
+	rest = rest[1:]
+	for {
+		arg, after, err := parseTypeRef(rest)
+		if err != nil {
+			return TypeRef{}, "", err
+		}
+		ref.Args = append(ref.Args, arg)
+		after = strings.TrimSpace(after)
+		switch {
+		case strings.HasPrefix(after, ","):
+			rest = after[1:]
+		case strings.HasPrefix(after, "]"):
+			return ref, after[1:], nil
+		default:
+			return TypeRef{}, "", fmt.Errorf("unterminated type arguments of %s", name)
+		}
+	}
+}
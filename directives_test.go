@@ -28,6 +28,9 @@ func TestParseDirectivesAll(t *testing.T) {
 	if d.DataTypeRef != "examples.IndexData" {
 		t.Errorf("DataTypeRef = %q, want %q", d.DataTypeRef, "examples.IndexData")
 	}
+	if d.DataLine != 1 {
+		t.Errorf("DataLine = %d, want 1", d.DataLine)
+	}
 	wantImports := map[string]string{"examples": "github.com/jtarchie/comtmpl/examples"}
 	if !reflect.DeepEqual(d.Imports, wantImports) {
 		t.Errorf("Imports = %v, want %v", d.Imports, wantImports)
@@ -59,6 +62,14 @@ func TestParseDirectivesErrors(t *testing.T) {
 		{"bad @funcs format", "{{/* @funcs sprig */}}"},
 		{"empty @funcs alias", "{{/* @funcs =github.com/foo */}}"},
 		{"duplicate @funcs alias", "{{/* @funcs s=a */}}{{/* @funcs s=b */}}"},
+		{"@param without type", "{{/* @param user */}}"},
+		{"@param bad name", "{{/* @param 1user a.B */}}"},
+		{"duplicate @param", "{{/* @param user a.B */}}{{/* @param $user a.C */}}"},
+		{"@param with @data", "{{/* @data a.B */}}{{/* @param user a.C */}}"},
+		{"@param in define", `{{define "row"}}{{/* @param user a.B */}}{{end}}`},
+		{"define @data after content", `{{define "row"}}<tr>{{/* @data a.B */}}{{end}}`},
+		{"nested define @data", `{{define "row"}}{{if .}}{{/* @data a.B */}}{{end}}{{end}}`},
+		{"duplicate define @data", `{{define "row"}}{{/* @data a.B */}}{{end}}{{define "row"}}{{/* @data a.C */}}{{end}}`},
 	}
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -69,6 +80,55 @@ func TestParseDirectivesErrors(t *testing.T) {
 	}
 }
 
+func TestParseDirectivesParams(t *testing.T) {
+	src := `{{/* @param user github.com/acme/models.User */}}
+{{/* @param $viewer *models.Viewer */}}`
+
+	d, err := ParseDirectives([]byte(src))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []ParamDirective{
+		{Name: "user", TypeRef: "github.com/acme/models.User", Line: 1},
+		{Name: "viewer", TypeRef: "*models.Viewer", Line: 2},
+	}
+	if !reflect.DeepEqual(d.Params, want) {
+		t.Errorf("Params = %+v, want %+v", d.Params, want)
+	}
+	if !d.Typed() {
+		t.Error("expected @param to opt into typed mode")
+	}
+}
+
+func TestParseDirectivesDefines(t *testing.T) {
+	src := `{{/* @data models.Page */}}
+{{define "row"}}{{/* @data models.User */}}{{.Name}}{{end}}
+{{- define ` + "`card`" + ` -}}
+  {{- /* @data *models.User */ -}}
+{{end}}
+{{define "plain"}}{{if .}}{{.}}{{end}}{{end}}
+{{define "helpers"}}{{/* @import models=github.com/acme/models */}}{{/* @funcs h=github.com/acme/helpers */}}{{end}}`
+
+	d, err := ParseDirectives([]byte(src))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d.DataTypeRef != "models.Page" || d.DataLine != 1 {
+		t.Errorf("file @data = %q at line %d, want %q at line 1", d.DataTypeRef, d.DataLine, "models.Page")
+	}
+	want := map[string]DefineDirective{
+		"row":  {DataTypeRef: "models.User", Line: 2},
+		"card": {DataTypeRef: "*models.User", Line: 4},
+	}
+	if !reflect.DeepEqual(d.Defines, want) {
+		t.Errorf("Defines = %+v, want %+v", d.Defines, want)
+	}
+	// @import and @funcs in a define body apply to the whole file.
+	if d.Imports["models"] != "github.com/acme/models" || d.FuncsAlias["h"] != "github.com/acme/helpers" {
+		t.Errorf("Imports = %v, FuncsAlias = %v, want the define's @import and @funcs", d.Imports, d.FuncsAlias)
+	}
+}
+
 func TestSplitDataTypeRef(t *testing.T) {
 	cases := []struct {
 		ref      string
@@ -96,3 +156,46 @@ func TestSplitDataTypeRef(t *testing.T) {
 		})
 	}
 }
+
+func TestParseTypeRef(t *testing.T) {
+	user := TypeRef{PathOrAlias: "github.com/acme/web", Name: "User"}
+	cases := []struct {
+		ref  string
+		want TypeRef
+	}{
+		{"examples.IndexData", TypeRef{PathOrAlias: "examples", Name: "IndexData"}},
+		{"github.com/acme/web.Page[github.com/acme/web.User]",
+			TypeRef{PathOrAlias: "github.com/acme/web", Name: "Page", Args: []TypeRef{user}}},
+		{"web.Pair[string, []*github.com/acme/web.User]", TypeRef{PathOrAlias: "web", Name: "Pair", Args: []TypeRef{
+			{Name: "string"},
+			{Slice: true, Elem: &TypeRef{Elem: &user}},
+		}}},
+		{"web.Box[web.Box[int]]", TypeRef{PathOrAlias: "web", Name: "Box", Args: []TypeRef{
+			{PathOrAlias: "web", Name: "Box", Args: []TypeRef{{Name: "int"}}},
+		}}},
+		{"*[]github.com/acme/web.User", TypeRef{Elem: &TypeRef{Slice: true, Elem: &user}}},
+		{"[]*github.com/acme/web.User", TypeRef{Slice: true, Elem: &TypeRef{Elem: &user}}},
+		{"**[][]int", TypeRef{Elem: &TypeRef{Elem: &TypeRef{Slice: true, Elem: &TypeRef{Slice: true, Elem: &TypeRef{Name: "int"}}}}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.ref, func(t *testing.T) {
+			got, err := ParseTypeRef(tc.ref)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseTypeRefErrors(t *testing.T) {
+	for _, ref := range []string{"web.Page[", "web.Page[web.User", "web.Page[]", "web.Page]", "trailing."} {
+		t.Run(ref, func(t *testing.T) {
+			if _, err := ParseTypeRef(ref); err == nil {
+				t.Fatal("expected error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template/parse"
+)
+
+// The dynamic codepath compiles templates without static types. Values
+// are held as any and fields, functions and nested templates are
+// resolved by the runtime through reflection. It shares the Generator's
+// indentation, line directives and variable numbering with typed mode,
+// whose fallback emits nodes it can't compile through it.
+
+// emitDynamic writes nodes as dynamic code. It expects data, the dot
+// value, t, the *templates.Templates registry, and writer and err in
+// scope.
+func (g *Generator) emitDynamic(nodes []parse.Node) {
+	for _, node := range nodes {
+		g.emitDynamicNode(node)
+	}
+}
+
+// emitDynamicNode writes one node as dynamic code, preceded by the
+// //line directive of its position in the template.
+func (g *Generator) emitDynamicNode(node parse.Node) {
+	g.EmitLine(int64(node.Position()))
+
+	switch n := node.(type) {
+	case *parse.TextNode:
+		if text := g.Escaping.text(n); len(text) > 0 {
+			g.Line("_, err = io.WriteString(writer, %q)", text)
+			g.Line("if err != nil { return err }")
+		}
+	case *parse.ActionNode:
+		g.emitDynamicAction(n)
+	case *parse.IfNode:
+		g.emitDynamicIf(n)
+	case *parse.RangeNode:
+		g.emitDynamicRange(n)
+	case *parse.WithNode:
+		g.emitDynamicWith(n)
+	case *parse.TemplateNode:
+		g.emitDynamicTemplate(n)
+	case *parse.BreakNode:
+		g.Line("%s", g.breakStmt())
+	case *parse.ContinueNode:
+		g.Line("continue")
+	case *parse.CommentNode:
+		g.Line("// Template comment: %s", strings.ReplaceAll(n.String(), "\n", " "))
+	default:
+		g.Line("// Unsupported node type: %T", n)
+	}
+}
+
+// emitDynamicList writes the nodes of a block body one level deeper,
+// first declaring the variables decl of its {{if}} or {{with}} as value.
+func (g *Generator) emitDynamicList(list *parse.ListNode, decl []*parse.VariableNode, value string) {
+	g.dynamicBlock(func() {
+		if len(decl) > 0 {
+			g.declareDynamic(decl[0].Ident[0], value)
+		}
+		if list != nil {
+			g.emitDynamic(list.Nodes)
+		}
+	})
+}
+
+// dynamicBlock writes body as the contents of a Go block, one level
+// deeper, where template variables may be declared anew.
+func (g *Generator) dynamicBlock(body func()) {
+	g.Depth++
+	g.DynamicVars = append(g.DynamicVars, map[string]bool{})
+	body()
+	g.DynamicVars = g.DynamicVars[:len(g.DynamicVars)-1]
+	g.Depth--
+}
+
+// declareDynamic writes code declaring the template variable name as
+// value. Template variables may be declared again where Go ones can't,
+// so a name the current block declared already is assigned instead;
+// the earlier variable can't be read anymore either way. Go rejects
+// unused variables, so each is marked used as it is declared.
+func (g *Generator) declareDynamic(name, value string) {
+	goName := sanitizeVarName(name)
+	if n := len(g.DynamicVars); n > 0 {
+		if g.DynamicVars[n-1][goName] {
+			g.Line("%s = %s", goName, value)
+			return
+		}
+		g.DynamicVars[n-1][goName] = true
+	}
+	g.Line("%s := %s", goName, value)
+	g.Line("_ = %s", goName)
+}
+
+// emitDynamicAction handles {{ .Field }} or {{ functionCall }} expressions
+func (g *Generator) emitDynamicAction(action *parse.ActionNode) {
+	resultVar := fmt.Sprintf("result%d", g.NextVar())
+	g.Line("var %s any", resultVar)
+	g.dynamicPipe(resultVar, action.Pipe)
+
+	// Like text/template, a declaration or assignment prints nothing.
+	if decl := action.Pipe.Decl; len(decl) > 0 {
+		if action.Pipe.IsAssign {
+			g.Line("%s = %s", sanitizeVarName(decl[0].Ident[0]), resultVar)
+			return
+		}
+		g.declareDynamic(decl[0].Ident[0], resultVar)
+		return
+	}
+
+	switch escapers := g.Escaping.escapers(action); {
+	case g.Escaping == nil:
+		g.Line("_, err = %s.Fprint(writer, %s)", g.Imports.Add("fmt", ""), resultVar)
+	case len(escapers) > 0:
+		g.Line("err = templates.WriteEscapedWith(writer, %s, %s)", resultVar, strings.Join(escapers, ", "))
+	default:
+		g.Line("err = templates.WriteEscaped(writer, %s)", resultVar)
+	}
+	g.Line("if err != nil { return err }")
+}
+
+// emitDynamicIf handles if/else statements
+func (g *Generator) emitDynamicIf(ifNode *parse.IfNode) {
+	condVar := fmt.Sprintf("cond%d", g.NextVar())
+	resultVar := fmt.Sprintf("ifResult%d", g.NextVar())
+
+	g.Line("// If statement")
+	g.Line("var %s bool", condVar)
+	g.Line("var %s any", resultVar)
+	g.dynamicPipe(resultVar, ifNode.Pipe)
+	g.Line("%s, err = templates.IsTrue(%s)", condVar, resultVar)
+	g.Line("if err != nil { return err }")
+
+	// A variable the pipeline declares is in scope in both branches.
+	g.Line("if %s {", condVar)
+	g.emitDynamicList(ifNode.List, ifNode.Pipe.Decl, resultVar)
+	if ifNode.ElseList != nil {
+		g.Line("} else {")
+		g.emitDynamicList(ifNode.ElseList, ifNode.Pipe.Decl, resultVar)
+	}
+	g.Line("}")
+}
+
+// emitDynamicRange handles range loops. Maps and slices alike are
+// flattened to keys and values first, so the body is emitted once.
+func (g *Generator) emitDynamicRange(rangeNode *parse.RangeNode) {
+	rangeVar := fmt.Sprintf("rangeData%d", g.NextVar())
+	keysVar := fmt.Sprintf("rangeKeys%d", g.NextVar())
+	valuesVar := fmt.Sprintf("rangeValues%d", g.NextVar())
+	indexVar := fmt.Sprintf("rangeIndex%d", g.NextVar())
+	scopeVar := fmt.Sprintf("rangeScope%d", g.NextVar())
+	savedVar := fmt.Sprintf("savedData%d", g.NextVar())
+
+	g.Line("// Range statement")
+	g.Line("var %s any", rangeVar)
+	g.dynamicPipe(rangeVar, rangeNode.Pipe)
+
+	g.Line("var %s, %s []any", keysVar, valuesVar)
+	g.Line("%s, %s, err = templates.RangeItems(%s)", keysVar, valuesVar, rangeVar)
+	g.Line("if err != nil { return err }")
+
+	// Like text/template, a single variable gets the element and two get
+	// the key and the element.
+	var indexVarName, valueVarName string
+	switch len(rangeNode.Pipe.Decl) {
+	case 1:
+		valueVarName = sanitizeVarName(rangeNode.Pipe.Decl[0].Ident[0])
+	case 2:
+		indexVarName = sanitizeVarName(rangeNode.Pipe.Decl[0].Ident[0])
+		valueVarName = sanitizeVarName(rangeNode.Pipe.Decl[1].Ident[0])
+	}
+
+	key := fmt.Sprintf("%s[%s]", keysVar, indexVar)
+	value := fmt.Sprintf("%s[%s]", valuesVar, indexVar)
+	// Each iteration sets data from the saved outer value, and the loop
+	// restores it after, so a {{break}} or {{continue}} that skips the
+	// rest of the body leaves data as it should be.
+	g.Line("%s := data", savedVar)
+	g.Line("for %s := range %s {", indexVar, valuesVar)
+	g.dynamicBlock(func() {
+		if indexVarName != "" {
+			g.declareDynamic(indexVarName, key)
+		}
+		if valueVarName != "" {
+			g.declareDynamic(valueVarName, value)
+		}
+		g.Line("// Create range scope")
+		g.Line("%s := templates.NewRangeScope(%s, %s, %s)", scopeVar, savedVar, key, value)
+		g.Line("data = %s", scopeVar)
+		// No type switch is open in the body, so its {{break}}s need no
+		// label.
+		g.Loops = append(g.Loops, &loopState{})
+		g.Line("// Range body")
+		g.emitDynamic(rangeNode.List.Nodes)
+		g.Loops = g.Loops[:len(g.Loops)-1]
+	})
+	g.Line("}")
+	g.Line("data = %s", savedVar)
+
+	if rangeNode.ElseList != nil {
+		g.Line("if len(%s) == 0 {", valuesVar)
+		g.emitDynamicList(rangeNode.ElseList, nil, "")
+		g.Line("}")
+	}
+}
+
+// emitDynamicWith handles with blocks
+func (g *Generator) emitDynamicWith(withNode *parse.WithNode) {
+	withVar := fmt.Sprintf("withData%d", g.NextVar())
+	condVar := fmt.Sprintf("withCond%d", g.NextVar())
+	savedVar := fmt.Sprintf("savedData%d", g.NextVar())
+
+	g.Line("// With statement")
+	g.Line("var %s any", withVar)
+	g.dynamicPipe(withVar, withNode.Pipe)
+	g.Line("var %s bool", condVar)
+	g.Line("%s, err = templates.IsTrue(%s)", condVar, withVar)
+	g.Line("if err != nil { return err }")
+
+	// A variable the pipeline declares is in scope in both branches.
+	g.Line("if %s {", condVar)
+	g.dynamicBlock(func() {
+		if decl := withNode.Pipe.Decl; len(decl) > 0 {
+			g.declareDynamic(decl[0].Ident[0], withVar)
+		}
+		g.Line("// Save old data context and set new one")
+		g.Line("%s := data", savedVar)
+		g.Line("data = %s", withVar)
+		g.emitDynamic(withNode.List.Nodes)
+		g.Line("data = %s", savedVar)
+	})
+	if withNode.ElseList != nil {
+		g.Line("} else {")
+		g.emitDynamicList(withNode.ElseList, withNode.Pipe.Decl, withVar)
+	}
+	g.Line("}")
+}
+
+// emitDynamicTemplate handles template inclusion
+func (g *Generator) emitDynamicTemplate(tmplNode *parse.TemplateNode) {
+	dataVar := fmt.Sprintf("tmplData%d", g.NextVar())
+
+	g.Line("// Include template: %s", tmplNode.Name)
+	if tmplNode.Pipe != nil && len(tmplNode.Pipe.Cmds) > 0 {
+		g.Line("var %s any", dataVar)
+		g.dynamicPipe(dataVar, tmplNode.Pipe)
+	} else {
+		g.Line("%s := data", dataVar)
+	}
+
+	g.Line("err = t.ExecuteTemplate(writer, %q, %s)", tmplNode.Name, dataVar)
+	g.Line("if err != nil { return err }")
+}
+
+// dynamicPipe writes code that evaluates pipe into the any variable
+// dest. A command after the first must be a function call, which gets
+// the result so far as its last argument.
+func (g *Generator) dynamicPipe(dest string, pipe *parse.PipeNode) {
+	if pipe == nil {
+		return
+	}
+	for i, cmd := range pipe.Cmds {
+		if len(cmd.Args) == 0 {
+			continue
+		}
+		var final []string
+		if i > 0 {
+			final = []string{dest}
+		}
+		if ident, ok := cmd.Args[0].(*parse.IdentifierNode); ok {
+			g.dynamicCall(dest, ident.Ident, cmd.Args[1:], final)
+			continue
+		}
+		if i == 0 {
+			g.dynamicValue(dest, cmd.Args[0])
+		}
+	}
+}
+
+// dynamicCall writes a call of the template function name through the
+// registry, assigning its result to dest.
+func (g *Generator) dynamicCall(dest, name string, args []parse.Node, final []string) {
+	exprs := []string{strconv.Quote(name)}
+	for _, arg := range args {
+		exprs = append(exprs, g.dynamicArg(arg))
+	}
+	exprs = append(exprs, final...)
+	g.Line("%s, err = t.CallFunc(%s)", dest, strings.Join(exprs, ", "))
+	g.Line("if err != nil { return err }")
+}
+
+// dynamicValue writes code that assigns the value of the operand arg to
+// the any variable dest.
+func (g *Generator) dynamicValue(dest string, arg parse.Node) {
+	switch a := arg.(type) {
+	case *parse.FieldNode:
+		g.dynamicField(dest, "data", a.Ident)
+	case *parse.VariableNode:
+		g.dynamicField(dest, sanitizeVarName(a.Ident[0]), a.Ident[1:])
+	case *parse.PipeNode:
+		g.dynamicPipe(dest, a)
+	default:
+		g.Line("%s = %s", dest, g.dynamicArg(arg))
+	}
+}
+
+// dynamicField writes code that assigns the field path idents of the
+// value base to dest.
+func (g *Generator) dynamicField(dest, base string, idents []string) {
+	if len(idents) == 0 {
+		g.Line("%s = %s", dest, base)
+		return
+	}
+	quoted := make([]string, len(idents))
+	for i, ident := range idents {
+		quoted[i] = strconv.Quote(ident)
+	}
+	g.Line("%s, err = templates.EvalField(%s, []string{%s})", dest, base, strings.Join(quoted, ", "))
+	g.Line("if err != nil { return err }")
+}
+
+// dynamicArg returns a Go expression for the operand arg, first writing
+// code that evaluates it into a variable when that takes statements.
+func (g *Generator) dynamicArg(arg parse.Node) string {
+	switch a := arg.(type) {
+	case *parse.DotNode:
+		return "templates.Dot(data)"
+	case *parse.VariableNode:
+		if len(a.Ident) == 1 {
+			return sanitizeVarName(a.Ident[0])
+		}
+	case *parse.FieldNode, *parse.PipeNode:
+	case *parse.StringNode:
+		return a.Quoted
+	case *parse.BoolNode:
+		return strconv.FormatBool(a.True)
+	case *parse.NilNode:
+		return "nil"
+	case *parse.NumberNode:
+		// As in text/template, integers are int and other numbers
+		// float64.
+		switch {
+		case a.IsInt:
+			return strconv.FormatInt(a.Int64, 10)
+		case a.IsFloat:
+			return fmt.Sprintf("float64(%s)", strconv.FormatFloat(a.Float64, 'g', -1, 64))
+		}
+		g.Line("// Unsupported number: %s", a.Text)
+		return "nil"
+	default:
+		g.Line("// Unsupported node type: %T", arg)
+		return "nil"
+	}
+
+	argVar := fmt.Sprintf("arg%d", g.NextVar())
+	g.Line("var %s any", argVar)
+	g.dynamicValue(argVar, arg)
+	return argVar
+}
+
+// sanitizeVarName turns a template variable like $item into the Go
+// identifier dynamic code holds it in.
+func sanitizeVarName(varName string) string {
+	if strings.HasPrefix(varName, "$") {
+		return "var_" + varName[1:]
+	}
+	return varName
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"text/template/parse"
+)
+
+// Escaping is how html/template escapes a typed template: the escapers
+// it appends to each action that prints, by the templates.Escaper
+// constants typed code applies in their place, and the text it
+// rewrites, such as HTML comments it strips. An action printed in HTML
+// text has no escapers; typed code escapes it as text without help.
+type Escaping struct {
+	Actions map[*parse.ActionNode][]string
+	Texts   map[*parse.TextNode][]byte
+}
+
+// escapers returns the templates.Escaper constants for n, or nil when
+// n prints into HTML text.
+func (e *Escaping) escapers(n *parse.ActionNode) []string {
+	if e == nil {
+		return nil
+	}
+	return e.Actions[n]
+}
+
+// text returns the text n writes once escaped.
+func (e *Escaping) text(n *parse.TextNode) []byte {
+	if e == nil {
+		return n.Text
+	}
+	if text, ok := e.Texts[n]; ok {
+		return text
+	}
+	return n.Text
+}
+
+// runtimeEscapers maps html/template's escaping functions to the
+// templates.Escaper constants that port them.
+var runtimeEscapers = map[string]string{
+	"_html_template_attrescaper":    "templates.EscapeAttr",
+	"_html_template_nospaceescaper": "templates.EscapeUnquotedAttr",
+	"_html_template_rcdataescaper":  "templates.EscapeRCDATA",
+	"_html_template_urlfilter":      "templates.FilterURL",
+	"_html_template_urlnormalizer":  "templates.NormalizeURL",
+	"_html_template_urlescaper":     "templates.EscapeURL",
+	"_html_template_jsstrescaper":   "templates.EscapeJSString",
+	"_html_template_jsvalescaper":   "templates.EscapeJSValue",
+	"_html_template_cssescaper":     "templates.EscapeCSS",
+	"_html_template_cssvaluefilter": "templates.FilterCSSValue",
+	"_html_template_commentescaper": "templates.EscapeComment",
+}
+
+// unportedEscapers names the contexts of html/template's escaping
+// functions that templates doesn't port.
+var unportedEscapers = map[string]string{
+	"_html_template_htmlnamefilter":   "an attribute name",
+	"_html_template_srcsetescaper":    "a srcset attribute",
+	"_html_template_jsregexpescaper":  "a JavaScript regular expression",
+	"_html_template_jstmpllitescaper": "a JavaScript template literal",
+}
+
+// escapeProbeName names the template escapeTemplate executes to have
+// html/template escape the template it calls.
+const escapeProbeName = "$comtmpl_escape"
+
+// escapeTemplate has html/template escape rt as it would before
+// executing it, and returns what that changed. set holds every parsed
+// template, as rt may call any of them; it is left as it is, since
+// html/template escapes copies. byFile maps file base names to their
+// templates, to position errors in the templates rt calls.
+//
+// html/template only escapes when executing, so it executes a probe
+// that calls rt in a branch never taken.
+func escapeTemplate(set *template.Template, rt *resolvedTemplate, byFile map[string]*resolvedTemplate) (*Escaping, error) {
+	escaped := template.New("")
+	var tree *parse.Tree
+	for _, t := range set.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		copied := t.Tree.Copy()
+		if t.Name() == rt.BaseName {
+			tree = copied
+		}
+		if _, err := escaped.AddParseTree(t.Name(), copied); err != nil {
+			return nil, err
+		}
+	}
+	probe, err := escaped.New(escapeProbeName).Parse(fmt.Sprintf("{{if false}}{{template %q .}}{{end}}", rt.BaseName))
+	if err != nil {
+		return nil, err
+	}
+	if err := probe.Execute(io.Discard, nil); err != nil {
+		return nil, Diagnostics{escapeDiagnostic(err, rt, byFile)}
+	}
+
+	e := &Escaping{Actions: map[*parse.ActionNode][]string{}, Texts: map[*parse.TextNode][]byte{}}
+	var diags Diagnostics
+	e.record(rt.Tree.Root, tree.Root, func(n parse.Node, err error) {
+		diags = append(diags, nodeDiagnostic(rt.Filename, rt.LineIndex, int64(n.Position()), err))
+	})
+	if len(diags) > 0 {
+		return nil, diags
+	}
+	return e, nil
+}
+
+// escapeDiagnostic positions err, which html/template returned escaping
+// rt, in the file of the node it names.
+func escapeDiagnostic(err error, rt *resolvedTemplate, byFile map[string]*resolvedTemplate) Diagnostic {
+	var escErr *template.Error
+	if !errors.As(err, &escErr) || escErr.Node == nil {
+		return Diagnostic{File: rt.Filename, Message: err.Error()}
+	}
+	// The location is "file:line:col", but its line counts any @param
+	// declarations parsed in front of the file, so only the name is used.
+	loc, _ := (*parse.Tree)(nil).ErrorContext(escErr.Node)
+	for range 2 {
+		if i := strings.LastIndexByte(loc, ':'); i >= 0 {
+			loc = loc[:i]
+		}
+	}
+	if loc == escapeProbeName {
+		// The probe's branches end in different contexts.
+		return Diagnostic{File: rt.Filename, Message: fmt.Sprintf("html/template: %s ends in a non-text context", rt.where())}
+	}
+	file, ok := byFile[loc]
+	if !ok {
+		return Diagnostic{File: rt.Filename, Message: err.Error()}
+	}
+	return nodeDiagnostic(file.Filename, file.LineIndex, int64(escErr.Node.Position()), errors.New("html/template: "+escErr.Description))
+}
+
+// record walks orig and its escaped copy together, noting what
+// html/template changed and reporting to fail what typed code can't do
+// likewise.
+func (e *Escaping) record(orig, escaped parse.Node, fail func(parse.Node, error)) {
+	switch o := orig.(type) {
+	case *parse.ListNode:
+		if o == nil {
+			return
+		}
+		for i, n := range o.Nodes {
+			e.record(n, escaped.(*parse.ListNode).Nodes[i], fail)
+		}
+	case *parse.IfNode:
+		e.recordBranch(&o.BranchNode, &escaped.(*parse.IfNode).BranchNode, fail)
+	case *parse.RangeNode:
+		e.recordBranch(&o.BranchNode, &escaped.(*parse.RangeNode).BranchNode, fail)
+	case *parse.WithNode:
+		e.recordBranch(&o.BranchNode, &escaped.(*parse.WithNode).BranchNode, fail)
+	case *parse.TextNode:
+		if text := escaped.(*parse.TextNode).Text; !bytes.Equal(text, o.Text) {
+			e.Texts[o] = text
+		}
+	case *parse.TemplateNode:
+		// html/template calls a copy escaped for the context of the
+		// call, but a typed template is only compiled for HTML text.
+		if escaped.(*parse.TemplateNode).Name != o.Name {
+			fail(o, fmt.Errorf("typed mode can only call %q in HTML text, not inside a tag, script or style", o.Name))
+		}
+	case *parse.ActionNode:
+		if len(o.Pipe.Decl) > 0 {
+			return
+		}
+		escapers, err := escapersFor(o, escaped.(*parse.ActionNode).Pipe.Cmds[len(o.Pipe.Cmds):])
+		if err != nil {
+			fail(o, err)
+			return
+		}
+		e.Actions[o] = escapers
+	}
+}
+
+func (e *Escaping) recordBranch(orig, escaped *parse.BranchNode, fail func(parse.Node, error)) {
+	e.record(orig.List, escaped.List, fail)
+	e.record(orig.ElseList, escaped.ElseList, fail)
+}
+
+// escapersFor returns the templates.Escaper constants for the commands
+// html/template appended to n.
+func escapersFor(n *parse.ActionNode, cmds []*parse.CommandNode) ([]string, error) {
+	for _, cmd := range n.Pipe.Cmds {
+		// html/template merges these into its own escapers.
+		if ident, ok := cmd.Args[0].(*parse.IdentifierNode); ok && (ident.Ident == "html" || ident.Ident == "urlquery") {
+			return nil, fmt.Errorf("typed templates escape what they print; remove %s from %s", ident.Ident, n)
+		}
+	}
+	names := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		names[i] = cmd.String()
+	}
+	if len(names) == 1 && names[0] == "_html_template_htmlescaper" {
+		return nil, nil
+	}
+	var escapers []string
+	for _, name := range names {
+		if where, ok := unportedEscapers[name]; ok {
+			return nil, fmt.Errorf("typed mode can't print %s in %s", n, where)
+		}
+		escaper, ok := runtimeEscapers[name]
+		if !ok {
+			return nil, fmt.Errorf("typed mode can't print %s where html/template escapes it with %q", n, names)
+		}
+		escapers = append(escapers, escaper)
+	}
+	if len(escapers) == 0 {
+		return nil, fmt.Errorf("typed mode can't print %s where html/template leaves it unescaped", n)
+	}
+	return escapers, nil
+}
@@ -10,13 +10,13 @@ var Parsed = templates.NewTemplates(map[string]templates.Template{
 	"complex.html": func(t *templates.Templates, writer io.Writer, data any) error {
 		var err error
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:1
+//line complex.html:1
 		_, err = io.WriteString(writer, "<!DOCTYPE html>\n<html>\n<head>\n  <title>")
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:4
+//line complex.html:4
 		var result0 any
 		result0, err = templates.EvalField(data, []string{"Title"})
 		if err != nil {
@@ -27,13 +27,13 @@ var Parsed = templates.NewTemplates(map[string]templates.Template{
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:4
+//line complex.html:4
 		_, err = io.WriteString(writer, " - Complex Template Example</title>\n  <style>\n    .highlight { color: blue; }\n    .error { color: red; }\n  </style>\n</head>\n<body>\n  <h1>")
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:11
+//line complex.html:11
 		var result1 any
 		result1, err = templates.EvalField(data, []string{"Title"})
 		if err != nil {
@@ -44,19 +44,19 @@ var Parsed = templates.NewTemplates(map[string]templates.Template{
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:11
+//line complex.html:11
 		_, err = io.WriteString(writer, "</h1>\n  \n  ")
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:13
+//line complex.html:13
 		_, err = io.WriteString(writer, "\n  \n  <!-- Conditional logic -->\n  <div class=\"user-info\">\n    ")
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:17
+//line complex.html:17
 		// If statement
 		var cond2 bool
 		var ifResult3 any
@@ -70,13 +70,13 @@ var Parsed = templates.NewTemplates(map[string]templates.Template{
 		}
 		if cond2 {
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:17
+//line complex.html:17
 			_, err = io.WriteString(writer, "\n      <p>Welcome, <span class=\"highlight\">")
 			if err != nil {
 				return err
 			}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:18
+//line complex.html:18
 			var result4 any
 			result4, err = templates.EvalField(data, []string{"User", "Name"})
 			if err != nil {
@@ -87,13 +87,13 @@ var Parsed = templates.NewTemplates(map[string]templates.Template{
 				return err
 			}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:18
+//line complex.html:18
 			_, err = io.WriteString(writer, "</span>!</p>\n      \n      ")
 			if err != nil {
 				return err
 			}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:20
+//line complex.html:20
 			// If statement
 			var cond5 bool
 			var ifResult6 any
@@ -107,605 +107,363 @@ var Parsed = templates.NewTemplates(map[string]templates.Template{
 			}
 			if cond5 {
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:20
+//line complex.html:20
 				_, err = io.WriteString(writer, "\n        <p class=\"highlight\">You have admin privileges</p>\n      ")
 				if err != nil {
 					return err
 				}
 			} else {
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:22
+//line complex.html:22
 				_, err = io.WriteString(writer, "\n        <p>You are a regular user</p>\n      ")
 				if err != nil {
 					return err
 				}
 			}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:24
+//line complex.html:24
 			_, err = io.WriteString(writer, "\n      \n      ")
 			if err != nil {
 				return err
 			}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:26
+//line complex.html:26
 			// With statement
 			var withData7 any
 			withData7, err = templates.EvalField(data, []string{"User", "Contact"})
 			if err != nil {
 				return err
 			}
-			withCond8, err := templates.IsTrue(withData7)
+			var withCond8 bool
+			withCond8, err = templates.IsTrue(withData7)
 			if err != nil {
 				return err
 			}
 			if withCond8 {
 				// Save old data context and set new one
-				oldData := data
+				savedData9 := data
 				data = withData7
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:26
+//line complex.html:26
 				_, err = io.WriteString(writer, "\n        <div class=\"contact\">\n          <h3>Contact Information:</h3>\n          <p>Email: ")
 				if err != nil {
 					return err
 				}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:29
-				var result9 any
-				result9, err = templates.EvalField(data, []string{"Email"})
+//line complex.html:29
+				var result10 any
+				result10, err = templates.EvalField(data, []string{"Email"})
 				if err != nil {
 					return err
 				}
-				_, err = fmt.Fprint(writer, result9)
+				_, err = fmt.Fprint(writer, result10)
 				if err != nil {
 					return err
 				}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:29
+//line complex.html:29
 				_, err = io.WriteString(writer, "</p>\n          <p>Phone: ")
 				if err != nil {
 					return err
 				}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:30
-				var result10 any
-				result10, err = templates.EvalField(data, []string{"Phone"})
+//line complex.html:30
+				var result11 any
+				result11, err = templates.EvalField(data, []string{"Phone"})
 				if err != nil {
 					return err
 				}
-				_, err = fmt.Fprint(writer, result10)
+				_, err = fmt.Fprint(writer, result11)
 				if err != nil {
 					return err
 				}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:30
+//line complex.html:30
 				_, err = io.WriteString(writer, "</p>\n        </div>\n      ")
 				if err != nil {
 					return err
 				}
-				data = oldData
+				data = savedData9
 			} else {
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:32
+//line complex.html:32
 				_, err = io.WriteString(writer, "\n        <p class=\"error\">No contact information available</p>\n      ")
 				if err != nil {
 					return err
 				}
 			}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:34
+//line complex.html:34
 			_, err = io.WriteString(writer, "\n    ")
 			if err != nil {
 				return err
 			}
 		} else {
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:35
+//line complex.html:35
 			_, err = io.WriteString(writer, "\n      <p class=\"error\">No user information available</p>\n    ")
 			if err != nil {
 				return err
 			}
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:37
+//line complex.html:37
 		_, err = io.WriteString(writer, "\n  </div>\n  \n  <!-- Range loop for items -->\n  <div class=\"items\">\n    <h2>Your Items:</h2>\n    ")
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:43
+//line complex.html:43
 		// Range statement
-		var rangeData11 any
-		rangeData11, err = templates.EvalField(data, []string{"Items"})
+		var rangeData12 any
+		rangeData12, err = templates.EvalField(data, []string{"Items"})
 		if err != nil {
 			return err
 		}
-		iter12, err := templates.GetIterable(rangeData11)
+		var rangeKeys13, rangeValues14 []any
+		rangeKeys13, rangeValues14, err = templates.RangeItems(rangeData12)
 		if err != nil {
 			return err
 		}
-		hasItems := false
-		var var_index any // Template variable for index: $index
-		var var_item any  // Template variable for value: $item
+		savedData17 := data
+		for rangeIndex15 := range rangeValues14 {
+			var_index := rangeKeys13[rangeIndex15]
+			_ = var_index
+			var_item := rangeValues14[rangeIndex15]
+			_ = var_item
+			// Create range scope
+			rangeScope16 := templates.NewRangeScope(savedData17, rangeKeys13[rangeIndex15], rangeValues14[rangeIndex15])
+			data = rangeScope16
+			// Range body
 
-		if mapData, isMap := iter12.(map[string]any); isMap {
-			for k, v := range mapData {
-				hasItems = true
-				var_index = k
-				var_item = v
+//line complex.html:43
+			_, err = io.WriteString(writer, "\n      <div class=\"item\">\n        <h3>")
+			if err != nil {
+				return err
+			}
 
-				// Create range scope
-				rangeContext := templates.NewRangeScope(data, k, v)
-				oldData := data
-				data = rangeContext
-				// Range body
+//line complex.html:45
+			var result18 any
+			result18 = var_index
+			_, err = fmt.Fprint(writer, result18)
+			if err != nil {
+				return err
+			}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:43
-				_, err = io.WriteString(writer, "\n      <div class=\"item\">\n        <h3>")
-				if err != nil {
-					return err
-				}
+//line complex.html:45
+			_, err = io.WriteString(writer, ". ")
+			if err != nil {
+				return err
+			}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:45
-				var result14 any = var_index // Variable reference
-				_, err = fmt.Fprint(writer, result14)
-				if err != nil {
-					return err
-				}
+//line complex.html:45
+			var result19 any
+			result19, err = templates.EvalField(var_item, []string{"Name"})
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprint(writer, result19)
+			if err != nil {
+				return err
+			}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:45
-				_, err = io.WriteString(writer, ". ")
-				if err != nil {
-					return err
-				}
+//line complex.html:45
+			_, err = io.WriteString(writer, "</h3>\n        <p>Price: $")
+			if err != nil {
+				return err
+			}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:45
-				var result15 any
-				result15, err = templates.EvalField(var_item, []string{"Name"})
-				if err != nil {
-					return err
-				}
-				_, err = fmt.Fprint(writer, result15)
-				if err != nil {
-					return err
-				}
+//line complex.html:46
+			var result20 any
+			result20, err = templates.EvalField(var_item, []string{"Price"})
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprint(writer, result20)
+			if err != nil {
+				return err
+			}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:45
-				_, err = io.WriteString(writer, "</h3>\n        <p>Price: $")
-				if err != nil {
-					return err
-				}
+//line complex.html:46
+			_, err = io.WriteString(writer, "</p>\n        \n        ")
+			if err != nil {
+				return err
+			}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:46
-				var result16 any
-				result16, err = templates.EvalField(var_item, []string{"Price"})
-				if err != nil {
-					return err
-				}
-				_, err = fmt.Fprint(writer, result16)
-				if err != nil {
-					return err
-				}
+//line complex.html:48
+			// If statement
+			var cond21 bool
+			var ifResult22 any
+			ifResult22, err = templates.EvalField(var_item, []string{"OnSale"})
+			if err != nil {
+				return err
+			}
+			cond21, err = templates.IsTrue(ifResult22)
+			if err != nil {
+				return err
+			}
+			if cond21 {
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:46
-				_, err = io.WriteString(writer, "</p>\n        \n        ")
+//line complex.html:48
+				_, err = io.WriteString(writer, "\n          <p class=\"highlight\">ON SALE!</p>\n        ")
 				if err != nil {
 					return err
 				}
+			}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:48
-				// If statement
-				var cond17 bool
-				var ifResult18 any
-				ifResult18, err = templates.EvalField(var_item, []string{"OnSale"})
-				if err != nil {
-					return err
-				}
-				cond17, err = templates.IsTrue(ifResult18)
-				if err != nil {
-					return err
-				}
-				if cond17 {
+//line complex.html:50
+			_, err = io.WriteString(writer, "\n        \n        <!-- Nested range for item tags -->\n        ")
+			if err != nil {
+				return err
+			}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:48
-					_, err = io.WriteString(writer, "\n          <p class=\"highlight\">ON SALE!</p>\n        ")
-					if err != nil {
-						return err
-					}
-				}
+//line complex.html:53
+			// If statement
+			var cond23 bool
+			var ifResult24 any
+			ifResult24, err = templates.EvalField(var_item, []string{"Tags"})
+			if err != nil {
+				return err
+			}
+			cond23, err = templates.IsTrue(ifResult24)
+			if err != nil {
+				return err
+			}
+			if cond23 {
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:50
-				_, err = io.WriteString(writer, "\n        \n        <!-- Nested range for item tags -->\n        ")
+//line complex.html:53
+				_, err = io.WriteString(writer, "\n          <p>Tags:</p>\n          <ul>\n            ")
 				if err != nil {
 					return err
 				}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:53
-				// If statement
-				var cond19 bool
-				var ifResult20 any
-				ifResult20, err = templates.EvalField(var_item, []string{"Tags"})
+//line complex.html:56
+				// Range statement
+				var rangeData25 any
+				rangeData25, err = templates.EvalField(var_item, []string{"Tags"})
 				if err != nil {
 					return err
 				}
-				cond19, err = templates.IsTrue(ifResult20)
+				var rangeKeys26, rangeValues27 []any
+				rangeKeys26, rangeValues27, err = templates.RangeItems(rangeData25)
 				if err != nil {
 					return err
 				}
-				if cond19 {
+				savedData30 := data
+				for rangeIndex28 := range rangeValues27 {
+					// Create range scope
+					rangeScope29 := templates.NewRangeScope(savedData30, rangeKeys26[rangeIndex28], rangeValues27[rangeIndex28])
+					data = rangeScope29
+					// Range body
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:53
-					_, err = io.WriteString(writer, "\n          <p>Tags:</p>\n          <ul>\n            ")
+//line complex.html:56
+					_, err = io.WriteString(writer, "\n              <li>")
 					if err != nil {
 						return err
 					}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:56
-					// Range statement
-					var rangeData21 any
-					rangeData21, err = templates.EvalField(var_item, []string{"Tags"})
-					if err != nil {
-						return err
-					}
-					iter22, err := templates.GetIterable(rangeData21)
+//line complex.html:57
+					var result31 any
+					result31 = templates.Dot(data)
+					_, err = fmt.Fprint(writer, result31)
 					if err != nil {
 						return err
 					}
 
-					if mapData, isMap := iter22.(map[string]any); isMap {
-						for k, v := range mapData {
-
-							// Create range scope
-							rangeContext := templates.NewRangeScope(data, k, v)
-							oldData := data
-							data = rangeContext
-							// Range body
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:56
-							_, err = io.WriteString(writer, "\n              <li>")
-							if err != nil {
-								return err
-							}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:57
-							var result24 any = templates.Dot(data)
-							_, err = fmt.Fprint(writer, result24)
-							if err != nil {
-								return err
-							}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:57
-							_, err = io.WriteString(writer, "</li>\n            ")
-							if err != nil {
-								return err
-							}
-							data = oldData
-						}
-
-					} else if sliceData, isSlice := iter22.([]any); isSlice {
-						for i, v := range sliceData {
-
-							// Create range scope
-							rangeContext := templates.NewRangeScope(data, i, v)
-							oldData := data
-							data = rangeContext
-							// Range body
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:56
-							_, err = io.WriteString(writer, "\n              <li>")
-							if err != nil {
-								return err
-							}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:57
-							var result25 any = templates.Dot(data)
-							_, err = fmt.Fprint(writer, result25)
-							if err != nil {
-								return err
-							}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:57
-							_, err = io.WriteString(writer, "</li>\n            ")
-							if err != nil {
-								return err
-							}
-							data = oldData
-						}
-					}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:58
-					_, err = io.WriteString(writer, "\n          </ul>\n        ")
+//line complex.html:57
+					_, err = io.WriteString(writer, "</li>\n            ")
 					if err != nil {
 						return err
 					}
-				} else {
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:60
-					_, err = io.WriteString(writer, "\n          <p>No tags available</p>\n        ")
-					if err != nil {
-						return err
-					}
-				}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:62
-				_, err = io.WriteString(writer, "\n      </div>\n    ")
-				if err != nil {
-					return err
-				}
-				data = oldData
-			}
-
-		} else if sliceData, isSlice := iter12.([]any); isSlice {
-			for i, v := range sliceData {
-				hasItems = true
-				var_index = i
-				var_item = v
-
-				// Create range scope
-				rangeContext := templates.NewRangeScope(data, i, v)
-				oldData := data
-				data = rangeContext
-				// Range body
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:43
-				_, err = io.WriteString(writer, "\n      <div class=\"item\">\n        <h3>")
-				if err != nil {
-					return err
-				}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:45
-				var result26 any = var_index // Variable reference
-				_, err = fmt.Fprint(writer, result26)
-				if err != nil {
-					return err
-				}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:45
-				_, err = io.WriteString(writer, ". ")
-				if err != nil {
-					return err
-				}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:45
-				var result27 any
-				result27, err = templates.EvalField(var_item, []string{"Name"})
-				if err != nil {
-					return err
-				}
-				_, err = fmt.Fprint(writer, result27)
-				if err != nil {
-					return err
-				}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:45
-				_, err = io.WriteString(writer, "</h3>\n        <p>Price: $")
-				if err != nil {
-					return err
-				}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:46
-				var result28 any
-				result28, err = templates.EvalField(var_item, []string{"Price"})
-				if err != nil {
-					return err
-				}
-				_, err = fmt.Fprint(writer, result28)
-				if err != nil {
-					return err
-				}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:46
-				_, err = io.WriteString(writer, "</p>\n        \n        ")
-				if err != nil {
-					return err
 				}
+				data = savedData30
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:48
-				// If statement
-				var cond29 bool
-				var ifResult30 any
-				ifResult30, err = templates.EvalField(var_item, []string{"OnSale"})
-				if err != nil {
-					return err
-				}
-				cond29, err = templates.IsTrue(ifResult30)
-				if err != nil {
-					return err
-				}
-				if cond29 {
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:48
-					_, err = io.WriteString(writer, "\n          <p class=\"highlight\">ON SALE!</p>\n        ")
-					if err != nil {
-						return err
-					}
-				}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:50
-				_, err = io.WriteString(writer, "\n        \n        <!-- Nested range for item tags -->\n        ")
+//line complex.html:58
+				_, err = io.WriteString(writer, "\n          </ul>\n        ")
 				if err != nil {
 					return err
 				}
+			} else {
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:53
-				// If statement
-				var cond31 bool
-				var ifResult32 any
-				ifResult32, err = templates.EvalField(var_item, []string{"Tags"})
-				if err != nil {
-					return err
-				}
-				cond31, err = templates.IsTrue(ifResult32)
+//line complex.html:60
+				_, err = io.WriteString(writer, "\n          <p>No tags available</p>\n        ")
 				if err != nil {
 					return err
 				}
-				if cond31 {
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:53
-					_, err = io.WriteString(writer, "\n          <p>Tags:</p>\n          <ul>\n            ")
-					if err != nil {
-						return err
-					}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:56
-					// Range statement
-					var rangeData33 any
-					rangeData33, err = templates.EvalField(var_item, []string{"Tags"})
-					if err != nil {
-						return err
-					}
-					iter34, err := templates.GetIterable(rangeData33)
-					if err != nil {
-						return err
-					}
-
-					if mapData, isMap := iter34.(map[string]any); isMap {
-						for k, v := range mapData {
-
-							// Create range scope
-							rangeContext := templates.NewRangeScope(data, k, v)
-							oldData := data
-							data = rangeContext
-							// Range body
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:56
-							_, err = io.WriteString(writer, "\n              <li>")
-							if err != nil {
-								return err
-							}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:57
-							var result36 any = templates.Dot(data)
-							_, err = fmt.Fprint(writer, result36)
-							if err != nil {
-								return err
-							}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:57
-							_, err = io.WriteString(writer, "</li>\n            ")
-							if err != nil {
-								return err
-							}
-							data = oldData
-						}
-
-					} else if sliceData, isSlice := iter34.([]any); isSlice {
-						for i, v := range sliceData {
-
-							// Create range scope
-							rangeContext := templates.NewRangeScope(data, i, v)
-							oldData := data
-							data = rangeContext
-							// Range body
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:56
-							_, err = io.WriteString(writer, "\n              <li>")
-							if err != nil {
-								return err
-							}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:57
-							var result37 any = templates.Dot(data)
-							_, err = fmt.Fprint(writer, result37)
-							if err != nil {
-								return err
-							}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:57
-							_, err = io.WriteString(writer, "</li>\n            ")
-							if err != nil {
-								return err
-							}
-							data = oldData
-						}
-					}
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:58
-					_, err = io.WriteString(writer, "\n          </ul>\n        ")
-					if err != nil {
-						return err
-					}
-				} else {
-
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:60
-					_, err = io.WriteString(writer, "\n          <p>No tags available</p>\n        ")
-					if err != nil {
-						return err
-					}
-				}
+			}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:62
-				_, err = io.WriteString(writer, "\n      </div>\n    ")
-				if err != nil {
-					return err
-				}
-				data = oldData
+//line complex.html:62
+			_, err = io.WriteString(writer, "\n      </div>\n    ")
+			if err != nil {
+				return err
 			}
 		}
-		if !hasItems {
+		data = savedData17
+		if len(rangeValues14) == 0 {
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:64
+//line complex.html:64
 			_, err = io.WriteString(writer, "\n      <p class=\"error\">No items in your cart</p>\n    ")
 			if err != nil {
 				return err
 			}
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:66
+//line complex.html:66
 		_, err = io.WriteString(writer, "\n  </div>\n  \n  <!-- Function calls and pipes -->\n  <div class=\"footer\">\n    <p>Copyright &copy; ")
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:71
-		var result38 any
-		result38, err = templates.EvalField(data, []string{"Year"})
+//line complex.html:71
+		var result32 any
+		result32, err = templates.EvalField(data, []string{"Year"})
 		if err != nil {
 			return err
 		}
-		_, err = fmt.Fprint(writer, result38)
+		_, err = fmt.Fprint(writer, result32)
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:71
+//line complex.html:71
 		_, err = io.WriteString(writer, " ")
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:71
-		var result39 any
-		result39, err = templates.EvalField(data, []string{"Company"})
+//line complex.html:71
+		var result33 any
+		result33, err = templates.EvalField(data, []string{"Company"})
 		if err != nil {
 			return err
 		}
-		result39, err = t.CallFunc("upper", result39)
+		result33, err = t.CallFunc("upper", result33)
 		if err != nil {
 			return err
 		}
-		_, err = fmt.Fprint(writer, result39)
+		_, err = fmt.Fprint(writer, result33)
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:71
+//line complex.html:71
 		_, err = io.WriteString(writer, "</p>\n    <p>")
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:72
-		var result40 any
-		result40, err = templates.EvalField(data, []string{"Description"})
+//line complex.html:72
+		var result34 any
+		result34, err = templates.EvalField(data, []string{"Description"})
 		if err != nil {
 			return err
 		}
-		_, err = fmt.Fprint(writer, result40)
+		_, err = fmt.Fprint(writer, result34)
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/complex.html:72
+//line complex.html:72
 		_, err = io.WriteString(writer, "</p>\n  </div>\n</body>\n</html>")
 		if err != nil {
 			return err
@@ -716,13 +474,13 @@ var Parsed = templates.NewTemplates(map[string]templates.Template{
 	"index.html": func(t *templates.Templates, writer io.Writer, data any) error {
 		var err error
 
-//line /Users/jtarchie/workspace/comtmpl/examples/index.html:1
+//line index.html:1
 		_, err = io.WriteString(writer, "<html>\n  <head>\n    <title>")
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/index.html:3
+//line index.html:3
 		var result0 any
 		result0, err = templates.EvalField(data, []string{"Title"})
 		if err != nil {
@@ -733,13 +491,13 @@ var Parsed = templates.NewTemplates(map[string]templates.Template{
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/index.html:3
+//line index.html:3
 		_, err = io.WriteString(writer, "</title>\n  </head>\n  <body>\n    <h1>")
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/index.html:6
+//line index.html:6
 		var result1 any
 		result1, err = templates.EvalField(data, []string{"Title"})
 		if err != nil {
@@ -750,13 +508,13 @@ var Parsed = templates.NewTemplates(map[string]templates.Template{
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/index.html:6
+//line index.html:6
 		_, err = io.WriteString(writer, "</h1>\n    <p>Welcome, ")
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/index.html:7
+//line index.html:7
 		var result2 any
 		result2, err = templates.EvalField(data, []string{"User", "Name"})
 		if err != nil {
@@ -767,7 +525,7 @@ var Parsed = templates.NewTemplates(map[string]templates.Template{
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/index.html:7
+//line index.html:7
 		_, err = io.WriteString(writer, "!</p>\n  </body>\n</html>\n")
 		if err != nil {
 			return err
@@ -778,13 +536,13 @@ var Parsed = templates.NewTemplates(map[string]templates.Template{
 	"pipe.html": func(t *templates.Templates, writer io.Writer, data any) error {
 		var err error
 
-//line /Users/jtarchie/workspace/comtmpl/examples/pipe.html:1
+//line pipe.html:1
 		_, err = io.WriteString(writer, "<html>\n  <head>\n    <title>")
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/pipe.html:3
+//line pipe.html:3
 		var result0 any
 		result0, err = templates.EvalField(data, []string{"Title"})
 		if err != nil {
@@ -799,13 +557,13 @@ var Parsed = templates.NewTemplates(map[string]templates.Template{
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/pipe.html:3
+//line pipe.html:3
 		_, err = io.WriteString(writer, "</title>\n  </head>\n  <body>\n    <h1>")
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/pipe.html:6
+//line pipe.html:6
 		var result1 any
 		result1, err = templates.EvalField(data, []string{"Title"})
 		if err != nil {
@@ -816,13 +574,13 @@ var Parsed = templates.NewTemplates(map[string]templates.Template{
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/pipe.html:6
+//line pipe.html:6
 		_, err = io.WriteString(writer, "</h1>\n    <p>Name length: ")
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/pipe.html:7
+//line pipe.html:7
 		var result2 any
 		result2, err = templates.EvalField(data, []string{"User", "Name"})
 		if err != nil {
@@ -837,13 +595,13 @@ var Parsed = templates.NewTemplates(map[string]templates.Template{
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/pipe.html:7
+//line pipe.html:7
 		_, err = io.WriteString(writer, "</p>\n    <p>")
 		if err != nil {
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/pipe.html:8
+//line pipe.html:8
 		var result3 any
 		result3, err = templates.EvalField(data, []string{"User", "Description"})
 		if err != nil {
@@ -858,7 +616,7 @@ var Parsed = templates.NewTemplates(map[string]templates.Template{
 			return err
 		}
 
-//line /Users/jtarchie/workspace/comtmpl/examples/pipe.html:8
+//line pipe.html:8
 		_, err = io.WriteString(writer, "</p>\n  </body>\n</html>\n")
 		if err != nil {
 			return err
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-task/slim-sprig/v3"
+)
+
+// fuzzDriver is a tiny program compiled next to the generated registry.
+// It renders fuzz.html with data.json through html/template, text/template
+// printing as html/template does but unescaped, and the generated
+// registry, and prints a fuzzReport as JSON. The data
+// is decoded into models.Page for a template declaring @data, which is
+// its type, and into plain JSON values otherwise, so every renderer gets
+// the same value. Data that doesn't decode exits with status 3; anything
+// else non-zero is a crash.
+const fuzzDriver = `package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	textTemplate "text/template"
+	"text/template/parse"
+
+	"github.com/go-task/slim-sprig/v3"
+
+	"testpkg"
+	"testpkg/models"
+)
+
+func main() {
+	src, err := os.ReadFile("fuzz.html")
+	if err != nil {
+		panic(err)
+	}
+	raw, err := os.ReadFile("data.json")
+	if err != nil {
+		panic(err)
+	}
+	var data any
+	if bytes.Contains(src, []byte("@data")) {
+		var page models.Page
+		err = json.Unmarshal(raw, &page)
+		data = page
+	} else {
+		err = json.Unmarshal(raw, &data)
+	}
+	if err != nil {
+		os.Exit(3)
+	}
+
+	var report struct {
+		Want, Unescaped, Got          string
+		WantErr, UnescapedErr, GotErr string
+		Rejected                      bool
+	}
+	errString := func(err error) string {
+		if err == nil {
+			return ""
+		}
+		return err.Error()
+	}
+	var out bytes.Buffer
+	std := template.Must(template.New("fuzz.html").Funcs(sprig.FuncMap()).Parse(string(src)))
+	err = std.Execute(&out, data)
+	report.WantErr = errString(err)
+	report.Want = out.String()
+	// Escaping fails with a *template.Error; executing doesn't.
+	var escapeErr *template.Error
+	report.Rejected = errors.As(err, &escapeErr)
+
+	out.Reset()
+	text := textTemplate.Must(textTemplate.New("fuzz.html").Funcs(sprig.FuncMap()).
+		Funcs(textTemplate.FuncMap{"unescaped": unescaped}).Parse(string(src)))
+	for _, t := range text.Templates() {
+		if t.Tree != nil {
+			printUnescaped(t.Tree.Root)
+		}
+	}
+	report.UnescapedErr = errString(text.Execute(&out, data))
+	report.Unescaped = out.String()
+
+	out.Reset()
+	testpkg.Parsed.Funcs(sprig.FuncMap())
+	report.GotErr = errString(testpkg.Parsed.ExecuteTemplate(&out, "fuzz.html", data))
+	report.Got = out.String()
+
+	if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+		panic(err)
+	}
+}
+
+// unescaped prints its arguments as html/template's escapers do before
+// escaping them: a missing value or untyped nil prints nothing.
+func unescaped(args ...any) string {
+	if len(args) == 1 {
+		if s, ok := args[0].(string); ok {
+			return s
+		}
+	}
+	var printed []any
+	for _, arg := range args {
+		if arg != nil {
+			printed = append(printed, arg)
+		}
+	}
+	return fmt.Sprint(printed...)
+}
+
+// printUnescaped ends every action under node that prints in a call to
+// unescaped, as html/template ends them in its escapers.
+func printUnescaped(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, node := range n.Nodes {
+			printUnescaped(node)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) == 0 {
+			n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+				NodeType: parse.NodeCommand,
+				Args:     []parse.Node{parse.NewIdentifier("unescaped")},
+			})
+		}
+	case *parse.IfNode:
+		printUnescaped(n.List)
+		printUnescaped(n.ElseList)
+	case *parse.RangeNode:
+		printUnescaped(n.List)
+		printUnescaped(n.ElseList)
+	case *parse.WithNode:
+		printUnescaped(n.List)
+		printUnescaped(n.ElseList)
+	}
+}
+`
+
+// fuzzModels is the package typed seeds take their @data type from, at
+// testpkg/models.
+const fuzzModels = `package models
+
+type Page struct {
+	Title  string
+	Count  int
+	Price  float64
+	Admin  bool
+	Tags   []string
+	Scores map[string]int
+	User   *User
+}
+
+type User struct {
+	Name  string
+	Email string
+}
+`
+
+// fuzzReport is what fuzzDriver prints: the output of html/template,
+// its unescaped counterpart and the generated code, the error each
+// failed with, and whether html/template rejected the template while
+// escaping it.
+type fuzzReport struct {
+	Want, Unescaped, Got          string
+	WantErr, UnescapedErr, GotErr string
+	Rejected                      bool
+}
+
+// fuzzKnownGaps match the diagnostics of templates the generator
+// refuses on purpose, where rendering would differ from html/template.
+// Each is documented for users; remove its entry once the gap closes.
+var fuzzKnownGaps = regexp.MustCompile(strings.Join([]string{
+	// Contexts typed code has no escaper for, {{template}} calls
+	// inside a tag, script or style, and html or urlquery in a
+	// pipeline; see Escaping in README.md.
+	`typed mode can't print`,
+	`typed mode can only call .* in HTML text`,
+	`typed templates escape what they print`,
+	// Directives naming packages, types or functions that don't
+	// exist, which html/template doesn't read.
+	`@(data|param|funcs|import)\b`,
+}, "|"))
+
+// FuzzDifferential renders a mutated template source and JSON document
+// through html/template and the generated registry. It
+// fails when the generated code disagrees with html/template on output
+// or on whether rendering errors, when the generator or the generated
+// code panics, when the generator emits Go that does not compile, and
+// when it rejects a template for a reason fuzzKnownGaps doesn't list.
+// Typed mode compiles with fallback, so what it can't type is rendered
+// by dynamic code instead of rejected. Only templates html/template
+// itself rejects are skipped.
+//
+// Dynamic templates print values unescaped, a difference README.md
+// documents; their output is compared with text/template's, printing
+// values as html/template does before escaping them.
+//
+// Each input compiles a throwaway module, so run it with a time budget:
+//
+//	go test -run '^$' -fuzz FuzzDifferential -fuzztime 10m
+//
+// The seed inputs run with the other tests, unless -short is set.
+func FuzzDifferential(f *testing.F) {
+	f.Add(`<h1>{{.Title}}</h1>`, `{"Title":"Hello"}`)
+	f.Add(`{{if .User}}Hi {{.User.Name}}{{else}}anon{{end}}`, `{"User":{"Name":"Ann"}}`)
+	f.Add(`{{range $i, $v := .Items}}{{$i}}={{$v}} {{else}}none{{end}}`, `{"Items":["a","b"]}`)
+	f.Add(`{{with .Contact}}{{.Email}}{{else}}-{{end}}`, `{"Contact":{"Email":"x"}}`)
+	f.Add(`{{.Title | upper}}`, `{"Title":"hello"}`)
+	f.Add(`<p class="x">&amp; {{.Title}}</p>`, `{"Title":"Tom"}`)
+	f.Add(typedDataRef+`<h1>{{.Title}}</h1>`, `{"Title":"Tom & \"Jerry\" <3"}`)
+	f.Add(typedDataRef+`{{range $i, $t := .Tags}}<li>{{$i}}:{{$t}}</li>{{else}}none{{end}}{{if gt .Count 1}} {{.Count}}{{end}}`,
+		`{"Tags":["<b>","a'b","+1"],"Count":2}`)
+	f.Add(typedDataRef+`{{with .User}}{{.Name | upper}} ({{.Email}}){{else}}anon{{end}} {{.Price}} {{.Admin}}`,
+		`{"User":{"Name":"o'neil & co","Email":"a@b"},"Price":1e21}`)
+	f.Add(typedDataRef+`{{range $k, $v := .Scores}}{{$k}}={{printf "%03d" $v}};{{end}}{{or .Title "<untitled>"}}`,
+		`{"Scores":{"<a>":1,"b&c":20}}`)
+	f.Add(typedDataRef+`<a href="{{.Title}}" title='{{.User.Name}}' onclick="f({{.Tags}}, '{{.Title}}')">x</a>`,
+		`{"Title":"javascript:alert('<x>')","User":{"Name":"a\"b"},"Tags":["</script>"]}`)
+	f.Add(typedDataRef+`<script>var n = {{.Count}}, t = "{{.Title}}";</script><p style="color: {{.Title}}">{{.Title}}</p>`,
+		`{"Count":3,"Title":"red; x:expression(1)"}`)
+
+	f.Fuzz(func(t *testing.T, src, data string) {
+		if testing.Short() {
+			t.Skip("compiles a module per input")
+		}
+		if !json.Valid([]byte(data)) {
+			t.Skip("data is not JSON")
+		}
+		if _, err := template.New("fuzz.html").Funcs(sprig.FuncMap()).Parse(src); err != nil {
+			t.Skip("template does not parse")
+		}
+
+		res := runCodegenWith(t, GenOptions{Fallback: true}, map[string]string{"fuzz.html": src}, map[string]string{
+			"data.json":        data,
+			"driver/main.go":   fuzzDriver,
+			"models/models.go": fuzzModels,
+		})
+		if res.Generated == "" {
+			if html, err := template.New("fuzz.html").Funcs(sprig.FuncMap()).Parse(src); err == nil && escapeErr(html) != nil {
+				t.Skip("html/template rejects the template")
+			}
+			if res.BuildErr == nil || !fuzzKnownGaps.MatchString(res.BuildErr.Error()) {
+				t.Fatalf("generator rejected %q: %v", src, res.BuildErr)
+			}
+			return
+		}
+		if res.BuildErr != nil {
+			t.Fatalf("generated code does not build: %v\nstderr:\n%s\n\ngenerated:\n%s",
+				res.BuildErr, res.BuildStderr, res.Generated)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		run := exec.CommandContext(ctx, "go", "run", "./driver")
+		run.Dir = res.TmpDir
+		var stdout, stderr bytes.Buffer
+		run.Stdout = &stdout
+		run.Stderr = &stderr
+		if err := run.Run(); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) && exitErr.ExitCode() == 3 {
+				t.Skip("data does not decode into the template's type")
+			}
+			t.Fatalf("generated code crashed: %v\nstderr:\n%s\n\ngenerated:\n%s",
+				err, stderr.String(), res.Generated)
+		}
+		var report fuzzReport
+		if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+			t.Fatalf("driver printed %q: %v", stdout.String(), err)
+		}
+
+		if report.Rejected {
+			t.Skip("html/template rejects the template")
+		}
+		want, wantErr, against := report.Want, report.WantErr, "html/template"
+		if !strings.Contains(res.Generated, "func RenderFuzz(") {
+			want, wantErr, against = report.Unescaped, report.UnescapedErr, "unescaped html/template"
+		}
+		switch {
+		case (wantErr != "") != (report.GotErr != ""):
+			t.Fatalf("error mismatch for %q with %s:\n%s: %s\ngenerated: %s",
+				src, data, against, wantErr, report.GotErr)
+		case wantErr != "":
+		case want != report.Got:
+			t.Fatalf("output mismatch for %q with %s:\n%s:\n\t%q\ngenerated:\n\t%q",
+				src, data, against, want, report.Got)
+		}
+	})
+}
+
+// escapeErr returns the error html/template reports escaping tmpl, if
+// any. It executes tmpl with no data, which fails after escaping, if at
+// all, when an action needs some.
+func escapeErr(tmpl *template.Template) error {
+	var escErr *template.Error
+	if err := tmpl.Execute(io.Discard, nil); errors.As(err, &escErr) {
+		return escErr
+	}
+	return nil
+}
@@ -1,31 +1,59 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"go/types"
 	"io"
+	"maps"
 	"sort"
 	"strings"
 )
 
-// Generator drives a single template's typed codegen. It holds the
-// running state (VarCounter, current dot type, lexical scope of typed
-// $variables) plus the writer and supporting helpers (line directives,
-// import collection). The dynamic codepath in main.go does not use this
-// struct — it predates the typed work and stays parameter-driven.
+// Generator drives a single template's codegen, typed or dynamic. It
+// holds the running state (VarCounter, block depth, current dot type,
+// lexical scope of typed $variables) plus the writer and supporting
+// helpers (line directives, import collection). Dynamic code uses only
+// the writer, depth, counter, imports, line directives and the variables
+// its blocks declared.
 type Generator struct {
 	Writer       io.Writer
+	Filename     string // as given to Generate; positions diagnostics
+	TemplateName string // e.g. "index.html"; prefixes runtime errors
 	TemplatePath string
 	LineIndex    *LineIndex
 	VarCounter   int
+	Depth        int // block nesting inside the render function body
 
-	Resolver *TypeResolver
-	Imports  *ImportSet
-	DataType types.Type
-	DotType  types.Type
-	DataExpr string // expression that refers to the root data value
-	DotExpr  string // expression that refers to the current dot value
-	Scopes   []SymbolScope
+	Resolver    *TypeResolver
+	Imports     *ImportSet
+	PackageName string // package being generated; its types are written unqualified
+	Funcs       map[string]FuncRef
+	FuncAliases map[string]string            // import path -> alias chosen by @funcs
+	TypeAliases map[string]string            // @import alias -> import path
+	Templates   map[string]*resolvedTemplate // every template in the run, by name
+	DataType    types.Type
+	DotType     types.Type
+	DataExpr    string // expression that refers to the root data value
+	DotExpr     string // expression that refers to the current dot value
+	Scopes      []SymbolScope
+	Loops       []*loopState      // enclosing {{range}} loops, innermost last
+	NonNil      map[string]bool   // pointer expressions a {{with}} proved non-nil
+	DynamicVars []map[string]bool // Go blocks open in dynamic code, innermost last, by the variables each declared
+
+	// Fallback emits dynamic code for nodes typed mode can't compile,
+	// reporting each one to Warnings, instead of failing.
+	Fallback bool
+	Warnings io.Writer
+
+	// Escaping is how html/template escapes the template. Typed code
+	// prints and writes text accordingly, and so does the dynamic code
+	// of fallback nodes, so they render like the typed ones around them.
+	// It is nil for dynamic templates, which print as text/template does.
+	Escaping *Escaping
+
+	// Diagnostics collects the nodes typed mode failed to compile.
+	Diagnostics Diagnostics
 }
 
 // SymbolScope records the typed bindings for $variables introduced by
@@ -36,10 +64,13 @@ type SymbolScope struct {
 }
 
 // ScopeBinding describes one $variable in scope: the Go expression that
-// refers to it and the static type of that expression.
+// refers to it and the static type of that expression. Assignable is set
+// for a variable with a Go variable of its own, which {{$x = ...}} may
+// set; the variables of {{range}} and {{with}} share theirs with dot.
 type ScopeBinding struct {
-	GoExpr string
-	Type   types.Type
+	GoExpr     string
+	Type       types.Type
+	Assignable bool
 }
 
 // PushScope opens a new lexical scope. Call Pop when leaving.
@@ -74,6 +105,15 @@ func (g *Generator) LookupVar(name string) (ScopeBinding, bool) {
 	return ScopeBinding{}, false
 }
 
+// markNonNil records that the pointer expression expr can't be nil,
+// so field access through it needs no check.
+func (g *Generator) markNonNil(expr string) {
+	if g.NonNil == nil {
+		g.NonNil = map[string]bool{}
+	}
+	g.NonNil[expr] = true
+}
+
 // NextVar returns a new unique-name suffix and increments the counter.
 func (g *Generator) NextVar() int {
 	v := g.VarCounter
@@ -82,8 +122,9 @@ func (g *Generator) NextVar() int {
 }
 
 // EmitLine writes a //line directive for the given byte offset (a
-// parse.Pos value) in the source template. It is the typed-mode
-// equivalent of emitLineDirective.
+// parse.Pos value) in the source template. The directive must start
+// at column 0 for the Go compiler to honor it, and applies to the
+// following lines until the next one.
 func (g *Generator) EmitLine(pos int64) {
 	if g.LineIndex == nil || g.TemplatePath == "" {
 		return
@@ -99,6 +140,42 @@ func (g *Generator) Writef(format string, args ...any) {
 	}
 }
 
+// Line writes one line of generated code indented to the current block
+// depth. The render function body itself is depth 0.
+func (g *Generator) Line(format string, args ...any) {
+	g.Writef("%s%s\n", strings.Repeat("\t", g.Depth+1), fmt.Sprintf(format, args...))
+}
+
+// TypeExpr renders t as Go source for the generated file, adding an
+// import for every package it mentions. Types declared in the package
+// being generated are written unqualified.
+func (g *Generator) TypeExpr(t types.Type) string {
+	return typeExpr(t, g.PackageName, g.Imports)
+}
+
+// typeExpr renders t as Go source in the generated package packageName,
+// adding the packages it refers to to imports.
+func typeExpr(t types.Type, packageName string, imports *ImportSet) string {
+	return types.TypeString(t, func(p *types.Package) string {
+		if p.Name() == packageName {
+			return ""
+		}
+		return imports.Add(p.Path(), p.Name())
+	})
+}
+
+// capture runs fn with the writer redirected to a buffer and returns
+// what it wrote, so callers can tell whether an expression needed
+// supporting statements before deciding where to place it.
+func (g *Generator) capture(fn func() error) (string, error) {
+	saved := g.Writer
+	var buf bytes.Buffer
+	g.Writer = &buf
+	err := fn()
+	g.Writer = saved
+	return buf.String(), err
+}
+
 // ImportSet tracks the set of Go imports that the generated file needs.
 // Aliases are deduplicated so two unrelated packages that suggest the
 // same alias get distinct names.
@@ -121,21 +198,34 @@ func (s *ImportSet) Add(path, preferredAlias string) string {
 	if alias, ok := s.byPath[path]; ok {
 		return alias
 	}
-	alias := preferredAlias
-	if alias == "" {
-		alias = lastPathSegment(path)
+	base := preferredAlias
+	if base == "" {
+		base = lastPathSegment(path)
 	}
+	alias := base
 	for i := 1; ; i++ {
 		if _, taken := s.byAlias[alias]; !taken {
 			break
 		}
-		alias = fmt.Sprintf("%s%d", preferredAlias, i)
+		alias = fmt.Sprintf("%s%d", base, i)
 	}
 	s.byAlias[alias] = path
 	s.byPath[path] = alias
 	return alias
 }
 
+// clone returns a copy of s, so imports added by a failed attempt can
+// be rolled back.
+func (s *ImportSet) clone() *ImportSet {
+	return &ImportSet{byAlias: maps.Clone(s.byAlias), byPath: maps.Clone(s.byPath)}
+}
+
+// PathOf returns the import path imported under alias, if any.
+func (s *ImportSet) PathOf(alias string) (string, bool) {
+	path, ok := s.byAlias[alias]
+	return path, ok
+}
+
 // WriteImports writes a Go import block listing all collected imports in
 // alias-sorted order. If the set is empty, nothing is written.
 func (s *ImportSet) WriteImports(w io.Writer) {
@@ -27,6 +27,15 @@ func TestImportSetAliasCollision(t *testing.T) {
 	}
 }
 
+func TestImportSetAliasCollisionDefault(t *testing.T) {
+	s := NewImportSet()
+	a1 := s.Add("github.com/foo/bar", "")
+	a2 := s.Add("github.com/baz/bar", "")
+	if a1 != "bar" || a2 != "bar1" {
+		t.Fatalf("got aliases %q, %q; want bar, bar1", a1, a2)
+	}
+}
+
 func TestImportSetWriteImports(t *testing.T) {
 	s := NewImportSet()
 	s.Add("github.com/foo/bar", "bar")
@@ -1,8 +1,6 @@
 package main
 
 import (
-	"bufio"
-	"os"
 	"sort"
 )
 
@@ -10,31 +8,15 @@ type LineIndex struct {
 	NewlineOffsets []int64
 }
 
-// Build a line offset index
-func NewLineIndex(filePath string) (*LineIndex, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return nil, err
-	}
-	defer func() { _ = file.Close() }()
-
+// NewLineIndexFromBytes builds a line offset index for src.
+func NewLineIndexFromBytes(src []byte) *LineIndex {
 	var newlineOffsets []int64
-	var offset int64 = 0
-
-	reader := bufio.NewReader(file)
-	for {
-		b, err := reader.ReadByte()
-		if err != nil {
-			break // EOF is expected
-		}
-
-		offset++
+	for i, b := range src {
 		if b == '\n' {
-			newlineOffsets = append(newlineOffsets, offset)
+			newlineOffsets = append(newlineOffsets, int64(i)+1)
 		}
 	}
-
-	return &LineIndex{NewlineOffsets: newlineOffsets}, nil
+	return &LineIndex{NewlineOffsets: newlineOffsets}
 }
 
 // Get line number at given byte offset
@@ -46,3 +28,12 @@ func (li *LineIndex) LineNumberAt(offset int64) int {
 
 	return idx + 1 // lines are 1-based
 }
+
+// ColumnAt returns the 1-based byte column of offset within its line.
+func (li *LineIndex) ColumnAt(offset int64) int {
+	line := li.LineNumberAt(offset)
+	if line == 1 {
+		return int(offset) + 1
+	}
+	return int(offset-li.NewlineOffsets[line-2]) + 1
+}
@@ -2,13 +2,19 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"go/format"
+	"go/scanner"
 	"go/types"
 	"html/template"
 	"io"
 	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
 	"text/template/parse"
 
@@ -17,8 +23,12 @@ import (
 )
 
 type CLI struct {
-	Filenames   []string `arg:"" help:"Files to process"`
-	PackageName string   `help:"Package name" default:"templates"`
+	Filenames      []string `arg:"" help:"Files to process"`
+	PackageName    string   `help:"Package name" default:"templates"`
+	Fallback       bool     `help:"Compile what typed mode can't handle as dynamic code, with a warning, instead of failing"`
+	Output         string   `short:"o" help:"File to write the generated code to; stdout if empty" type:"path"`
+	LinePaths      string   `help:"How //line directives name templates: absolute, output (relative to --output), module (relative to the module root) or none" enum:"absolute,output,module,none" default:"absolute"`
+	TrimLinePrefix string   `help:"Prefix to trim from the template paths of //line directives"`
 }
 
 // GenOptions controls a codegen run. It is the in-process equivalent of CLI flags.
@@ -26,8 +36,40 @@ type GenOptions struct {
 	Filenames   []string
 	PackageName string
 	Output      io.Writer
+
+	// Dir is the directory @data packages are resolved from; empty
+	// means the current working directory. Without an OutputPath, it is
+	// also the package //comtmpl:template types are declared in.
+	Dir string
+
+	// Fallback compiles the nodes of typed templates that typed mode
+	// can't handle with the dynamic codegen instead of failing, so
+	// templates can adopt typing incrementally. Each fallback is
+	// reported to Warnings, if set.
+	Fallback bool
+	Warnings io.Writer
+
+	// LinePaths chooses how //line directives name template files;
+	// anything but absolute paths keeps generated files the same across
+	// machines. OutputPath is where Output ends up, which
+	// LinePathsOutput makes paths relative to; its package is where
+	// //comtmpl:template types are declared. TrimLinePrefix is then
+	// removed from each path.
+	LinePaths      LinePaths
+	OutputPath     string
+	TrimLinePrefix string
 }
 
+// LinePaths is how //line directives name template files.
+type LinePaths string
+
+const (
+	LinePathsAbsolute LinePaths = "absolute" // the default
+	LinePathsOutput   LinePaths = "output"   // relative to the output file's directory
+	LinePathsModule   LinePaths = "module"   // relative to the root of the module in Dir
+	LinePathsNone     LinePaths = "none"     // no //line directives at all
+)
+
 func writeString(writer io.Writer, str string) {
 	_, err := writer.Write([]byte(str))
 	if err != nil {
@@ -36,11 +78,26 @@ func writeString(writer io.Writer, str string) {
 }
 
 func (c *CLI) Run() error {
-	return Generate(GenOptions{
-		Filenames:   c.Filenames,
-		PackageName: c.PackageName,
-		Output:      os.Stdout,
-	})
+	opts := GenOptions{
+		Filenames:      c.Filenames,
+		PackageName:    c.PackageName,
+		Output:         os.Stdout,
+		Fallback:       c.Fallback,
+		Warnings:       os.Stderr,
+		LinePaths:      LinePaths(c.LinePaths),
+		OutputPath:     c.Output,
+		TrimLinePrefix: c.TrimLinePrefix,
+	}
+	if c.Output == "" {
+		return Generate(opts)
+	}
+	// Only replace the output file once generation has succeeded.
+	var buf bytes.Buffer
+	opts.Output = &buf
+	if err := Generate(opts); err != nil {
+		return err
+	}
+	return os.WriteFile(c.Output, buf.Bytes(), 0o644)
 }
 
 // resolvedTemplate holds the per-template state derived from CLI input
@@ -49,776 +106,573 @@ func (c *CLI) Run() error {
 type resolvedTemplate struct {
 	Filename     string
 	BaseName     string
-	TemplatePath string // absolute path; used for //line directives
+	TemplatePath string // as //line directives name it; empty to omit them
 	Tree         *parse.Tree
 	LineIndex    *LineIndex
 	Directives   Directives
 	DataType     types.Type // nil for dynamic templates
 	DataTypeExpr string     // Go expression to refer to DataType
+	DataDecl     string     // "file:line" declaring DataType, for errors
+	Params       []typedParam
+	Funcs        map[string]FuncRef
+	Define       bool      // a {{define}} block of Filename rather than the file
+	Escaping     *Escaping // set for typed templates before they are emitted
+}
+
+// typedParam is a resolved @param: a typed render function parameter
+// bound as $Name.
+type typedParam struct {
+	Name     string
+	Type     types.Type
+	TypeExpr string // Go expression to refer to Type
+}
+
+// typed reports whether rt compiles to a typed render function.
+func (rt *resolvedTemplate) typed() bool {
+	return rt.DataType != nil || len(rt.Params) > 0
+}
+
+// where names rt in error messages: the file, or the define block
+// within it.
+func (rt *resolvedTemplate) where() string {
+	if rt.Define {
+		return fmt.Sprintf("%s: {{define %q}}", filepath.Base(rt.Filename), rt.BaseName)
+	}
+	return rt.BaseName
 }
 
 // Generate runs codegen for the given templates and writes the result to opts.Output.
 func Generate(opts GenOptions) error {
-	tmpl, err := template.New("").Funcs(sprig.FuncMap()).ParseFiles(opts.Filenames...)
+	resolver := NewTypeResolver()
+	resolver.Dir = opts.Dir
+
+	// Problems with one template don't stop the run: each is recorded
+	// and the template skipped, so all of them are reported together.
+	var diags Diagnostics
+	fail := func(filename string, line int, err error) {
+		diags = append(diags, Diagnostic{File: filename, Line: line, Message: err.Error()})
+	}
+
+	// Directives are read before parsing because the parser rejects
+	// calls to functions it has not been told about, including those
+	// provided by @funcs packages.
+	parseFuncs := sprig.FuncMap()
+	parseFuncs[asTypeFunc] = parseOnlyFunc
+	allDirs := make(map[string]Directives, len(opts.Filenames))
+	allFuncs := make(map[string]map[string]FuncRef, len(opts.Filenames))
+	allSrc := make(map[string][]byte, len(opts.Filenames))
+	for _, filename := range opts.Filenames {
+		raw, err := os.ReadFile(filename)
+		if err != nil {
+			diags.add(fmt.Errorf("read %s: %w", filename, err))
+			continue
+		}
+		dirs, err := ParseDirectives(raw)
+		if err != nil {
+			fail(filename, 0, err)
+			continue
+		}
+		funcs, err := resolveTemplateFuncs(resolver, dirs)
+		if err != nil {
+			fail(filename, 0, err)
+			continue
+		}
+		for name := range funcs {
+			if _, ok := parseFuncs[name]; !ok {
+				parseFuncs[name] = parseOnlyFunc
+			}
+		}
+		allDirs[filename] = dirs
+		allFuncs[filename] = funcs
+		allSrc[filename] = raw
+	}
+
+	if len(opts.Filenames) == 0 {
+		return fmt.Errorf("failed to parse templates: no files named")
+	}
+	linePath, err := linePathFunc(opts)
 	if err != nil {
-		return fmt.Errorf("failed to parse templates: %w", err)
+		return err
+	}
+	tmpl := template.New("").Funcs(parseFuncs)
+	for _, filename := range opts.Filenames {
+		src, ok := allSrc[filename]
+		if !ok {
+			continue
+		}
+		if err := parseTemplateFile(tmpl, filepath.Base(filename), src, allDirs[filename].Params); err != nil {
+			diags.add(fmt.Errorf("failed to parse templates: %w", err))
+			delete(allSrc, filename)
+		}
 	}
 
 	imports := NewImportSet()
 	imports.Add("io", "")
-	imports.Add("fmt", "")
 	imports.Add("github.com/jtarchie/comtmpl/templates", "templates")
 
-	resolver := NewTypeResolver()
+	// Types are declared next to the generated code, so they are looked
+	// for in the output's package when the output is a file.
+	typesDir := opts.Dir
+	if opts.OutputPath != "" {
+		typesDir = filepath.Dir(opts.OutputPath)
+	}
+	sourceTypes, err := DiscoverTemplateTypes(resolver, typesDir, opts.OutputPath, opts.PackageName)
+	if err != nil {
+		return fmt.Errorf("discover template types: %w", err)
+	}
 
 	resolved := make([]*resolvedTemplate, 0, len(opts.Filenames))
+	byName := make(map[string]*resolvedTemplate, len(opts.Filenames))
+files:
 	for _, filename := range opts.Filenames {
-		raw, err := os.ReadFile(filename)
-		if err != nil {
-			return fmt.Errorf("read %s: %w", filename, err)
-		}
-		dirs, err := ParseDirectives(raw)
-		if err != nil {
-			return fmt.Errorf("%s: %w", filename, err)
+		src, ok := allSrc[filename]
+		if !ok {
+			continue
 		}
+		dirs := allDirs[filename]
 
 		baseFilename := filepath.Base(filename)
 		t := tmpl.Lookup(baseFilename)
 		if t == nil {
-			return fmt.Errorf("template %q not found after parse", baseFilename)
-		}
-		idx, err := NewLineIndex(filename)
-		if err != nil {
-			return fmt.Errorf("line index for %s: %w", filename, err)
+			fail(filename, 0, fmt.Errorf("template %q not found after parse", baseFilename))
+			continue
 		}
-		absPath, err := filepath.Abs(filename)
+		idx := NewLineIndexFromBytes(src)
+		templatePath, err := linePath(filename)
 		if err != nil {
-			absPath = filename
+			fail(filename, 0, err)
+			continue
 		}
 
 		rt := &resolvedTemplate{
 			Filename:     filename,
 			BaseName:     t.Name(),
-			TemplatePath: absPath,
+			TemplatePath: templatePath,
 			Tree:         t.Tree,
 			LineIndex:    idx,
 			Directives:   dirs,
+			Funcs:        allFuncs[filename],
 		}
 
-		if dirs.Typed() {
-			pathOrAlias, typeName, err := SplitDataTypeRef(dirs.DataTypeRef)
+		source, fromSource := sourceTypes[rt.BaseName]
+		switch {
+		case dirs.Typed() && fromSource:
+			fail(filename, 0, fmt.Errorf("data type declared both by directives and by %s at %s",
+				templateTypeDirective, source.Pos))
+			continue
+		case dirs.DataTypeRef != "":
+			ref, err := ParseTypeRef(dirs.DataTypeRef)
 			if err != nil {
-				return fmt.Errorf("%s: %w", filename, err)
+				fail(filename, dirs.DataLine, fmt.Errorf("@data %q: %w", dirs.DataTypeRef, err))
+				continue
 			}
-			importPath := pathOrAlias
-			if alias, ok := dirs.Imports[pathOrAlias]; ok {
-				importPath = alias
-			}
-			typ, err := resolver.ResolveType(importPath, typeName)
+			typ, err := resolver.ResolveTypeRef(ref, dirs.Imports)
 			if err != nil {
-				return fmt.Errorf("%s: @data %q: %w", filename, dirs.DataTypeRef, err)
+				fail(filename, dirs.DataLine, fmt.Errorf("@data %q: %w", dirs.DataTypeRef, err))
+				continue
 			}
 			rt.DataType = typ
-
-			// Decide how to refer to the type. Same-package refs use the
-			// bare name; cross-package refs add an alias to the import set.
-			pkgName := lastPathSegment(importPath)
-			if pkgName == opts.PackageName {
-				rt.DataTypeExpr = typeName
-			} else {
-				alias := imports.Add(importPath, pkgName)
-				rt.DataTypeExpr = alias + "." + typeName
+			rt.DataDecl = fmt.Sprintf("%s:%d", rt.BaseName, dirs.DataLine)
+		case fromSource:
+			rt.DataType = source.Type
+			rt.DataDecl = source.Pos
+		}
+		for _, p := range dirs.Params {
+			ref, err := ParseTypeRef(p.TypeRef)
+			if err != nil {
+				fail(filename, p.Line, fmt.Errorf("@param %s %q: %w", p.Name, p.TypeRef, err))
+				continue files
+			}
+			typ, err := resolver.ResolveTypeRef(ref, dirs.Imports)
+			if err != nil {
+				fail(filename, p.Line, fmt.Errorf("@param %s %q: %w", p.Name, p.TypeRef, err))
+				continue files
+			}
+			rt.Params = append(rt.Params, typedParam{
+				Name:     p.Name,
+				Type:     typ,
+				TypeExpr: typeExpr(typ, opts.PackageName, imports),
+			})
+		}
+		if rt.DataType != nil {
+			rt.DataTypeExpr = typeExpr(rt.DataType, opts.PackageName, imports)
+		}
+		if rt.typed() {
+			if err := addBuiltinFuncs(resolver, rt.Funcs); err != nil {
+				fail(filename, 0, err)
+				continue
 			}
 		}
 
 		resolved = append(resolved, rt)
+		byName[rt.BaseName] = rt
+
+		// {{define}} blocks with their own @data become typed templates
+		// of their own, callable from other typed templates.
+		for _, name := range slices.Sorted(maps.Keys(dirs.Defines)) {
+			d := dirs.Defines[name]
+			dt := tmpl.Lookup(name)
+			if dt == nil || dt.Tree == nil {
+				fail(filename, d.Line, fmt.Errorf("@data for {{define %q}}, which was not parsed", name))
+				continue
+			}
+			ref, err := ParseTypeRef(d.DataTypeRef)
+			if err != nil {
+				fail(filename, d.Line, fmt.Errorf("@data %q: %w", d.DataTypeRef, err))
+				continue
+			}
+			typ, err := resolver.ResolveTypeRef(ref, dirs.Imports)
+			if err != nil {
+				fail(filename, d.Line, fmt.Errorf("@data %q: %w", d.DataTypeRef, err))
+				continue
+			}
+			def := &resolvedTemplate{
+				Filename:     filename,
+				BaseName:     name,
+				TemplatePath: templatePath,
+				Tree:         dt.Tree,
+				LineIndex:    idx,
+				Directives:   dirs,
+				DataType:     typ,
+				DataTypeExpr: typeExpr(typ, opts.PackageName, imports),
+				DataDecl:     fmt.Sprintf("%s:%d", baseFilename, d.Line),
+				Funcs:        maps.Clone(allFuncs[filename]),
+				Define:       true,
+			}
+			if err := addBuiltinFuncs(resolver, def.Funcs); err != nil {
+				fail(filename, d.Line, err)
+				continue
+			}
+			resolved = append(resolved, def)
+			byName[name] = def
+		}
+	}
+
+	// Typed templates are called by function name, so two templates
+	// mapping to the same one would not compile.
+	fnNames := map[string]*resolvedTemplate{}
+	for _, rt := range resolved {
+		if !rt.typed() {
+			continue
+		}
+		fn := renderFuncName(rt.BaseName)
+		if other, dup := fnNames[fn]; dup {
+			diags.add(fmt.Errorf("%s and %s both compile to %s; rename one", other.where(), rt.where(), fn))
+			continue
+		}
+		fnNames[fn] = rt
+		// The registry entry reports data of the wrong type with fmt.
+		imports.Add("fmt", "")
 	}
 
-	writer := opts.Output
+	// The file is built in memory and formatted before anything is
+	// written, so a syntax error leaves the output untouched.
+	out := &bytes.Buffer{}
+	writer := io.Writer(out)
 
 	// Emit typed render functions to a side buffer; they are appended
 	// after the registry so the file stays readable.
 	typedBody := &bytes.Buffer{}
+	byFile := make(map[string]*resolvedTemplate, len(resolved))
 	for _, rt := range resolved {
-		if rt.DataType == nil {
+		if !rt.Define {
+			byFile[filepath.Base(rt.Filename)] = rt
+		}
+	}
+	// An html/template error in a template is met again escaping each
+	// template calling it, but reported once.
+	escapeErrs := map[string]bool{}
+	for _, rt := range resolved {
+		if !rt.typed() {
+			continue
+		}
+		escaping, err := escapeTemplate(tmpl, rt, byFile)
+		if err != nil {
+			var ds Diagnostics
+			ds.add(err)
+			for _, d := range ds {
+				if !escapeErrs[d.String()] {
+					escapeErrs[d.String()] = true
+					diags = append(diags, d)
+				}
+			}
 			continue
 		}
-		if err := emitTypedTemplate(typedBody, opts, rt.TemplatePath, rt.BaseName,
-			rt.Tree, rt.LineIndex, rt.DataType, rt.DataTypeExpr); err != nil {
-			return err
+		rt.Escaping = escaping
+		if err := emitTypedTemplate(typedBody, opts, resolver, imports, rt, byName); err != nil {
+			diags.add(err)
 		}
 	}
+	// Parameters are named by template authors, so make sure none hides
+	// a package the generated code refers to.
+	for _, rt := range resolved {
+		for i, p := range rt.Params {
+			if path, ok := imports.PathOf(p.Name); ok {
+				fail(rt.Filename, rt.Directives.Params[i].Line, fmt.Errorf("@param %s hides the generated code's import of %q; rename it", p.Name, path))
+			}
+		}
+	}
+	if len(diags) > 0 {
+		return diags
+	}
 
-	writeString(writer, fmt.Sprintf("package %s\n\n", opts.PackageName))
-	imports.WriteImports(writer)
-	writeString(writer, "\nvar Parsed = templates.NewTemplates(map[string]templates.Template{\n")
-
+	// The registry is written ahead of the imports, which its dynamic
+	// templates add to.
+	var registry bytes.Buffer
 	for _, rt := range resolved {
-		if rt.DataType != nil {
-			// Typed template: emit a registry shim that delegates to the
-			// typed render function.
-			fnName := renderFuncName(rt.BaseName)
-			writeString(writer, fmt.Sprintf("\t%q: func(t *templates.Templates, writer io.Writer, data any) error {\n", rt.BaseName))
-			writeString(writer, fmt.Sprintf("\t\ttyped, ok := data.(%s)\n", rt.DataTypeExpr))
-			writeString(writer, "\t\tif !ok {\n")
-			writeString(writer, fmt.Sprintf("\t\t\treturn fmt.Errorf(\"%s: expected %s, got %%T\", data)\n", rt.BaseName, rt.DataTypeExpr))
-			writeString(writer, "\t\t}\n")
-			writeString(writer, fmt.Sprintf("\t\treturn %s(writer, typed)\n", fnName))
-			writeString(writer, "\t},\n")
+		if rt.typed() {
+			writeTypedShim(&registry, rt)
 			continue
 		}
 
-		// Dynamic template: existing reflection-based emit.
-		writeString(writer, fmt.Sprintf("\t%q: func(t *templates.Templates, writer io.Writer, data any) error {\n\t\tvar err error\n", rt.BaseName))
-		varCounter := 0
-		processTreeNodes(writer, rt.Tree.Root.Nodes, rt.TemplatePath, rt.LineIndex, &varCounter)
-		writeString(writer, "\n\t\treturn nil\n\t},\n")
+		// Dynamic template: reflection-based emit.
+		writeString(&registry, fmt.Sprintf("\t%q: func(t *templates.Templates, writer io.Writer, data any) error {\n\t\tvar err error\n", rt.BaseName))
+		g := &Generator{Writer: &registry, Imports: imports, TemplatePath: rt.TemplatePath, LineIndex: rt.LineIndex}
+		g.dynamicBlock(func() { g.emitDynamic(rt.Tree.Root.Nodes) })
+		writeString(&registry, "\n\t\treturn nil\n\t},\n")
 	}
 
+	writeString(writer, fmt.Sprintf("package %s\n\n", opts.PackageName))
+	imports.WriteImports(writer)
+	writeString(writer, "\nvar Parsed = templates.NewTemplates(map[string]templates.Template{\n")
+	writeString(writer, registry.String())
 	writeString(writer, "})\n")
 
 	if typedBody.Len() > 0 {
+		if opts.Fallback {
+			writeFallbackTemplates(writer)
+		}
 		writeString(writer, typedBody.String())
 	}
 
-	return nil
-}
-
-// emitLineDirective writes a Go //line directive pointing at the given
-// template position. The directive must start at column 0 (no leading
-// whitespace) for the Go compiler to honor it. Subsequent lines of the
-// generated file are reported as originating from templatePath until the
-// next //line directive.
-func emitLineDirective(writer io.Writer, templatePath string, offset *LineIndex, pos int64) {
-	if offset == nil || templatePath == "" {
-		return
-	}
-	writeString(writer, fmt.Sprintf("\n//line %s:%d\n", templatePath, offset.LineNumberAt(pos)))
-}
-
-// processTreeNodes processes all nodes at the current level
-func processTreeNodes(writer io.Writer, nodes []parse.Node, templatePath string, offset *LineIndex, varCounter *int) {
-	for _, node := range nodes {
-		emitLineDirective(writer, templatePath, offset, int64(node.Position()))
-
-		switch n := node.(type) {
-		case *parse.TextNode:
-			// Simple text node
-			writeString(writer, fmt.Sprintf("\t\t_, err = io.WriteString(writer, %q)\n", string(n.Text)))
-			writeString(writer, "\t\tif err != nil { return err }\n")
-
-		case *parse.ActionNode:
-			// Simple action node like {{ .Field }} or {{ functionCall }}
-			generateActionCode(writer, n, varCounter)
-
-		case *parse.IfNode:
-			// If node
-			generateIfCode(writer, n, templatePath, offset, varCounter)
-
-		case *parse.RangeNode:
-			// Range node
-			generateRangeCode(writer, n, templatePath, offset, varCounter)
-
-		case *parse.WithNode:
-			// With node
-			generateWithCode(writer, n, templatePath, offset, varCounter)
-
-		case *parse.TemplateNode:
-			// Template inclusion
-			generateTemplateCode(writer, n, varCounter)
-
-		case *parse.CommentNode:
-			// Skip comments in templates
-			writeString(writer, fmt.Sprintf("\t\t// Template comment: %s\n", strings.ReplaceAll(n.String(), "\n", " ")))
+	files := make(map[string]string, len(resolved))
+	for _, rt := range resolved {
+		if rt.TemplatePath != "" {
+			files[filepath.Clean(filepath.FromSlash(rt.TemplatePath))] = rt.Filename
 		}
 	}
+	src, err := formatGenerated(out.Bytes(), files)
+	if err != nil {
+		return err
+	}
+	_, err = opts.Output.Write(src)
+	return err
 }
 
-// generateActionCode handles {{ .Field }} or {{ functionCall }} expressions
-func generateActionCode(writer io.Writer, action *parse.ActionNode, varCounter *int) {
-	resultVar := fmt.Sprintf("result%d", *varCounter)
-	(*varCounter)++
-
-	writeString(writer, fmt.Sprintf("\t\tvar %s any\n", resultVar))
-
-	// Process the action's pipeline
-	if len(action.Pipe.Cmds) > 0 {
-		cmd := action.Pipe.Cmds[0]
-
-		if len(cmd.Args) > 0 {
-			switch arg := cmd.Args[0].(type) {
-			case *parse.FieldNode:
-				// Field access like {{ .Field }}
-				fields := "[]string{"
-				for i, ident := range arg.Ident {
-					if i > 0 {
-						fields += ", "
-					}
-					fields += fmt.Sprintf("%q", ident)
-				}
-				fields += "}"
-
-				writeString(writer, fmt.Sprintf("\t\t%s, err = templates.EvalField(data, %s)\n", resultVar, fields))
-				writeString(writer, "\t\tif err != nil { return err }\n")
-
-			case *parse.IdentifierNode:
-				// Function call like {{ funcName }}
-				funcName := arg.Ident
-				writeString(writer, fmt.Sprintf("\t\t%s, err = t.CallFunc(%q", resultVar, funcName))
-
-				// Add arguments if any
-				for i := 1; i < len(cmd.Args); i++ {
-					// Handle different argument types
-					switch argItem := cmd.Args[i].(type) {
-					case *parse.FieldNode:
-						// Field argument like {{ funcName .Field }}
-						argFields := "[]string{"
-						for j, ident := range argItem.Ident {
-							if j > 0 {
-								argFields += ", "
-							}
-							argFields += fmt.Sprintf("%q", ident)
-						}
-						argFields += "}"
-
-						argVar := fmt.Sprintf("arg%d_%d", *varCounter, i)
-						(*varCounter)++
-
-						writeString(writer, fmt.Sprintf(")\n\t\tvar %s any\n\t\t%s, err = templates.EvalField(data, %s)", argVar, argVar, argFields))
-						writeString(writer, fmt.Sprintf("\n\t\tif err != nil { return err }\n\t\t%s, err = t.CallFunc(%q, %s", resultVar, funcName, argVar))
-
-					case *parse.DotNode:
-						// Argument is dot itself like {{ funcName . }}
-						writeString(writer, ", templates.Dot(data)")
-
-					case *parse.VariableNode:
-						// Variable reference like {{ funcName $var }}
-						varName := sanitizeVarName(argItem.Ident[0])
-						writeString(writer, fmt.Sprintf(", %s", varName))
-
-					default:
-						// Fallback for unsupported argument types
-						writeString(writer, ", nil")
-					}
-				}
-
-				writeString(writer, ")\n")
-				writeString(writer, "\t\tif err != nil { return err }\n")
-
-			case *parse.DotNode:
-				// {{ . }} itself
-				writeString(writer, fmt.Sprintf("\t\t%s = templates.Dot(data)\n", resultVar))
-
-			case *parse.VariableNode:
-				// {{ $var }} or {{ $var.Field }} variable reference
-				emitVariableRef(writer, resultVar, arg.Ident)
-
-			default:
-				writeString(writer, fmt.Sprintf("\t\t%s = nil // Unsupported node type: %T\n", resultVar, arg))
-			}
+// linePathFunc returns the function naming a template file in //line
+// directives as opts asks, which returns "" when they are omitted.
+func linePathFunc(opts GenOptions) (func(filename string) (string, error), error) {
+	var base string
+	switch opts.LinePaths {
+	case "", LinePathsAbsolute:
+	case LinePathsNone:
+		return func(string) (string, error) { return "", nil }, nil
+	case LinePathsOutput:
+		if opts.OutputPath == "" {
+			return nil, fmt.Errorf("//line paths relative to the output need an output file")
 		}
-
-		// Handle pipes (simplified for now)
-		for i := 1; i < len(action.Pipe.Cmds); i++ {
-			if len(action.Pipe.Cmds[i].Args) > 0 {
-				if ident, ok := action.Pipe.Cmds[i].Args[0].(*parse.IdentifierNode); ok {
-					funcName := ident.Ident
-					writeString(writer, fmt.Sprintf("\t\t%s, err = t.CallFunc(%q, %s", resultVar, funcName, resultVar))
-
-					// Add arguments if any
-					for j := 1; j < len(action.Pipe.Cmds[i].Args); j++ {
-						switch argItem := action.Pipe.Cmds[i].Args[j].(type) {
-						case *parse.FieldNode:
-							// Field argument like {{ .Field | funcName .OtherField }}
-							argFields := "[]string{"
-							for k, ident := range argItem.Ident {
-								if k > 0 {
-									argFields += ", "
-								}
-								argFields += fmt.Sprintf("%q", ident)
-							}
-							argFields += "}"
-
-							argVar := fmt.Sprintf("arg%d_%d", *varCounter, j)
-							(*varCounter)++
-
-							writeString(writer, fmt.Sprintf(")\n\t\tvar %s any\n\t\t%s, err = templates.EvalField(data, %s)", argVar, argVar, argFields))
-							writeString(writer, fmt.Sprintf("\n\t\tif err != nil { return err }\n\t\t%s, err = t.CallFunc(%q, %s", resultVar, funcName, resultVar))
-							writeString(writer, fmt.Sprintf(", %s", argVar))
-
-						case *parse.DotNode:
-							// Dot argument like {{ .Field | funcName . }}
-							writeString(writer, ", templates.Dot(data)")
-
-						case *parse.VariableNode:
-							// Variable reference like {{ .Field | funcName $var }}
-							varName := sanitizeVarName(argItem.Ident[0])
-							writeString(writer, fmt.Sprintf(", %s", varName))
-
-						default:
-							// Fallback for unsupported argument types
-							writeString(writer, ", nil")
-						}
-					}
-
-					writeString(writer, ")\n")
-					writeString(writer, "\t\tif err != nil { return err }\n")
-				}
-			}
+		out, err := filepath.Abs(opts.OutputPath)
+		if err != nil {
+			return nil, err
 		}
+		base = filepath.Dir(out)
+	case LinePathsModule:
+		root, err := moduleRoot(opts.Dir)
+		if err != nil {
+			return nil, err
+		}
+		base = root
+	default:
+		return nil, fmt.Errorf("unknown //line path mode %q", opts.LinePaths)
 	}
 
-	// Output the result
-	writeString(writer, fmt.Sprintf("\t\t_, err = fmt.Fprint(writer, %s)\n", resultVar))
-	writeString(writer, "\t\tif err != nil { return err }\n")
-}
-
-// generateIfCode handles if/else statements
-func generateIfCode(writer io.Writer, ifNode *parse.IfNode, templatePath string, offset *LineIndex, varCounter *int) {
-	condVar := fmt.Sprintf("cond%d", *varCounter)
-	(*varCounter)++
-
-	writeString(writer, "\t\t// If statement\n")
-	writeString(writer, fmt.Sprintf("\t\tvar %s bool\n", condVar))
-
-	// Evaluate the condition (simplified)
-	if len(ifNode.Pipe.Cmds) > 0 {
-		resultVar := fmt.Sprintf("ifResult%d", *varCounter)
-		(*varCounter)++
-
-		writeString(writer, fmt.Sprintf("\t\tvar %s any\n", resultVar))
-
-		cmd := ifNode.Pipe.Cmds[0]
-		if len(cmd.Args) > 0 {
-			switch arg := cmd.Args[0].(type) {
-			case *parse.FieldNode:
-				// Field access like {{ if .Field }}
-				fields := "[]string{"
-				for i := 0; i < len(arg.Ident); i++ {
-					if i > 0 {
-						fields += ", "
-					}
-					fields += fmt.Sprintf("%q", arg.Ident[i])
-				}
-				fields += "}"
-
-				writeString(writer, fmt.Sprintf("\t\t%s, err = templates.EvalField(data, %s)\n", resultVar, fields))
-				writeString(writer, "\t\tif err != nil { return err }\n")
-
-			case *parse.IdentifierNode:
-				// Function call like {{ if funcName }}
-				funcName := arg.Ident
-				writeString(writer, fmt.Sprintf("\t\t%s, err = t.CallFunc(%q)\n", resultVar, funcName))
-				writeString(writer, "\t\tif err != nil { return err }\n")
-
-			case *parse.DotNode:
-				// {{ if . }}
-				writeString(writer, fmt.Sprintf("\t\t%s = templates.Dot(data)\n", resultVar))
-
-			case *parse.VariableNode:
-				// Variable reference like {{ if $x }} or {{ if $x.Field }}
-				emitVariableRef(writer, resultVar, arg.Ident)
-
-			default:
-				writeString(writer, fmt.Sprintf("\t\t%s = nil // Unsupported node type: %T\n", resultVar, arg))
+	return func(filename string) (string, error) {
+		path, err := filepath.Abs(filename)
+		if err != nil {
+			return "", err
+		}
+		if base != "" {
+			if path, err = filepath.Rel(base, path); err != nil {
+				return "", fmt.Errorf("//line path: %w", err)
 			}
 		}
+		// Slashes, so the paths don't depend on the generating OS.
+		path = strings.TrimPrefix(filepath.ToSlash(path), opts.TrimLinePrefix)
+		if path == "" {
+			return "", fmt.Errorf("//line path of %s is empty after trimming %q", filename, opts.TrimLinePrefix)
+		}
+		return path, nil
+	}, nil
+}
 
-		// Convert to boolean
-		writeString(writer, fmt.Sprintf("\t\t%s, err = templates.IsTrue(%s)\n", condVar, resultVar))
-		writeString(writer, "\t\tif err != nil { return err }\n")
+// moduleRoot returns the directory of the go.mod governing dir, or the
+// current working directory when dir is empty.
+func moduleRoot(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
 	}
-
-	// Generate if block
-	writeString(writer, fmt.Sprintf("\t\tif %s {\n", condVar))
-
-	// Process the if body with one more level of indentation
-	if ifNode.List != nil {
-		// Process all nodes in the if body recursively
-		for _, node := range ifNode.List.Nodes {
-			processNodeWithIndent(writer, node, templatePath, offset, varCounter, 1)
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, "go.mod")); err == nil {
+			return d, nil
 		}
-	}
-
-	// Process the else block if it exists
-	if ifNode.ElseList != nil {
-		writeString(writer, "\t\t} else {\n")
-
-		// Process all nodes in the else body recursively
-		for _, node := range ifNode.ElseList.Nodes {
-			processNodeWithIndent(writer, node, templatePath, offset, varCounter, 1)
+		if filepath.Dir(d) == d {
+			return "", fmt.Errorf("no go.mod found in %s or any parent directory", dir)
 		}
 	}
-
-	writeString(writer, "\t\t}\n")
-}
-
-// processNodeWithIndent processes a single node with additional indentation
-func processNodeWithIndent(writer io.Writer, node parse.Node, templatePath string, offset *LineIndex, varCounter *int, indentLevel int) {
-	indent := strings.Repeat("\t", indentLevel+2) // Base indent (2) + additional levels
-
-	emitLineDirective(writer, templatePath, offset, int64(node.Position()))
-
-	switch n := node.(type) {
-	case *parse.TextNode:
-		// Simple text node
-		writeString(writer, fmt.Sprintf("%s_, err = io.WriteString(writer, %q)\n", indent, string(n.Text)))
-		writeString(writer, fmt.Sprintf("%sif err != nil { return err }\n", indent))
-
-	case *parse.ActionNode:
-		// Action node - adjust indentation of generated code
-		origOutput := strings.Builder{}
-		generateActionCode(&origOutput, n, varCounter)
-		indented := strings.ReplaceAll(origOutput.String(), "\t\t", indent)
-		writeString(writer, indented)
-
-	case *parse.IfNode:
-		// Nested if node
-		origOutput := strings.Builder{}
-		generateIfCode(&origOutput, n, templatePath, offset, varCounter)
-		indented := strings.ReplaceAll(origOutput.String(), "\t\t", indent)
-		writeString(writer, indented)
-
-	case *parse.RangeNode:
-		// Nested range node
-		origOutput := strings.Builder{}
-		generateRangeCode(&origOutput, n, templatePath, offset, varCounter)
-		indented := strings.ReplaceAll(origOutput.String(), "\t\t", indent)
-		writeString(writer, indented)
-
-	case *parse.WithNode:
-		// Nested with node
-		origOutput := strings.Builder{}
-		generateWithCode(&origOutput, n, templatePath, offset, varCounter)
-		indented := strings.ReplaceAll(origOutput.String(), "\t\t", indent)
-		writeString(writer, indented)
-
-	case *parse.TemplateNode:
-		// Template inclusion
-		origOutput := strings.Builder{}
-		generateTemplateCode(&origOutput, n, varCounter)
-		indented := strings.ReplaceAll(origOutput.String(), "\t\t", indent)
-		writeString(writer, indented)
-
-	case *parse.CommentNode:
-		// Skip comments in templates
-		writeString(writer, fmt.Sprintf("%s// Template comment: %s\n", indent,
-			strings.ReplaceAll(n.String(), "\n", " ")))
-
-	default:
-		// Handle any other node types
-		writeString(writer, fmt.Sprintf("%s// Unsupported nested node type: %T\n", indent, n))
-	}
 }
 
-// generateRangeCode handles range loops
-func generateRangeCode(writer io.Writer, rangeNode *parse.RangeNode, templatePath string, offset *LineIndex, varCounter *int) {
-	rangeVar := fmt.Sprintf("rangeData%d", *varCounter)
-	(*varCounter)++
-
-	writeString(writer, "\t\t// Range statement\n")
-	writeString(writer, fmt.Sprintf("\t\tvar %s any\n", rangeVar))
-
-	// Get the range data
-	if len(rangeNode.Pipe.Cmds) > 0 {
-		cmd := rangeNode.Pipe.Cmds[0]
-
-		if len(cmd.Args) > 0 {
-			switch arg := cmd.Args[0].(type) {
-			case *parse.FieldNode:
-				// Field access like {{ range .Items }}
-				fields := "[]string{"
-				for i := 0; i < len(arg.Ident); i++ {
-					if i > 0 {
-						fields += ", "
-					}
-					fields += fmt.Sprintf("%q", arg.Ident[i])
-				}
-				fields += "}"
-
-				writeString(writer, fmt.Sprintf("\t\t%s, err = templates.EvalField(data, %s)\n", rangeVar, fields))
-				writeString(writer, "\t\tif err != nil { return err }\n")
-
-			case *parse.DotNode:
-				// {{ range . }}
-				writeString(writer, fmt.Sprintf("\t\t%s = templates.Dot(data)\n", rangeVar))
-
-			case *parse.VariableNode:
-				// {{ range $var }} or {{ range $var.Field }}
-				emitVariableRef(writer, rangeVar, arg.Ident)
-
-			default:
-				writeString(writer, fmt.Sprintf("\t\t%s = nil // Unsupported node type: %T\n", rangeVar, arg))
-			}
+// formatGenerated gofmts the generated file src. Syntax errors are
+// reported at the template position the //line directives attribute
+// them to, files mapping those directives' paths to template file
+// names; errors outside any template name the generated line instead.
+func formatGenerated(src []byte, files map[string]string) ([]byte, error) {
+	formatted, err := format.Source(src)
+	if err == nil {
+		return formatted, nil
+	}
+	var list scanner.ErrorList
+	if !errors.As(err, &list) {
+		return nil, fmt.Errorf("format generated code: %w", err)
+	}
+	lines := bytes.Split(src, []byte("\n"))
+	var diags Diagnostics
+	for _, e := range list {
+		if file, ok := files[e.Pos.Filename]; ok {
+			diags = append(diags, Diagnostic{File: file, Line: e.Pos.Line, Message: "generated code: " + e.Msg})
+			continue
 		}
-	}
-
-	// Create iterable and range loop
-	iterVar := fmt.Sprintf("iter%d", *varCounter)
-	(*varCounter)++
-
-	writeString(writer, fmt.Sprintf("\t\t%s, err := templates.GetIterable(%s)\n", iterVar, rangeVar))
-	writeString(writer, "\t\tif err != nil { return err }\n")
-	hasElse := rangeNode.ElseList != nil
-	if hasElse {
-		writeString(writer, "\t\thasItems := false\n")
-	}
-
-	// Handle variable declarations in range
-	var indexVarName, valueVarName string
-	if len(rangeNode.Pipe.Decl) >= 1 {
-		// Create a safe variable name from the template variable
-		origIndexVar := rangeNode.Pipe.Decl[0].Ident[0]
-		indexVarName = sanitizeVarName(origIndexVar)
-		writeString(writer, fmt.Sprintf("\t\tvar %s any // Template variable for index: %s\n", indexVarName, origIndexVar))
-	}
-	if len(rangeNode.Pipe.Decl) >= 2 {
-		// Create a safe variable name from the template variable
-		origValueVar := rangeNode.Pipe.Decl[1].Ident[0]
-		valueVarName = sanitizeVarName(origValueVar)
-		writeString(writer, fmt.Sprintf("\t\tvar %s any // Template variable for value: %s\n", valueVarName, origValueVar))
-	}
-	(*varCounter)++
-
-	// Generate code for map iteration
-	writeString(writer, fmt.Sprintf(`
-		if mapData, isMap := %s.(map[string]any); isMap {
-			for k, v := range mapData {`, iterVar))
-	if hasElse {
-		writeString(writer, "\n\t\t\t\thasItems = true")
-	}
-
-	// Assign to template variables if they exist
-	if indexVarName != "" {
-		writeString(writer, fmt.Sprintf("\n\t\t\t\t%s = k", indexVarName))
-	}
-	if valueVarName != "" {
-		writeString(writer, fmt.Sprintf("\n\t\t\t\t%s = v", valueVarName))
-	}
-
-	// Setup range context
-	writeString(writer, `
-
-				// Create range scope
-				rangeContext := templates.NewRangeScope(data, k, v)
-				oldData := data
-				data = rangeContext
-`)
-
-	// Process range body with proper node handling
-	writeString(writer, "\t\t\t\t// Range body\n")
-	if rangeNode.List != nil && rangeNode.List.Nodes != nil {
-		for _, node := range rangeNode.List.Nodes {
-			processNodeWithIndent(writer, node, templatePath, offset, varCounter, 2)
+		msg := fmt.Sprintf("generated code: line %d: %s", e.Pos.Line, e.Msg)
+		if e.Pos.Line >= 1 && e.Pos.Line <= len(lines) {
+			msg += fmt.Sprintf(" in %q", bytes.TrimSpace(lines[e.Pos.Line-1]))
 		}
+		diags = append(diags, Diagnostic{Message: msg})
 	}
+	return nil, diags
+}
 
-	// Restore original context
-	writeString(writer, "\t\t\t\tdata = oldData\n")
-	writeString(writer, "\t\t\t}\n")
-
-	// Generate code for slice iteration
-	writeString(writer, fmt.Sprintf(`
-		} else if sliceData, isSlice := %s.([]any); isSlice {
-			for i, v := range sliceData {`, iterVar))
-	if hasElse {
-		writeString(writer, "\n\t\t\t\thasItems = true")
-	}
-
-	// Assign to template variables if they exist
-	if indexVarName != "" {
-		writeString(writer, fmt.Sprintf("\n\t\t\t\t%s = i", indexVarName))
-	}
-	if valueVarName != "" {
-		writeString(writer, fmt.Sprintf("\n\t\t\t\t%s = v", valueVarName))
-	}
-
-	// Setup range context
-	writeString(writer, `
-
-				// Create range scope
-				rangeContext := templates.NewRangeScope(data, i, v)
-				oldData := data
-				data = rangeContext
-`)
-
-	// Process range body again for slice iteration with proper node handling
-	writeString(writer, "\t\t\t\t// Range body\n")
-	if rangeNode.List != nil && rangeNode.List.Nodes != nil {
-		for _, node := range rangeNode.List.Nodes {
-			processNodeWithIndent(writer, node, templatePath, offset, varCounter, 2)
-		}
+// writeTypedShim writes the registry entry of a typed template, which
+// checks the dynamic data and delegates to the typed render function. A
+// template with @param directives takes its arguments from a
+// map[string]any keyed by parameter name.
+func writeTypedShim(writer io.Writer, rt *resolvedTemplate) {
+	fnName := renderFuncName(rt.BaseName)
+	writeString(writer, fmt.Sprintf("\t%q: func(t *templates.Templates, writer io.Writer, data any) error {\n", rt.BaseName))
+	if len(rt.Params) == 0 {
+		writeString(writer, fmt.Sprintf("\t\ttyped, ok := data.(%s)\n", rt.DataTypeExpr))
+		writeString(writer, "\t\tif !ok {\n")
+		writeString(writer, fmt.Sprintf("\t\t\treturn fmt.Errorf(\"%s: expected %s, got %%T\", data)\n", rt.BaseName, rt.DataTypeExpr))
+		writeString(writer, "\t\t}\n")
+		writeString(writer, fmt.Sprintf("\t\treturn %s(writer, typed)\n", fnName))
+		writeString(writer, "\t},\n")
+		return
 	}
 
-	// Restore original context
-	writeString(writer, "\t\t\t\tdata = oldData\n")
-	writeString(writer, "\t\t\t}\n")
+	writeString(writer, "\t\tparams, ok := data.(map[string]any)\n")
+	writeString(writer, "\t\tif !ok {\n")
+	writeString(writer, fmt.Sprintf("\t\t\treturn fmt.Errorf(\"%s: expected map[string]any of parameters, got %%T\", data)\n", rt.BaseName))
 	writeString(writer, "\t\t}\n")
-
-	// Handle range else clause if present
-	if hasElse {
-		writeString(writer, "\t\tif !hasItems {\n")
-
-		for _, node := range rangeNode.ElseList.Nodes {
-			processNodeWithIndent(writer, node, templatePath, offset, varCounter, 1)
-		}
-
+	args := make([]string, len(rt.Params))
+	for i, p := range rt.Params {
+		args[i] = fmt.Sprintf("param%d", i)
+		writeString(writer, fmt.Sprintf("\t\t%s, ok := params[%q].(%s)\n", args[i], p.Name, p.TypeExpr))
+		writeString(writer, "\t\tif !ok {\n")
+		writeString(writer, fmt.Sprintf("\t\t\treturn fmt.Errorf(\"%s: parameter %s: expected %s, got %%T\", params[%q])\n",
+			rt.BaseName, p.Name, p.TypeExpr, p.Name))
 		writeString(writer, "\t\t}\n")
 	}
+	writeString(writer, fmt.Sprintf("\t\treturn %s(writer, %s)\n", fnName, strings.Join(args, ", ")))
+	writeString(writer, "\t},\n")
 }
 
-// generateWithCode handles with blocks
-func generateWithCode(writer io.Writer, withNode *parse.WithNode, templatePath string, offset *LineIndex, varCounter *int) {
-	withVar := fmt.Sprintf("withData%d", *varCounter)
-	(*varCounter)++
-
-	writeString(writer, "\t\t// With statement\n")
-	writeString(writer, fmt.Sprintf("\t\tvar %s any\n", withVar))
-
-	// Get the with value
-	if len(withNode.Pipe.Cmds) > 0 {
-		cmd := withNode.Pipe.Cmds[0]
-
-		if len(cmd.Args) > 0 {
-			switch arg := cmd.Args[0].(type) {
-			case *parse.FieldNode:
-				// Field access like {{ with .Field }}
-				fields := "[]string{"
-				for i := 0; i < len(arg.Ident); i++ {
-					if i > 0 {
-						fields += ", "
-					}
-					fields += fmt.Sprintf("%q", arg.Ident[i])
-				}
-				fields += "}"
-
-				writeString(writer, fmt.Sprintf("\t\t%s, err = templates.EvalField(data, %s)\n", withVar, fields))
-				writeString(writer, "\t\tif err != nil { return err }\n")
-
-			case *parse.DotNode:
-				// {{ with . }}
-				writeString(writer, fmt.Sprintf("\t\t%s = templates.Dot(data)\n", withVar))
-
-			case *parse.VariableNode:
-				// {{ with $var }} or {{ with $var.Field }}
-				emitVariableRef(writer, withVar, arg.Ident)
-
-			default:
-				writeString(writer, fmt.Sprintf("\t\t%s = nil // Unsupported node type: %T\n", withVar, arg))
-			}
-		}
-	}
-
-	// Check if with value is truthy
-	condVar := fmt.Sprintf("withCond%d", *varCounter)
-	(*varCounter)++
-
-	writeString(writer, fmt.Sprintf("\t\t%s, err := templates.IsTrue(%s)\n", condVar, withVar))
-	writeString(writer, "\t\tif err != nil { return err }\n")
-
-	// Generate with block
-	writeString(writer, fmt.Sprintf("\t\tif %s {\n", condVar))
-	writeString(writer, "\t\t\t// Save old data context and set new one\n")
-	writeString(writer, "\t\t\toldData := data\n")
-	writeString(writer, fmt.Sprintf("\t\t\tdata = %s\n", withVar))
-
-	// Process the with body with proper node handling
-	if withNode.List != nil {
-		for _, node := range withNode.List.Nodes {
-			processNodeWithIndent(writer, node, templatePath, offset, varCounter, 1)
+// parseTemplateFile parses src as the template name of tmpl, with a
+// $variable declared for each of params. The parser rejects undeclared
+// variables, so declarations such as {{$user := .user}} are parsed in
+// front of src; they are then cut from the template, and the positions
+// of the file's trees moved back, so the trees read as parsed from src
+// alone. Typed codegen binds the variables to the render function's
+// parameters.
+func parseTemplateFile(tmpl *template.Template, name string, src []byte, params []ParamDirective) error {
+	if len(params) == 0 {
+		_, err := tmpl.New(name).Parse(string(src))
+		return err
+	}
+	var decls []byte
+	for _, p := range params {
+		decls = fmt.Appendf(decls, "{{$%s := .%s}}", p.Name, p.Name)
+	}
+	before := map[*parse.Tree]bool{}
+	for _, t := range tmpl.Templates() {
+		before[t.Tree] = true
+	}
+	if _, err := tmpl.New(name).Parse(string(decls) + string(src)); err != nil {
+		return err
+	}
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil || before[t.Tree] {
+			continue
 		}
-	}
-
-	// Restore data context
-	writeString(writer, "\t\t\tdata = oldData\n")
-
-	// Process the else block if it exists
-	if withNode.ElseList != nil {
-		writeString(writer, "\t\t} else {\n")
-
-		for _, node := range withNode.ElseList.Nodes {
-			processNodeWithIndent(writer, node, templatePath, offset, varCounter, 1)
+		if t.Name() == name {
+			t.Tree.Root.Nodes = t.Tree.Root.Nodes[len(params):]
 		}
+		shiftPositions(reflect.ValueOf(t.Tree.Root), -parse.Pos(len(decls)))
 	}
-
-	writeString(writer, "\t\t}\n")
+	return nil
 }
 
-// generateTemplateCode handles template inclusion
-func generateTemplateCode(writer io.Writer, tmplNode *parse.TemplateNode, varCounter *int) {
-	dataVar := fmt.Sprintf("tmplData%d", *varCounter)
-	(*varCounter)++
-
-	writeString(writer, fmt.Sprintf("\t\t// Include template: %s\n", tmplNode.Name))
-
-	// Set up data for the template
-	if tmplNode.Pipe != nil && len(tmplNode.Pipe.Cmds) > 0 {
-		writeString(writer, fmt.Sprintf("\t\tvar %s any\n", dataVar))
-
-		cmd := tmplNode.Pipe.Cmds[0]
-		if len(cmd.Args) > 0 {
-			switch arg := cmd.Args[0].(type) {
-			case *parse.FieldNode:
-				// Field access like {{ template "name" .Field }}
-				fields := "[]string{"
-				for i, ident := range arg.Ident {
-					if i > 0 {
-						fields += ", "
-					}
-					fields += fmt.Sprintf("%q", ident)
-				}
-				fields += "}"
-
-				writeString(writer, fmt.Sprintf("\t\t%s, err = templates.EvalField(data, %s)\n", dataVar, fields))
-				writeString(writer, "\t\tif err != nil { return err }\n")
-
-			case *parse.DotNode:
-				// {{ template "name" . }}
-				writeString(writer, fmt.Sprintf("\t\t%s = templates.Dot(data)\n", dataVar))
-
+// shiftPositions moves the position of every node reachable from v by
+// delta, but not before the start of the source.
+func shiftPositions(v reflect.Value, delta parse.Pos) {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if !v.IsNil() {
+			shiftPositions(v.Elem(), delta)
+		}
+	case reflect.Slice:
+		for i := range v.Len() {
+			shiftPositions(v.Index(i), delta)
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			field := v.Field(i)
+			switch {
+			case !v.Type().Field(i).IsExported():
+			case field.Type() == reflect.TypeFor[parse.Pos]():
+				field.SetInt(max(field.Int()+int64(delta), 0))
 			default:
-				writeString(writer, fmt.Sprintf("\t\t%s = nil // Unsupported node type: %T\n", dataVar, arg))
+				shiftPositions(field, delta)
 			}
 		}
-	} else {
-		// No data specified, use nil
-		writeString(writer, fmt.Sprintf("\t\t%s := data\n", dataVar))
 	}
-
-	// Execute the template
-	writeString(writer, fmt.Sprintf("\t\terr = t.ExecuteTemplate(writer, %q, %s)\n", tmplNode.Name, dataVar))
-	writeString(writer, "\t\tif err != nil { return err }\n")
 }
 
-// Helper function to sanitize variable names (convert $var to valid Go identifier)
-func sanitizeVarName(varName string) string {
-	// Remove $ prefix for template variables and make a valid Go identifier
-	if strings.HasPrefix(varName, "$") {
-		return "var_" + varName[1:]
-	}
-	return varName
-}
-
-// emitVariableRef writes code that assigns a template variable (with optional
-// field path, e.g. $item.Name.First) into the destination variable.
-func emitVariableRef(writer io.Writer, dest string, idents []string) {
-	varName := sanitizeVarName(idents[0])
-	if len(idents) == 1 {
-		writeString(writer, fmt.Sprintf("\t\t%s = %s // Variable reference\n", dest, varName))
-		return
-	}
-
-	fields := "[]string{"
-	for i, ident := range idents[1:] {
-		if i > 0 {
-			fields += ", "
+// parseOnlyFunc stands in for @funcs functions and asType while
+// parsing, which only checks that called names exist. Typed templates
+// call the real Go functions directly.
+func parseOnlyFunc(...any) any { return nil }
+
+// resolveTemplateFuncs merges the functions of every @funcs package a
+// template names, in alias then name order so errors are stable. A
+// name provided by two packages is an error.
+func resolveTemplateFuncs(resolver *TypeResolver, dirs Directives) (map[string]FuncRef, error) {
+	funcs := map[string]FuncRef{}
+	from := map[string]string{}
+	for _, alias := range slices.Sorted(maps.Keys(dirs.FuncsAlias)) {
+		path := dirs.FuncsAlias[alias]
+		pkgFuncs, err := resolver.ResolveFuncs(path)
+		if err != nil {
+			return nil, fmt.Errorf("@funcs %s=%s: %w", alias, path, err)
+		}
+		for _, name := range slices.Sorted(maps.Keys(pkgFuncs)) {
+			ref := pkgFuncs[name]
+			if other, dup := from[name]; dup {
+				return nil, fmt.Errorf("function %q is provided by both %s and %s", name, other, path)
+			}
+			funcs[name] = ref
+			from[name] = path
 		}
-		fields += fmt.Sprintf("%q", ident)
 	}
-	fields += "}"
-
-	writeString(writer, fmt.Sprintf("\t\t%s, err = templates.EvalField(%s, %s)\n", dest, varName, fields))
-	writeString(writer, "\t\tif err != nil { return err }\n")
+	return funcs, nil
 }
 
 func main() {
@@ -827,5 +681,13 @@ func main() {
 	cli := &CLI{}
 	ctx := kong.Parse(cli)
 	err := ctx.Run()
+	var diags Diagnostics
+	if errors.As(err, &diags) {
+		// One problem per line, like go vet.
+		for _, d := range diags {
+			_, _ = fmt.Fprintln(os.Stderr, d)
+		}
+		os.Exit(1)
+	}
 	ctx.FatalIfErrorf(err)
 }
@@ -0,0 +1,669 @@
+package templates
+
+// The escapers below are ported from Go's html/template, copyright The
+// Go Authors and distributed under its BSD-style license. Typed render
+// functions apply them to values printed outside HTML text, in the
+// order html/template's contextual autoescaping chose for each action.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Escaper is one of the functions html/template applies to a value
+// printed in an attribute, a URL, a script or a style sheet.
+type Escaper uint8
+
+const (
+	EscapeAttr         Escaper = iota + 1 // a quoted attribute value
+	EscapeUnquotedAttr                    // an unquoted attribute value
+	EscapeRCDATA                          // the text of <textarea> or <title>
+	FilterURL                             // replaces unsafe URL schemes such as javascript:
+	NormalizeURL                          // percent-encodes what a URL can't contain
+	EscapeURL                             // percent-encodes a query or fragment part
+	EscapeJSString                        // a quoted JavaScript string
+	EscapeJSValue                         // a JavaScript expression
+	EscapeCSS                             // a quoted CSS string or url()
+	FilterCSSValue                        // a CSS property value
+	EscapeComment                         // an HTML comment, which html/template strips
+)
+
+// filterFailsafe replaces values an escaper rejects, as in html/template.
+const filterFailsafe = "ZgotmplZ"
+
+// WriteEscapedWith writes value escaped by each of escapers in turn.
+// The first sees value as html/template would, so trusted content such
+// as a template.URL passed to FilterURL is left alone; the rest see the
+// string the one before returned.
+func WriteEscapedWith(writer io.Writer, value any, escapers ...Escaper) error {
+	_, err := io.WriteString(writer, Escape(value, escapers...))
+	return err
+}
+
+// Escape returns value escaped by each of escapers in turn, as
+// WriteEscapedWith writes it.
+func Escape(value any, escapers ...Escaper) string {
+	if len(escapers) > 0 && escapers[0] == EscapeJSValue {
+		// A JavaScript value keeps its type: numbers stay numbers.
+		return escapeWith(jsValue(value), contentPlain, escapers[1:])
+	}
+	s, t := stringify(value)
+	return escapeWith(s, t, escapers)
+}
+
+// escapeWith applies escapers to s, of content type t.
+func escapeWith(s string, t contentType, escapers []Escaper) string {
+	for _, e := range escapers {
+		s, t = e.escape(s, t), contentPlain
+	}
+	return s
+}
+
+func (e Escaper) escape(s string, t contentType) string {
+	switch e {
+	case EscapeAttr:
+		if t == contentHTML {
+			return stripTags(quotedAttr, s)
+		}
+		return htmlReplacer(s, htmlReplacements[:], true)
+	case EscapeUnquotedAttr:
+		if t == contentHTML {
+			return stripTags(unquotedAttr, s)
+		}
+		if s == "" {
+			return filterFailsafe
+		}
+		return htmlReplacer(s, htmlNospaceReplacementTable, false)
+	case EscapeRCDATA:
+		if t == contentHTML {
+			return htmlReplacer(s, htmlNormReplacementTable, true)
+		}
+		return htmlReplacer(s, htmlReplacements[:], true)
+	case FilterURL:
+		if t != contentURL && !isSafeURL(s) {
+			return "#" + filterFailsafe
+		}
+		return s
+	case NormalizeURL, EscapeURL:
+		var b strings.Builder
+		if processURLOnto(s, e == NormalizeURL || t == contentURL, &b) {
+			return b.String()
+		}
+		return s
+	case EscapeJSString:
+		if t == contentJSStr {
+			return replace(s, jsStrNormReplacementTable)
+		}
+		return replace(s, jsStrReplacementTable)
+	case EscapeJSValue:
+		return jsValue(s)
+	case EscapeCSS:
+		return cssEscaper(s)
+	case FilterCSSValue:
+		if t == contentCSS {
+			return s
+		}
+		return cssValueFilter(s)
+	case EscapeComment:
+		return ""
+	}
+	panic(fmt.Sprintf("templates: unknown escaper %d", e))
+}
+
+// contentType is the kind of trusted content a value holds.
+type contentType uint8
+
+const (
+	contentPlain contentType = iota
+	contentCSS
+	contentHTML
+	contentHTMLAttr
+	contentJS
+	contentJSStr
+	contentURL
+	contentSrcset
+)
+
+// stringify formats value as html/template does for its escapers: the
+// string of one of html/template's content types along with that type,
+// or else the value formatted by fmt after following pointers, with
+// untyped nil as nothing.
+func stringify(value any) (string, contentType) {
+	switch s := indirect(value).(type) {
+	case string:
+		return s, contentPlain
+	case template.CSS:
+		return string(s), contentCSS
+	case template.HTML:
+		return string(s), contentHTML
+	case template.HTMLAttr:
+		return string(s), contentHTMLAttr
+	case template.JS:
+		return string(s), contentJS
+	case template.JSStr:
+		return string(s), contentJSStr
+	case template.URL:
+		return string(s), contentURL
+	case template.Srcset:
+		return string(s), contentSrcset
+	}
+	if value == nil {
+		return "", contentPlain
+	}
+	return fmt.Sprint(indirectToStringerOrError(value)), contentPlain
+}
+
+// indirect dereferences value until it reaches a nil pointer or a
+// non-pointer.
+func indirect(value any) any {
+	if value == nil {
+		return nil
+	}
+	if t := reflect.TypeOf(value); t.Kind() != reflect.Pointer {
+		return value
+	}
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v.Interface()
+}
+
+// quotedAttr and unquotedAttr print trusted HTML as an attribute value,
+// which html/template does with the tags stripped and the text left
+// escaped. Stripping tags takes its HTML parser, so rather than port
+// that, html/template itself prints the value, between the attribute
+// markup stripTags then cuts off.
+var (
+	quotedAttr   = template.Must(template.New("").Parse(`<a title="{{.}}">`))
+	unquotedAttr = template.Must(template.New("").Parse(`<a title={{.}}>`))
+)
+
+// stripTags returns html as attr prints it, without the markup around
+// the value.
+func stripTags(attr *template.Template, html string) string {
+	var b strings.Builder
+	if err := attr.Execute(&b, template.HTML(html)); err != nil {
+		// Printing a string can't fail.
+		panic(err)
+	}
+	s := strings.TrimPrefix(b.String(), `<a title=`)
+	s = strings.TrimPrefix(s, `"`)
+	s = strings.TrimSuffix(s, `>`)
+	return strings.TrimSuffix(s, `"`)
+}
+
+// htmlNormReplacementTable is htmlReplacements without '&', for content
+// already HTML.
+var htmlNormReplacementTable = []string{
+	0:    "\uFFFD",
+	'"':  "&#34;",
+	'\'': "&#39;",
+	'+':  "&#43;",
+	'<':  "&lt;",
+	'>':  "&gt;",
+}
+
+// htmlNospaceReplacementTable also escapes what ends an unquoted
+// attribute value.
+var htmlNospaceReplacementTable = []string{
+	0:    "&#xfffd;",
+	'\t': "&#9;",
+	'\n': "&#10;",
+	'\v': "&#11;",
+	'\f': "&#12;",
+	'\r': "&#13;",
+	' ':  "&#32;",
+	'"':  "&#34;",
+	'&':  "&amp;",
+	'\'': "&#39;",
+	'+':  "&#43;",
+	'<':  "&lt;",
+	'=':  "&#61;",
+	'>':  "&gt;",
+	'`':  "&#96;",
+}
+
+// htmlReplacer returns s with the runes replacementTable has an entry
+// for replaced. Unless badRunes is set, Unicode noncharacters are
+// escaped too.
+func htmlReplacer(s string, replacementTable []string, badRunes bool) string {
+	written, b := 0, new(strings.Builder)
+	r, w := rune(0), 0
+	for i := 0; i < len(s); i += w {
+		r, w = utf8.DecodeRuneInString(s[i:])
+		if int(r) < len(replacementTable) {
+			if repl := replacementTable[r]; len(repl) != 0 {
+				if written == 0 {
+					b.Grow(len(s))
+				}
+				b.WriteString(s[written:i])
+				b.WriteString(repl)
+				written = i + w
+			}
+		} else if badRunes {
+			// No-op.
+		} else if 0xfdd0 <= r && r <= 0xfdef || 0xfff0 <= r && r <= 0xffff {
+			if written == 0 {
+				b.Grow(len(s))
+			}
+			fmt.Fprintf(b, "%s&#x%x;", s[written:i], r)
+			written = i + w
+		}
+	}
+	if written == 0 {
+		return s
+	}
+	b.WriteString(s[written:])
+	return b.String()
+}
+
+// isSafeURL reports whether s is relative or uses one of the schemes
+// http, https or mailto.
+func isSafeURL(s string) bool {
+	if protocol, _, ok := strings.Cut(s, ":"); ok && !strings.Contains(protocol, "/") {
+		if !strings.EqualFold(protocol, "http") && !strings.EqualFold(protocol, "https") && !strings.EqualFold(protocol, "mailto") {
+			return false
+		}
+	}
+	return true
+}
+
+// processURLOnto percent-encodes s onto b and reports whether anything
+// needed encoding. Normalizing leaves reserved characters and valid
+// escapes alone.
+func processURLOnto(s string, norm bool, b *strings.Builder) bool {
+	b.Grow(len(s) + 16)
+	written := 0
+	for i, n := 0, len(s); i < n; i++ {
+		c := s[i]
+		switch c {
+		case '!', '#', '$', '&', '*', '+', ',', '/', ':', ';', '=', '?', '@', '[', ']':
+			if norm {
+				continue
+			}
+		case '-', '.', '_', '~':
+			continue
+		case '%':
+			if norm && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+				continue
+			}
+		default:
+			if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+				continue
+			}
+		}
+		b.WriteString(s[written:i])
+		fmt.Fprintf(b, "%%%02x", c)
+		written = i + 1
+	}
+	b.WriteString(s[written:])
+	return written != 0
+}
+
+var jsonMarshalType = reflect.TypeFor[json.Marshaler]()
+
+// indirectToJSONMarshaler dereferences value until it reaches a nil
+// pointer, a json.Marshaler or a non-pointer.
+func indirectToJSONMarshaler(value any) any {
+	if value == nil {
+		return nil
+	}
+	v := reflect.ValueOf(value)
+	for !v.Type().Implements(jsonMarshalType) && v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v.Interface()
+}
+
+var scriptTagRe = regexp.MustCompile("(?i)<(/?)script")
+
+// jsValue returns value as a JavaScript expression: its JSON encoding,
+// padded with spaces so it can't run into a neighbouring token.
+func jsValue(value any) string {
+	a := indirectToJSONMarshaler(value)
+	switch t := a.(type) {
+	case template.JS:
+		return string(t)
+	case template.JSStr:
+		return `"` + string(t) + `"`
+	case json.Marshaler:
+		// Marshaled below.
+	case fmt.Stringer:
+		a = t.String()
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		// The error goes in a comment; make sure it can't end it or the
+		// script.
+		errStr := err.Error()
+		errStr = string(scriptTagRe.ReplaceAll([]byte(errStr), []byte(`\x3C${1}script`)))
+		errStr = strings.ReplaceAll(errStr, "*/", "* /")
+		errStr = strings.ReplaceAll(errStr, "<!--", `\x3C!--`)
+		return fmt.Sprintf(" /* %s */null ", errStr)
+	}
+	if len(b) == 0 {
+		return " null "
+	}
+	first, _ := utf8.DecodeRune(b)
+	last, _ := utf8.DecodeLastRune(b)
+	var buf strings.Builder
+	pad := isJSIdentPart(first) || isJSIdentPart(last)
+	if pad {
+		buf.WriteByte(' ')
+	}
+	written := 0
+	// JSON allows the line separators U+2028 and U+2029 in strings, but
+	// older JavaScript doesn't.
+	for i := 0; i < len(b); {
+		r, n := utf8.DecodeRune(b[i:])
+		repl := ""
+		if r == 0x2028 {
+			repl = `\u2028`
+		} else if r == 0x2029 {
+			repl = `\u2029`
+		}
+		if repl != "" {
+			buf.Write(b[written:i])
+			buf.WriteString(repl)
+			written = i + n
+		}
+		i += n
+	}
+	if buf.Len() != 0 {
+		buf.Write(b[written:])
+		if pad {
+			buf.WriteByte(' ')
+		}
+		return buf.String()
+	}
+	return string(b)
+}
+
+func isJSIdentPart(r rune) bool {
+	return r == '$' || r == '_' || '0' <= r && r <= '9' || 'A' <= r && r <= 'Z' || 'a' <= r && r <= 'z'
+}
+
+// replace returns s with control characters, line separators and the
+// runes replacementTable has an entry for escaped for JavaScript.
+func replace(s string, replacementTable []string) string {
+	var b strings.Builder
+	r, w, written := rune(0), 0, 0
+	for i := 0; i < len(s); i += w {
+		r, w = utf8.DecodeRuneInString(s[i:])
+		var repl string
+		switch {
+		case int(r) < len(lowUnicodeReplacementTable):
+			repl = lowUnicodeReplacementTable[r]
+		case int(r) < len(replacementTable) && replacementTable[r] != "":
+			repl = replacementTable[r]
+		case r == '\u2028':
+			repl = `\u2028`
+		case r == '\u2029':
+			repl = `\u2029`
+		default:
+			continue
+		}
+		if written == 0 {
+			b.Grow(len(s))
+		}
+		b.WriteString(s[written:i])
+		b.WriteString(repl)
+		written = i + w
+	}
+	if written == 0 {
+		return s
+	}
+	b.WriteString(s[written:])
+	return b.String()
+}
+
+var lowUnicodeReplacementTable = []string{
+	0: `\u0000`, 1: `\u0001`, 2: `\u0002`, 3: `\u0003`, 4: `\u0004`, 5: `\u0005`, 6: `\u0006`,
+	'\a': `\u0007`,
+	'\b': `\u0008`,
+	'\t': `\t`,
+	'\n': `\n`,
+	'\v': `\u000b`, // "\v" == "v" on IE 6.
+	'\f': `\f`,
+	'\r': `\r`,
+	0xe:  `\u000e`, 0xf: `\u000f`, 0x10: `\u0010`, 0x11: `\u0011`, 0x12: `\u0012`, 0x13: `\u0013`,
+	0x14: `\u0014`, 0x15: `\u0015`, 0x16: `\u0016`, 0x17: `\u0017`, 0x18: `\u0018`, 0x19: `\u0019`,
+	0x1a: `\u001a`, 0x1b: `\u001b`, 0x1c: `\u001c`, 0x1d: `\u001d`, 0x1e: `\u001e`, 0x1f: `\u001f`,
+}
+
+var jsStrReplacementTable = []string{
+	0:    `\u0000`,
+	'\t': `\t`,
+	'\n': `\n`,
+	'\v': `\u000b`, // "\v" == "v" on IE 6.
+	'\f': `\f`,
+	'\r': `\r`,
+	'"':  `\u0022`,
+	'`':  `\u0060`,
+	'&':  `\u0026`,
+	'\'': `\u0027`,
+	'+':  `\u002b`,
+	'/':  `\/`,
+	'<':  `\u003c`,
+	'>':  `\u003e`,
+	'\\': `\\`,
+}
+
+// jsStrNormReplacementTable is jsStrReplacementTable without '\\', for
+// content already escaped as a JavaScript string.
+var jsStrNormReplacementTable = []string{
+	0:    `\u0000`,
+	'\t': `\t`,
+	'\n': `\n`,
+	'\v': `\u000b`, // "\v" == "v" on IE 6.
+	'\f': `\f`,
+	'\r': `\r`,
+	'"':  `\u0022`,
+	'&':  `\u0026`,
+	'\'': `\u0027`,
+	'`':  `\u0060`,
+	'+':  `\u002b`,
+	'/':  `\/`,
+	'<':  `\u003c`,
+	'>':  `\u003e`,
+}
+
+// cssEscaper escapes s for a quoted CSS string or url().
+func cssEscaper(s string) string {
+	var b strings.Builder
+	r, w, written := rune(0), 0, 0
+	for i := 0; i < len(s); i += w {
+		r, w = utf8.DecodeRuneInString(s[i:])
+		var repl string
+		switch {
+		case int(r) < len(cssReplacementTable) && cssReplacementTable[r] != "":
+			repl = cssReplacementTable[r]
+		default:
+			continue
+		}
+		if written == 0 {
+			b.Grow(len(s))
+		}
+		b.WriteString(s[written:i])
+		b.WriteString(repl)
+		written = i + w
+		// A hex escape ends at a space, which a following hex digit or
+		// space would otherwise be read as part of.
+		if repl != `\\` && (written == len(s) || isHex(s[written]) || isCSSSpace(s[written])) {
+			b.WriteByte(' ')
+		}
+	}
+	if written == 0 {
+		return s
+	}
+	b.WriteString(s[written:])
+	return b.String()
+}
+
+var cssReplacementTable = []string{
+	0:    `\0`,
+	'\t': `\9`,
+	'\n': `\a`,
+	'\f': `\c`,
+	'\r': `\d`,
+	'"':  `\22`,
+	'&':  `\26`,
+	'\'': `\27`,
+	'(':  `\28`,
+	')':  `\29`,
+	'+':  `\2b`,
+	'/':  `\2f`,
+	':':  `\3a`,
+	';':  `\3b`,
+	'<':  `\3c`,
+	'>':  `\3e`,
+	'\\': `\\`,
+	'{':  `\7b`,
+	'}':  `\7d`,
+}
+
+var (
+	expressionBytes = []byte("expression")
+	mozBindingBytes = []byte("mozbinding")
+)
+
+// cssValueFilter returns s if it is safe as a CSS property value, or
+// filterFailsafe if it could break out of one or run script.
+func cssValueFilter(s string) string {
+	b, id := decodeCSS([]byte(s)), make([]byte, 0, 64)
+	for i, c := range b {
+		switch c {
+		case 0, '"', '\'', '(', ')', '/', ';', '@', '[', '\\', ']', '`', '{', '}', '<', '>':
+			return filterFailsafe
+		case '-':
+			// Disallow <!-- and -->, which can end a style element.
+			if i != 0 && b[i-1] == '-' {
+				return filterFailsafe
+			}
+		default:
+			if c < utf8.RuneSelf && isCSSNmchar(rune(c)) {
+				id = append(id, c)
+			}
+		}
+	}
+	id = bytes.ToLower(id)
+	if bytes.Contains(id, expressionBytes) || bytes.Contains(id, mozBindingBytes) {
+		return filterFailsafe
+	}
+	return string(b)
+}
+
+// isCSSNmchar reports whether r may appear in a CSS identifier.
+func isCSSNmchar(r rune) bool {
+	return 'a' <= r && r <= 'z' ||
+		'A' <= r && r <= 'Z' ||
+		'0' <= r && r <= '9' ||
+		r == '-' ||
+		r == '_' ||
+		0x80 <= r && r <= 0xd7ff ||
+		0xe000 <= r && r <= 0xfffd ||
+		0x10000 <= r && r <= 0x10ffff
+}
+
+// decodeCSS decodes CSS3 escapes in s.
+func decodeCSS(s []byte) []byte {
+	i := bytes.IndexByte(s, '\\')
+	if i == -1 {
+		return s
+	}
+	// The UTF-8 sequence for a codepoint is never longer than 1 + the
+	// number of hex digits needed to represent that codepoint, so len(s)
+	// is an upper bound on the output length.
+	b := make([]byte, 0, len(s))
+	for len(s) != 0 {
+		i := bytes.IndexByte(s, '\\')
+		if i == -1 {
+			i = len(s)
+		}
+		b, s = append(b, s[:i]...), s[i:]
+		if len(s) < 2 {
+			break
+		}
+		if isHex(s[1]) {
+			// "\" hex{1,6} wc?
+			j := 2
+			for j < len(s) && j < 7 && isHex(s[j]) {
+				j++
+			}
+			r := hexDecode(s[1:j])
+			if r > utf8.MaxRune {
+				r, j = r/16, j-1
+			}
+			n := utf8.EncodeRune(b[len(b):cap(b)], r)
+			// The optional space at the end allows a hex sequence to be
+			// followed by a literal hex.
+			b, s = b[:len(b)+n], skipCSSSpace(s[j:])
+		} else {
+			// "\" followed by anything else is that character.
+			_, n := utf8.DecodeRune(s[1:])
+			b, s = append(b, s[1:1+n]...), s[1+n:]
+		}
+	}
+	return b
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// hexDecode decodes a short hex digit sequence.
+func hexDecode(s []byte) rune {
+	n := '\x00'
+	for _, c := range s {
+		n <<= 4
+		switch {
+		case '0' <= c && c <= '9':
+			n |= rune(c - '0')
+		case 'a' <= c && c <= 'f':
+			n |= rune(c-'a') + 10
+		case 'A' <= c && c <= 'F':
+			n |= rune(c-'A') + 10
+		default:
+			panic(fmt.Sprintf("Bad hex digit in %q", s))
+		}
+	}
+	return n
+}
+
+// skipCSSSpace returns a suffix of c, skipping over a single space.
+func skipCSSSpace(c []byte) []byte {
+	if len(c) == 0 {
+		return c
+	}
+	// wc ::= #x9 | #xA | #xC | #xD | #x20
+	switch c[0] {
+	case '\t', '\n', '\f', ' ':
+		return c[1:]
+	case '\r':
+		// This differs from CSS3's wc production because it contains a
+		// probable spec error whereby wc contains all the single byte
+		// sequences in nl (newline) but not CRLF.
+		if len(c) >= 2 && c[1] == '\n' {
+			return c[2:]
+		}
+		return c[1:]
+	}
+	return c
+}
+
+// isCSSSpace reports whether b is a CSS space char as defined in wc.
+func isCSSSpace(b byte) bool {
+	switch b {
+	case '\t', '\n', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
@@ -45,6 +45,7 @@ func builtins() textTemplates.FuncMap {
 			}
 			return 0, fmt.Errorf("len of type %s", item.Type())
 		},
+		"asType":  AsType,
 		"print":   fmt.Sprint,
 		"printf":  fmt.Sprintf,
 		"println": fmt.Sprintln,
@@ -61,3 +62,45 @@ func builtins() textTemplates.FuncMap {
 		// "ne": ne, // !=
 	}
 }
+
+// CompareIntUint compares a signed and an unsigned integer by value, as
+// text/template's comparison functions do: it returns -1 if i < u, 0 if
+// they are equal and +1 if i > u. Typed templates call it where Go
+// would need a conversion that changes some values.
+func CompareIntUint(i int64, u uint64) int {
+	switch {
+	case i < 0 || uint64(i) < u:
+		return -1
+	case uint64(i) == u:
+		return 0
+	}
+	return 1
+}
+
+// AsType returns value if its dynamic type is typeName, written as in a
+// template's {{with asType .Block "models.TextBlock"}}: qualified by
+// package name or by full import path, with a * per pointer. It returns
+// nil otherwise, so {{with}} skips the branch.
+func AsType(value any, typeName string) any {
+	if value == nil {
+		return nil
+	}
+	t := reflect.TypeOf(value)
+	if t.String() == typeName || qualifiedTypeName(t) == typeName {
+		return value
+	}
+	return nil
+}
+
+// qualifiedTypeName returns t's name qualified by its import path.
+func qualifiedTypeName(t reflect.Type) string {
+	stars := ""
+	for t.Kind() == reflect.Pointer && t.Name() == "" {
+		stars += "*"
+		t = t.Elem()
+	}
+	if t.PkgPath() == "" {
+		return stars + t.String()
+	}
+	return stars + t.PkgPath() + "." + t.Name()
+}
@@ -0,0 +1,330 @@
+// Package sprig has typed equivalents of the slim-sprig template
+// functions that sprig implements unexported or as closures, so typed
+// render functions can call them directly. Each behaves like the sprig
+// function of the same template name, narrowed to a static signature
+// where sprig accepts several types at runtime.
+//
+// Generated code references only the functions a template uses, so the
+// rest of sprig is never linked in.
+package sprig
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Strings. Several take the string operated on last, as sprig does, so
+// it can be piped in: {{.Name | trimPrefix "Dr. "}}.
+
+func Trunc(c int, s string) string {
+	if c < 0 && len(s)+c > 0 {
+		return s[len(s)+c:]
+	}
+	if c >= 0 && len(s) > c {
+		return s[:c]
+	}
+	return s
+}
+
+func Substr(start, end int, s string) string {
+	if start < 0 {
+		return s[:end]
+	}
+	if end < 0 || end > len(s) {
+		return s[start:]
+	}
+	return s[start:end]
+}
+
+func Repeat(count int, s string) string { return strings.Repeat(s, count) }
+
+func TrimAll(cutset, s string) string { return strings.Trim(s, cutset) }
+
+func TrimPrefix(prefix, s string) string { return strings.TrimPrefix(s, prefix) }
+
+func TrimSuffix(suffix, s string) string { return strings.TrimSuffix(s, suffix) }
+
+func Contains(substr, s string) bool { return strings.Contains(s, substr) }
+
+func HasPrefix(prefix, s string) bool { return strings.HasPrefix(s, prefix) }
+
+func HasSuffix(suffix, s string) bool { return strings.HasSuffix(s, suffix) }
+
+func Replace(old, new, s string) string { return strings.ReplaceAll(s, old, new) }
+
+func SplitList(sep, s string) []string { return strings.Split(s, sep) }
+
+func Join(sep string, elems []string) string { return strings.Join(elems, sep) }
+
+func Indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+func Nindent(spaces int, s string) string { return "\n" + Indent(spaces, s) }
+
+func Plural(one, many string, count int) string {
+	if count == 1 {
+		return one
+	}
+	return many
+}
+
+// Quote double-quotes each non-nil value and joins them with spaces.
+func Quote(values ...any) string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != nil {
+			out = append(out, strconv.Quote(ToString(v)))
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// Squote single-quotes each non-nil value and joins them with spaces.
+func Squote(values ...any) string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != nil {
+			out = append(out, fmt.Sprintf("'%v'", v))
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// Cat joins the non-nil values with spaces.
+func Cat(values ...any) string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != nil {
+			out = append(out, fmt.Sprint(v))
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// ToString formats v as sprig's toString does, preferring its Error or
+// String method.
+func ToString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func Atoi(s string) int {
+	i, _ := strconv.Atoi(s)
+	return i
+}
+
+// Encodings and hashes. Decoders return the error text for bad input,
+// as sprig does.
+
+func B64Enc(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+func B64Dec(s string) string {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+func B32Enc(s string) string { return base32.StdEncoding.EncodeToString([]byte(s)) }
+
+func B32Dec(s string) string {
+	data, err := base32.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+func Sha1Sum(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func Sha256Sum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func Adler32Sum(s string) string { return strconv.FormatUint(uint64(adler32.Checksum([]byte(s))), 10) }
+
+// Defaults. What counts as empty depends on the value, as in sprig,
+// and the result has the type of the arguments.
+
+// Default returns given[0] unless it is missing or empty, and d
+// otherwise.
+func Default[T any](d T, given ...T) T {
+	if len(given) == 0 || Empty(given[0]) {
+		return d
+	}
+	return given[0]
+}
+
+// Empty reports whether v is nil or the zero value of its type, except
+// that structs are never empty.
+func Empty(v any) bool {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return true
+	}
+	switch rv.Kind() {
+	case reflect.Array, reflect.Slice, reflect.Map, reflect.String:
+		return rv.Len() == 0
+	case reflect.Bool:
+		return !rv.Bool()
+	case reflect.Complex64, reflect.Complex128:
+		return rv.Complex() == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return rv.Float() == 0
+	case reflect.Struct:
+		return false
+	}
+	return rv.IsNil()
+}
+
+// Coalesce returns the first non-empty value, or the zero value.
+func Coalesce[T any](values ...T) T {
+	for _, v := range values {
+		if !Empty(v) {
+			return v
+		}
+	}
+	var zero T
+	return zero
+}
+
+func Ternary[T any](whenTrue, whenFalse T, cond bool) T {
+	if cond {
+		return whenTrue
+	}
+	return whenFalse
+}
+
+// Fail stops rendering with msg as the error.
+func Fail(msg string) (string, error) { return "", errors.New(msg) }
+
+// Dates take a time.Time where sprig also accepts Unix seconds.
+
+func Date(layout string, t time.Time) string { return DateInZone(layout, t, "Local") }
+
+// DateInZone formats t in the named zone, or in UTC if the zone is
+// unknown.
+func DateInZone(layout string, t time.Time, zone string) string {
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		loc = time.UTC
+	}
+	return t.In(loc).Format(layout)
+}
+
+func HTMLDate(t time.Time) string { return Date("2006-01-02", t) }
+
+func HTMLDateInZone(t time.Time, zone string) string { return DateInZone("2006-01-02", t, zone) }
+
+// Ago is the time since t, rounded to the second.
+func Ago(t time.Time) string { return time.Since(t).Round(time.Second).String() }
+
+// ToDate parses s in the local zone, returning the zero time if it
+// doesn't match layout.
+func ToDate(layout, s string) time.Time {
+	t, _ := time.ParseInLocation(layout, s, time.Local)
+	return t
+}
+
+func MustToDate(layout, s string) (time.Time, error) {
+	return time.ParseInLocation(layout, s, time.Local)
+}
+
+func UnixEpoch(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) }
+
+// Regular expressions. The plain forms panic on a bad pattern, as
+// sprig's do; the Must forms return the error.
+
+func RegexMatch(pattern, s string) bool {
+	match, _ := regexp.MatchString(pattern, s)
+	return match
+}
+
+func MustRegexMatch(pattern, s string) (bool, error) { return regexp.MatchString(pattern, s) }
+
+func RegexFind(pattern, s string) string { return regexp.MustCompile(pattern).FindString(s) }
+
+func MustRegexFind(pattern, s string) (string, error) {
+	r, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	return r.FindString(s), nil
+}
+
+func RegexFindAll(pattern, s string, n int) []string {
+	return regexp.MustCompile(pattern).FindAllString(s, n)
+}
+
+func MustRegexFindAll(pattern, s string, n int) ([]string, error) {
+	r, err := regexp.Compile(pattern)
+	if err != nil {
+		return []string{}, err
+	}
+	return r.FindAllString(s, n), nil
+}
+
+func RegexReplaceAll(pattern, s, repl string) string {
+	return regexp.MustCompile(pattern).ReplaceAllString(s, repl)
+}
+
+func MustRegexReplaceAll(pattern, s, repl string) (string, error) {
+	r, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	return r.ReplaceAllString(s, repl), nil
+}
+
+func RegexReplaceAllLiteral(pattern, s, repl string) string {
+	return regexp.MustCompile(pattern).ReplaceAllLiteralString(s, repl)
+}
+
+func MustRegexReplaceAllLiteral(pattern, s, repl string) (string, error) {
+	r, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	return r.ReplaceAllLiteralString(s, repl), nil
+}
+
+func RegexSplit(pattern, s string, n int) []string { return regexp.MustCompile(pattern).Split(s, n) }
+
+func MustRegexSplit(pattern, s string, n int) ([]string, error) {
+	r, err := regexp.Compile(pattern)
+	if err != nil {
+		return []string{}, err
+	}
+	return r.Split(s, n), nil
+}
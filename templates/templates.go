@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"sort"
 	textTemplates "text/template"
 )
 
@@ -48,9 +49,9 @@ func EvalField(data any, parts []string) (any, error) {
 
 	// Traverse the parts
 	for _, part := range parts {
-		// Handle nil values
+		// A missing key returned already; this nil was stored.
 		if current == nil {
-			return "", nil
+			return "", fmt.Errorf("nil pointer evaluating interface {}.%s", part)
 		}
 
 		// Fast path for common map types without using reflection
@@ -78,7 +79,7 @@ func EvalField(data any, parts []string) (any, error) {
 		// Dereference pointers and interfaces
 		for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
 			if v.IsNil() {
-				return "", nil
+				return "", fmt.Errorf("nil pointer evaluating %s.%s", v.Type(), part)
 			}
 			v = v.Elem()
 		}
@@ -99,10 +100,11 @@ func EvalField(data any, parts []string) (any, error) {
 			current = v.Interface()
 
 		case reflect.Struct:
-			v = v.FieldByName(part)
-			if !v.IsValid() {
-				return "", nil
+			field := v.FieldByName(part)
+			if !field.IsValid() {
+				return "", fmt.Errorf("can't evaluate field %s in type %s", part, v.Type())
 			}
+			v = field
 			if !v.CanInterface() {
 				return "", fmt.Errorf("cannot access unexported field %s", part)
 			}
@@ -228,8 +230,9 @@ func callFunction(fn any, args ...any) (any, error) {
 			}
 		}
 
-		// Call variadic function
-		out := v.CallSlice(in)
+		// Call variadic function; Call gathers the trailing arguments
+		// into its slice.
+		out := v.Call(in)
 
 		// Handle return values
 		if len(out) == 0 {
@@ -380,6 +383,39 @@ func GetIterable(val any) (any, error) {
 	}
 }
 
+// RangeItems returns the keys and values a range over val visits, so
+// generated code can loop over any iterable with a single body: a map's
+// entries in key order, as text/template visits them, or a slice's
+// elements with their indexes.
+func RangeItems(val any) ([]any, []any, error) {
+	iterable, err := GetIterable(val)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch it := iterable.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(it))
+		for k := range it {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		anyKeys := make([]any, len(keys))
+		values := make([]any, len(keys))
+		for i, k := range keys {
+			anyKeys[i] = k
+			values[i] = it[k]
+		}
+		return anyKeys, values, nil
+	case []any:
+		keys := make([]any, len(it))
+		for i := range it {
+			keys[i] = i
+		}
+		return keys, it, nil
+	}
+	return nil, nil, fmt.Errorf("value of type %T cannot be iterated", iterable)
+}
+
 // ConvertToAnySlice converts any iterable type to []any
 func ConvertToAnySlice(val any) ([]any, error) {
 	// Already a slice of any
@@ -0,0 +1,180 @@
+package templates
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// The writers below print values for typed render functions. They
+// escape like html/template does for text content, and avoid the boxing
+// fmt.Fprint needs, so printing numbers does not allocate, nor does
+// printing strings when the writer has a WriteString method.
+
+// htmlReplacements is html/template's replacement table for text
+// content. Every other byte is written unchanged.
+var htmlReplacements = [...]string{
+	0:    "\uFFFD",
+	'"':  "&#34;",
+	'&':  "&amp;",
+	'\'': "&#39;",
+	'+':  "&#43;",
+	'<':  "&lt;",
+	'>':  "&gt;",
+}
+
+// WriteEscapedString writes s to writer with HTML special characters
+// escaped.
+func WriteEscapedString(writer io.Writer, s string) error {
+	written := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if int(c) >= len(htmlReplacements) || htmlReplacements[c] == "" {
+			continue
+		}
+		if written < i {
+			if _, err := io.WriteString(writer, s[written:i]); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(writer, htmlReplacements[c]); err != nil {
+			return err
+		}
+		written = i + 1
+	}
+	if written < len(s) {
+		_, err := io.WriteString(writer, s[written:])
+		return err
+	}
+	return nil
+}
+
+// HTMLEscaper is an io.Writer that escapes everything written through it
+// like WriteEscapedString, so typed printf calls can format straight to
+// the output instead of building a string first.
+type HTMLEscaper struct {
+	Writer io.Writer
+}
+
+func (e HTMLEscaper) Write(p []byte) (int, error) {
+	written := 0
+	for i, c := range p {
+		if int(c) >= len(htmlReplacements) || htmlReplacements[c] == "" {
+			continue
+		}
+		if written < i {
+			if _, err := e.Writer.Write(p[written:i]); err != nil {
+				return written, err
+			}
+		}
+		if _, err := io.WriteString(e.Writer, htmlReplacements[c]); err != nil {
+			return i, err
+		}
+		written = i + 1
+	}
+	if written < len(p) {
+		if _, err := e.Writer.Write(p[written:]); err != nil {
+			return written, err
+		}
+	}
+	return len(p), nil
+}
+
+// WriteInt writes i in decimal. Digits and signs need no escaping.
+func WriteInt(writer io.Writer, i int64) error {
+	b, buf := scratch(writer)
+	_, err := writer.Write(strconv.AppendInt(b, i, 10))
+	buf.release()
+	return err
+}
+
+// WriteUint writes u in decimal.
+func WriteUint(writer io.Writer, u uint64) error {
+	b, buf := scratch(writer)
+	_, err := writer.Write(strconv.AppendUint(b, u, 10))
+	buf.release()
+	return err
+}
+
+// WriteFloat writes f as fmt.Print formats a float of bitSize bits,
+// escaping the '+' of a positive exponent or infinity.
+func WriteFloat(writer io.Writer, f float64, bitSize int) error {
+	b, buf := scratch(writer)
+	b = strconv.AppendFloat(b, f, 'g', -1, bitSize)
+	if i := bytes.IndexByte(b, '+'); i >= 0 {
+		// b may alias the writer's buffer, so rebuild it in place
+		// rather than writing the pieces separately.
+		var tail [8]byte
+		n := copy(tail[:], b[i+1:])
+		b = append(append(b[:i], htmlReplacements['+']...), tail[:n]...)
+	}
+	_, err := writer.Write(b)
+	buf.release()
+	return err
+}
+
+// WriteEscaped writes a value whose type is only known at runtime, the
+// way html/template prints it: untyped nil as nothing, template.HTML
+// unescaped, and anything else formatted by fmt after following
+// pointers to a Stringer, an error or a plain value, then escaped.
+func WriteEscaped(writer io.Writer, value any) error {
+	switch v := value.(type) {
+	case nil:
+		// html/template skips untyped nil rather than printing <nil>.
+		return nil
+	case string:
+		return WriteEscapedString(writer, v)
+	case template.HTML:
+		_, err := io.WriteString(writer, string(v))
+		return err
+	}
+	return WriteEscapedString(writer, fmt.Sprint(indirectToStringerOrError(value)))
+}
+
+// scratchBuf holds a number being formatted for a writer without spare
+// capacity of its own. Writers must not retain what they are given, so
+// it can be reused as soon as Write returns.
+type scratchBuf [32]byte
+
+var scratchPool = sync.Pool{New: func() any { return new(scratchBuf) }}
+
+// scratch returns an empty slice to append a number to: the writer's
+// own spare capacity when it offers it, or else a pooled buffer, also
+// returned, to release once written.
+func scratch(writer io.Writer) ([]byte, *scratchBuf) {
+	if w, ok := writer.(interface{ AvailableBuffer() []byte }); ok {
+		return w.AvailableBuffer(), nil
+	}
+	buf := scratchPool.Get().(*scratchBuf)
+	return buf[:0], buf
+}
+
+// release returns buf to the pool; a nil buf is ignored.
+func (buf *scratchBuf) release() {
+	if buf != nil {
+		scratchPool.Put(buf)
+	}
+}
+
+var (
+	errorType       = reflect.TypeFor[error]()
+	fmtStringerType = reflect.TypeFor[fmt.Stringer]()
+)
+
+// indirectToStringerOrError dereferences value until it reaches a nil
+// pointer, a Stringer, an error or a non-pointer, as html/template does
+// before printing.
+func indirectToStringerOrError(value any) any {
+	if value == nil {
+		return nil
+	}
+	v := reflect.ValueOf(value)
+	for !v.Type().Implements(fmtStringerType) && !v.Type().Implements(errorType) && v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v.Interface()
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"go/types"
 	"io"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"text/template/parse"
 )
@@ -39,36 +41,115 @@ func renderFuncName(templateName string) string {
 // In addition, the caller emits a registry shim that type-asserts `any`
 // to the static type and forwards to this function so that
 // Parsed.ExecuteTemplate keeps working.
-func emitTypedTemplate(out io.Writer, opts GenOptions, templatePath, templateName string,
-	tree *parse.Tree, lineIdx *LineIndex, dataType types.Type, dataTypeExpr string) error {
-
+func emitTypedTemplate(out io.Writer, opts GenOptions, resolver *TypeResolver, imports *ImportSet, rt *resolvedTemplate, all map[string]*resolvedTemplate) error {
 	g := &Generator{
 		Writer:       out,
-		TemplatePath: templatePath,
-		LineIndex:    lineIdx,
-		DataType:     dataType,
-		DotType:      dataType,
+		Filename:     rt.Filename,
+		TemplateName: filepath.Base(rt.Filename),
+		TemplatePath: rt.TemplatePath,
+		LineIndex:    rt.LineIndex,
+		PackageName:  opts.PackageName,
+		Imports:      imports,
+		Resolver:     resolver,
+		Funcs:        rt.Funcs,
+		TypeAliases:  rt.Directives.Imports,
+		FuncAliases:  map[string]string{},
+		Templates:    all,
+		DataType:     rt.DataType,
+		DotType:      rt.DataType,
 		DataExpr:     "data",
 		DotExpr:      "data",
+		Fallback:     opts.Fallback,
+		Escaping:     rt.Escaping,
+		Warnings:     opts.Warnings,
+	}
+	for alias, path := range rt.Directives.FuncsAlias {
+		g.FuncAliases[path] = alias
+	}
+
+	params := []string{"writer io.Writer"}
+	if len(rt.Params) > 0 {
+		// Dot has no static type; the template reads its parameters
+		// through the $variables declared for them.
+		g.DataExpr, g.DotExpr = "", ""
+		for i, p := range rt.Params {
+			if reservedParamNames[p.Name] || types.Universe.Lookup(p.Name) != nil {
+				return Diagnostics{{
+					File:    rt.Filename,
+					Line:    rt.Directives.Params[i].Line,
+					Message: fmt.Sprintf("@param %s is reserved in generated code; rename it", p.Name),
+				}}
+			}
+			g.BindVar("$"+p.Name, ScopeBinding{GoExpr: p.Name, Type: p.Type})
+			params = append(params, p.Name+" "+p.TypeExpr)
+		}
+	} else {
+		g.BindVar("$", ScopeBinding{GoExpr: g.DataExpr, Type: rt.DataType})
+		params = append(params, "data "+rt.DataTypeExpr)
 	}
 
-	fnName := renderFuncName(templateName)
-	_, _ = fmt.Fprintf(out, "\nfunc %s(writer io.Writer, data %s) error {\n\tvar err error\n", fnName, dataTypeExpr)
+	fnName := renderFuncName(rt.BaseName)
+	_, _ = fmt.Fprintf(out, "\nfunc %s(%s) error {\n\tvar err error\n", fnName, strings.Join(params, ", "))
 
-	for _, node := range tree.Root.Nodes {
+	for _, node := range rt.Tree.Root.Nodes {
 		if err := g.emitNode(node); err != nil {
-			return fmt.Errorf("%s: %w", templateName, err)
+			return err
 		}
 	}
+	if len(g.Diagnostics) > 0 {
+		return g.Diagnostics
+	}
 
 	_, _ = fmt.Fprintf(out, "\n\treturn nil\n}\n")
 	return nil
 }
 
-// emitNode dispatches to the right typed-emitter for a parse.Node.
+// reservedParamNames are identifiers every typed render function uses,
+// which a @param can't take.
+var reservedParamNames = map[string]bool{"writer": true, "err": true, "data": true}
+
+// emitNode emits node as typed code. A node typed mode can't compile is
+// recorded in g.Diagnostics and generation carries on with the next, so
+// one run reports every problem; with g.Fallback set it is emitted as
+// dynamic code instead, see emitFallback. Either way only the innermost
+// failing node is affected: an {{if}} whose body has a bad action keeps
+// its typed condition.
+func (g *Generator) emitNode(node parse.Node) error {
+	var (
+		imports = g.Imports.clone()
+		depth   = g.Depth
+		dotExpr = g.DotExpr
+		dotType = g.DotType
+		scopes  = len(g.Scopes)
+		loops   = len(g.Loops)
+	)
+	body, err := g.capture(func() error { return g.emitTypedNode(node) })
+	if err == nil {
+		g.Writef("%s", body)
+		return nil
+	}
+	// Discard the failed attempt's output and state.
+	*g.Imports = *imports
+	g.Depth, g.DotExpr, g.DotType, g.Scopes = depth, dotExpr, dotType, g.Scopes[:scopes]
+	g.Loops = g.Loops[:loops]
+
+	d := nodeDiagnostic(g.Filename, g.LineIndex, int64(node.Position()), err)
+	if !g.Fallback || !g.canFallBack(node) {
+		g.Diagnostics = append(g.Diagnostics, d)
+		return nil
+	}
+	if g.Warnings != nil {
+		d.Message = "warning: " + d.Message + "; falling back to dynamic code"
+		_, _ = fmt.Fprintln(g.Warnings, d)
+	}
+	g.emitFallback(node)
+	return nil
+}
+
+// emitTypedNode dispatches to the right typed-emitter for a parse.Node.
 // Unsupported node types return a clear error so users know their
 // template can't be compiled in typed mode yet.
-func (g *Generator) emitNode(node parse.Node) error {
+func (g *Generator) emitTypedNode(node parse.Node) error {
 	g.EmitLine(int64(node.Position()))
 
 	switch n := node.(type) {
@@ -76,105 +157,561 @@ func (g *Generator) emitNode(node parse.Node) error {
 		return g.emitTextNode(n)
 	case *parse.ActionNode:
 		return g.emitActionNode(n)
+	case *parse.IfNode:
+		return g.emitIfNode(n)
+	case *parse.RangeNode:
+		return g.emitRangeNode(n)
+	case *parse.WithNode:
+		return g.emitWithNode(n)
+	case *parse.TemplateNode:
+		return g.emitTemplateNode(n)
+	case *parse.BreakNode:
+		g.Line("%s", g.breakStmt())
+		return nil
+	case *parse.ContinueNode:
+		g.Line("continue")
+		return nil
 	case *parse.CommentNode:
 		// Comments are no-ops at runtime.
 		return nil
 	default:
-		return fmt.Errorf("typed mode does not yet support %T (line %d)", n,
-			lineNumberFor(g.LineIndex, int64(node.Position())))
+		return errorAtLine(lineNumberFor(g.LineIndex, int64(node.Position())), "typed mode does not yet support %T",
+			n)
 	}
 }
 
+// emitTemplateNode compiles {{template "name" pipeline}} into a direct
+// call of the named template's typed render function. The callee must
+// be a typed template whose @data type the pipeline's value is
+// assignable to.
+func (g *Generator) emitTemplateNode(n *parse.TemplateNode) error {
+	line := lineNumberFor(g.LineIndex, int64(n.Position()))
+	callee, ok := g.Templates[n.Name]
+	if !ok {
+		return errorAtLine(line, "typed mode can only call typed templates, and %s is neither a template file nor a {{define}} with @data",
+			n.Name)
+	}
+	if len(callee.Params) > 0 {
+		return errorAtLine(line, "%s takes @param parameters, which {{template}} can't pass; render it from Go",
+			n.Name)
+	}
+	if callee.DataType == nil {
+		return errorAtLine(line, "typed mode can only call typed templates, and %s has no data type", n.Name)
+	}
+
+	var (
+		expr string
+		typ  types.Type
+	)
+	if n.Pipe == nil {
+		// text/template executes the callee with nil data.
+		expr, typ = "nil", types.Typ[types.UntypedNil]
+	} else {
+		var err error
+		if expr, typ, err = g.evalPipe(n.Pipe); err != nil {
+			return err
+		}
+	}
+	if !types.AssignableTo(typ, callee.DataType) {
+		return errorAtLine(line, "{{template %q}} passes %s, but %s declares data type %s",
+			n.Name, typ, callee.DataDecl, callee.DataType)
+	}
+	g.Line("if err = %s(writer, %s); err != nil { return err }", renderFuncName(callee.BaseName), expr)
+	return nil
+}
+
+// emitList emits the body of a control structure one block deeper and
+// in its own $variable scope, matching text/template where a variable
+// declared inside {{if}} ends at the matching {{end}}.
+func (g *Generator) emitList(list *parse.ListNode) error {
+	if list == nil {
+		return nil
+	}
+	g.Depth++
+	g.PushScope()
+	defer func() {
+		g.PopScope()
+		g.Depth--
+	}()
+
+	for _, node := range list.Nodes {
+		if err := g.emitNode(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emitTextNode writes text as html/template would, which strips HTML
+// comments, for one.
 func (g *Generator) emitTextNode(n *parse.TextNode) error {
-	g.Writef("\t_, err = io.WriteString(writer, %q)\n", string(n.Text))
-	g.Writef("\tif err != nil { return err }\n")
+	text := g.Escaping.text(n)
+	if len(text) == 0 {
+		return nil
+	}
+	g.Line("_, err = io.WriteString(writer, %q)", string(text))
+	g.Line("if err != nil { return err }")
 	return nil
 }
 
-// emitActionNode handles {{.Field}}, {{.Foo.Bar}}, and {{.}} in typed mode.
-// Function calls and pipelines are not yet supported in this MVP.
+// emitActionNode prints the value of a pipeline such as {{.Field}} or
+// {{.Title | upper}} in typed mode. Values printed in HTML text are
+// escaped by their static type; anywhere else, such as in an attribute
+// or a script, they go through the escapers html/template chose.
 func (g *Generator) emitActionNode(n *parse.ActionNode) error {
 	if n.Pipe == nil || len(n.Pipe.Cmds) == 0 {
 		return nil
 	}
-	if len(n.Pipe.Cmds) > 1 {
-		return fmt.Errorf("typed mode does not yet support pipelines (line %d)",
-			lineNumberFor(g.LineIndex, int64(n.Position())))
+	if len(n.Pipe.Decl) > 0 {
+		return g.emitDeclaration(n.Pipe)
 	}
-	cmd := n.Pipe.Cmds[0]
-	if len(cmd.Args) == 0 {
+	escapers := g.Escaping.escapers(n)
+	if len(escapers) == 0 {
+		if ok, err := g.emitPrintf(n.Pipe); ok {
+			return err
+		}
+	}
+
+	expr, typ, err := g.evalPipe(n.Pipe)
+	if err != nil {
+		return err
+	}
+	if len(escapers) > 0 {
+		g.Line("err = templates.WriteEscapedWith(writer, %s, %s)", expr, strings.Join(escapers, ", "))
+		g.Line("if err != nil { return err }")
 		return nil
 	}
+	g.emitPrint(expr, typ)
+	return nil
+}
+
+// emitDeclaration compiles {{$x := pipeline}} and {{$x = pipeline}},
+// which print nothing. Each declaration gets a Go variable of its own,
+// so a name may be declared again where Go couldn't, and an assignment
+// must keep the variable's type.
+func (g *Generator) emitDeclaration(pipe *parse.PipeNode) error {
+	line := lineNumberFor(g.LineIndex, int64(pipe.Position()))
+	name := pipe.Decl[0].Ident[0]
+	if !pipe.IsAssign {
+		expr, typ, err := g.evalCommands(pipe)
+		if err != nil {
+			return err
+		}
+		local := fmt.Sprintf("local%d", g.NextVar())
+		g.Line("%s := %s", local, expr)
+		g.Line("_ = %s", local)
+		g.BindVar(name, ScopeBinding{GoExpr: local, Type: typ, Assignable: true})
+		return nil
+	}
+
+	b, ok := g.LookupVar(name)
+	if !ok {
+		return errorAtLine(line, "undefined variable %s", name)
+	}
+	if !b.Assignable {
+		return errorAtLine(line, "typed mode can only assign to variables declared with %s :=, not those of {{range}}, {{with}} or @param", name)
+	}
+	expr, typ, err := g.evalCommands(pipe)
+	if err != nil {
+		return err
+	}
+	switch {
+	case types.AssignableTo(typ, b.Type):
+	case widensTo(typ, b.Type):
+		// Such as an int64 into an int, on 64-bit platforms.
+		expr = fmt.Sprintf("%s(%s)", g.TypeExpr(b.Type), expr)
+	default:
+		return errorAtLine(line, "can't assign %s of type %s to %s of type %s", pipe.Cmds[0], typ, name, b.Type)
+	}
+	g.Line("%s = %s", b.GoExpr, expr)
+	return nil
+}
+
+// widensTo reports whether every value of the integer type from is one
+// of the integer type to, so converting it to that loses nothing.
+func widensTo(from, to types.Type) bool {
+	f, ok := from.Underlying().(*types.Basic)
+	if !ok || f.Info()&types.IsInteger == 0 {
+		return false
+	}
+	t, ok := to.Underlying().(*types.Basic)
+	if !ok || t.Info()&types.IsInteger == 0 {
+		return false
+	}
+	fromUnsigned, toUnsigned := f.Info()&types.IsUnsigned != 0, t.Info()&types.IsUnsigned != 0
+	switch {
+	case fromUnsigned == toUnsigned:
+		return sizes.Sizeof(f) <= sizes.Sizeof(t)
+	case fromUnsigned:
+		return sizes.Sizeof(f) < sizes.Sizeof(t)
+	}
+	return false
+}
 
-	expr, _, err := g.evalCommandArg(cmd.Args[0])
+// emitIfNode compiles {{if}}, {{else if}} and {{else}} into a native Go
+// if/else chain. Conditions are tested statically by truthExpr, so the
+// generated code never calls templates.IsTrue.
+func (g *Generator) emitIfNode(n *parse.IfNode) error {
+	cond, err := g.evalCond(n.Pipe)
 	if err != nil {
 		return err
 	}
+	g.Line("if %s {", cond)
+	return g.emitIfBranches(n)
+}
+
+// emitIfBranches writes the body and else branches of n once its
+// opening "if cond {" line is out. An {{else if}} whose condition needs
+// no supporting statements continues the chain as "} else if cond {";
+// otherwise it nests inside a plain else block.
+func (g *Generator) emitIfBranches(n *parse.IfNode) error {
+	if err := g.emitList(n.List); err != nil {
+		return err
+	}
+	if n.ElseList == nil {
+		g.Line("}")
+		return nil
+	}
+
+	if len(n.ElseList.Nodes) == 1 {
+		if elseIf, ok := n.ElseList.Nodes[0].(*parse.IfNode); ok {
+			var cond string
+			stmts, err := g.capture(func() (err error) {
+				cond, err = g.evalCond(elseIf.Pipe)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if stmts == "" {
+				g.Line("} else if %s {", cond)
+				return g.emitIfBranches(elseIf)
+			}
+		}
+	}
 
-	g.Writef("\t_, err = fmt.Fprint(writer, %s)\n", expr)
-	g.Writef("\tif err != nil { return err }\n")
+	g.Line("} else {")
+	if err := g.emitList(n.ElseList); err != nil {
+		return err
+	}
+	g.Line("}")
 	return nil
 }
 
+// emitWithNode compiles {{with}} into an if statement that evaluates
+// the pipeline once in its init clause and tests it statically. Inside
+// the body dot is that local, so field accesses read through a value
+// already known to be non-nil rather than re-walking the original path.
+// {{else with}} continues the chain as "} else if v := ...; cond {".
+func (g *Generator) emitWithNode(n *parse.WithNode) error {
+	if _, _, ok := g.asTypeCall(n.Pipe); ok {
+		return g.emitTypeSwitch(n)
+	}
+	cond, body, err := g.withBranch(n)
+	if err != nil {
+		return err
+	}
+	g.Line("if %s {", cond)
+	g.Writef("%s", body)
+	return g.emitWithElse(n)
+}
+
+// emitWithElse writes the else branches of n, mirroring emitIfBranches.
+func (g *Generator) emitWithElse(n *parse.WithNode) error {
+	if n.ElseList == nil {
+		g.Line("}")
+		return nil
+	}
+
+	if len(n.ElseList.Nodes) == 1 {
+		if elseWith, ok := n.ElseList.Nodes[0].(*parse.WithNode); ok {
+			var cond, body string
+			stmts, err := g.capture(func() (err error) {
+				cond, body, err = g.withBranch(elseWith)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if stmts == "" {
+				g.Line("} else if %s {", cond)
+				g.Writef("%s", body)
+				return g.emitWithElse(elseWith)
+			}
+		}
+	}
+
+	g.Line("} else {")
+	if err := g.emitList(n.ElseList); err != nil {
+		return err
+	}
+	g.Line("}")
+	return nil
+}
+
+// withBranch evaluates a {{with}} pipeline and generates its body with
+// dot, and any declared variable, narrowed to the pipeline value. It
+// returns the if condition, which binds the value in an init clause only
+// when the body reads it, together with the body's code.
+func (g *Generator) withBranch(n *parse.WithNode) (cond, body string, err error) {
+	line := lineNumberFor(g.LineIndex, int64(n.Position()))
+	if n.Pipe.IsAssign {
+		return "", "", errorAtLine(line, "typed mode does not yet support assigning to existing variables in {{with}}")
+	}
+
+	expr, typ, err := g.evalCommands(n.Pipe)
+	if err != nil {
+		return "", "", err
+	}
+	value := fmt.Sprintf("with%d", g.NextVar())
+	truth, err := truthExpr(value, typ)
+	if err != nil {
+		return "", "", atLine(line, err)
+	}
+
+	savedDotExpr, savedDotType := g.DotExpr, g.DotType
+	g.DotExpr, g.DotType = value, typ
+	g.PushScope()
+	if len(n.Pipe.Decl) > 0 {
+		g.BindVar(n.Pipe.Decl[0].Ident[0], ScopeBinding{GoExpr: value, Type: typ})
+	}
+	if _, ok := typ.(*types.Pointer); ok {
+		g.markNonNil(value)
+	}
+	body, err = g.capture(func() error { return g.emitList(n.List) })
+	g.PopScope()
+	g.DotExpr, g.DotType = savedDotExpr, savedDotType
+	if err != nil {
+		return "", "", err
+	}
+
+	if usesIdent(body, value) {
+		return fmt.Sprintf("%s := %s; %s", value, expr, truth), body, nil
+	}
+	cond, _ = truthExpr(expr, typ)
+	return cond, body, nil
+}
+
+// evalPipe returns the Go expression and static type for a pipeline.
+// Declarations are rejected: emitDeclaration compiles those of actions,
+// and those of parenthesized pipelines outlive them. See evalCommands
+// for what is evaluated.
+func (g *Generator) evalPipe(pipe *parse.PipeNode) (string, types.Type, error) {
+	if len(pipe.Decl) > 0 {
+		return "", nil, fmt.Errorf("typed mode does not yet support declaring variables inside parentheses")
+	}
+	return g.evalCommands(pipe)
+}
+
+// evalCommands evaluates the commands of a pipeline, ignoring any
+// declaration, for callers like {{range}} that bind variables
+// themselves. Each command after the first receives the previous
+// result as its final argument, and the static type flows with it.
+func (g *Generator) evalCommands(pipe *parse.PipeNode) (string, types.Type, error) {
+	if len(pipe.Cmds) == 0 || len(pipe.Cmds[0].Args) == 0 {
+		return "", nil, errorAtLine(lineNumberFor(g.LineIndex, int64(pipe.Position())), "empty pipeline")
+	}
+	var prev *operand
+	for _, cmd := range pipe.Cmds {
+		expr, typ, err := g.evalCommand(cmd, prev)
+		if err != nil {
+			return "", nil, err
+		}
+		prev = &operand{expr: expr, typ: typ}
+	}
+	return prev.expr, prev.typ, nil
+}
+
+// evalCond evaluates an {{if}} pipeline and returns a Go boolean
+// expression for its truthiness.
+func (g *Generator) evalCond(pipe *parse.PipeNode) (string, error) {
+	return g.evalTruth(pipe)
+}
+
+// truthExpr returns a Go boolean expression that is true when expr, of
+// static type typ, is "true" by text/template's rules: non-zero numbers
+// and bools, non-empty strings and collections, non-nil pointers and
+// interfaces. Structs are always true.
+func truthExpr(expr string, typ types.Type) (string, error) {
+	switch u := typ.Underlying().(type) {
+	case *types.Basic:
+		info := u.Info()
+		switch {
+		case info&types.IsBoolean != 0:
+			return expr, nil
+		case info&types.IsString != 0:
+			return fmt.Sprintf("len(%s) > 0", expr), nil
+		case info&types.IsNumeric != 0:
+			return fmt.Sprintf("%s != 0", expr), nil
+		case u.Kind() == types.UntypedNil:
+			return "false", nil
+		}
+	case *types.Slice, *types.Array, *types.Map, *types.Chan:
+		return fmt.Sprintf("len(%s) > 0", expr), nil
+	case *types.Pointer, *types.Interface, *types.Signature:
+		return fmt.Sprintf("%s != nil", expr), nil
+	case *types.Struct:
+		return "true", nil
+	}
+	return "", fmt.Errorf("cannot determine truth of type %s", typ)
+}
+
 // evalCommandArg returns the Go expression and static type for a single
 // argument of an action command. Supports FieldNode, DotNode, and
 // VariableNode chains. Anything else is rejected.
 func (g *Generator) evalCommandArg(arg parse.Node) (expr string, typ types.Type, err error) {
 	switch a := arg.(type) {
 	case *parse.DotNode:
+		if err := g.checkDot(a.Position()); err != nil {
+			return "", nil, err
+		}
 		return g.DotExpr, g.DotType, nil
 
 	case *parse.FieldNode:
-		return g.fieldExpr(g.DotExpr, g.DotType, a.Ident, int64(a.Position()))
+		if err := g.checkDot(a.Position()); err != nil {
+			return "", nil, err
+		}
+		return g.fieldExpr(g.DotExpr, g.DotType, a.Ident, a.String(), int64(a.Position()), nil, nil)
 
 	case *parse.VariableNode:
-		if len(a.Ident) == 0 {
-			return "", nil, fmt.Errorf("empty variable reference")
-		}
-		bind, ok := g.LookupVar(a.Ident[0])
-		if !ok {
-			return "", nil, fmt.Errorf("unbound variable %q (line %d)",
-				a.Ident[0], lineNumberFor(g.LineIndex, int64(a.Position())))
-		}
-		if len(a.Ident) == 1 {
-			return bind.GoExpr, bind.Type, nil
-		}
-		return g.fieldExpr(bind.GoExpr, bind.Type, a.Ident[1:], int64(a.Position()))
+		return g.evalVariable(a, nil, nil)
+
+	case *parse.ChainNode:
+		return g.evalChain(a, nil, nil)
 
 	case *parse.StringNode:
 		return a.Quoted, types.Typ[types.String], nil
 
+	case *parse.PipeNode:
+		// A parenthesized pipeline, such as the argument in {{f (g .X)}}.
+		return g.evalPipe(a)
+
+	case *parse.BoolNode:
+		return strconv.FormatBool(a.True), types.Typ[types.Bool], nil
+
+	case *parse.NumberNode:
+		// Mirror text/template's idealConstant: numbers written with a
+		// fraction or exponent are float64, other integers are int.
+		hexInt := len(a.Text) > 2 && a.Text[0] == '0' && (a.Text[1] == 'x' || a.Text[1] == 'X') &&
+			!strings.ContainsAny(a.Text, "pP")
+		looksFloat := !hexInt && a.Text[0] != '\'' && strings.ContainsAny(a.Text, ".eEpP")
+		switch {
+		case a.IsComplex:
+			return fmt.Sprintf("complex128(%s)", a.Text), types.Typ[types.Complex128], nil
+		case a.IsFloat && looksFloat, a.IsFloat && !a.IsInt:
+			return fmt.Sprintf("float64(%s)", strconv.FormatFloat(a.Float64, 'g', -1, 64)), types.Typ[types.Float64], nil
+		case a.IsInt:
+			return strconv.FormatInt(a.Int64, 10), types.Typ[types.Int], nil
+		default:
+			return "", nil, fmt.Errorf("number %s does not fit any Go type", a.Text)
+		}
+
 	default:
 		return "", nil, fmt.Errorf("typed mode does not yet support %T as command arg", a)
 	}
 }
 
+// checkDot reports an error when dot has no static type, as at the top
+// level of a template declared with @param.
+func (g *Generator) checkDot(pos parse.Pos) error {
+	if g.DotType == nil {
+		return errorAtLine(lineNumberFor(g.LineIndex, int64(pos)), "dot has no type in a template declared with @param; use the parameters' $variables")
+	}
+	return nil
+}
+
+// evalVariable returns the value of a $variable reference, following
+// any field chain after it like fieldExpr. args and final are passed to
+// a method at the end of the chain.
+func (g *Generator) evalVariable(v *parse.VariableNode, args []parse.Node, final *operand) (string, types.Type, error) {
+	if len(v.Ident) == 0 {
+		return "", nil, fmt.Errorf("empty variable reference")
+	}
+	line := lineNumberFor(g.LineIndex, int64(v.Position()))
+	bind, ok := g.LookupVar(v.Ident[0])
+	if !ok {
+		return "", nil, errorAtLine(line, "unbound variable %q", v.Ident[0])
+	}
+	if len(v.Ident) == 1 {
+		if len(args) > 0 || final != nil {
+			return "", nil, errorAtLine(line, "can't give argument to non-function %s", v.Ident[0])
+		}
+		return bind.GoExpr, bind.Type, nil
+	}
+	return g.fieldExpr(bind.GoExpr, bind.Type, v.Ident[1:], v.String(), int64(v.Position()), args, final)
+}
+
+// evalChain evaluates a field chain on a parenthesized pipeline, such
+// as (.Cost.Convert 2.0).Format, passing args and final to a method at
+// the end of the chain.
+func (g *Generator) evalChain(c *parse.ChainNode, args []parse.Node, final *operand) (string, types.Type, error) {
+	expr, typ, err := g.evalCommandArg(c.Node)
+	if err != nil {
+		return "", nil, err
+	}
+	return g.fieldExpr(expr, typ, c.Field, c.String(), int64(c.Position()), args, final)
+}
+
 // fieldExpr resolves a chain of identifiers (e.g. ["User", "Name"])
 // against a base expression and its type. Each step navigates either:
 //   - a struct field (emits ".Ident")
 //   - a map[string]X key (emits "[\"Ident\"]")
-//   - a method call on a named type with arity 0 (emits ".Ident()")
+//   - a method call (emits ".Ident(args)")
+//
+// As in text/template, only the last method in the chain takes
+// arguments: args, then the piped-in final value if there is one. A
+// method returning (T, error) gets an error check.
 //
-// It dereferences pointers as needed, like Go selector syntax.
-func (g *Generator) fieldExpr(baseExpr string, baseType types.Type, idents []string, pos int64) (string, types.Type, error) {
+// It dereferences pointers as needed, like Go selector syntax, first
+// checking each for nil so a nil pointer in path, the chain as written
+// in the template, returns an error instead of panicking.
+func (g *Generator) fieldExpr(baseExpr string, baseType types.Type, idents []string, path string, pos int64, args []parse.Node, final *operand) (string, types.Type, error) {
+	line := lineNumberFor(g.LineIndex, pos)
 	expr := baseExpr
 	currentType := baseType
 
-	for _, ident := range idents {
-		next, nextType, err := g.stepField(expr, currentType, ident)
+	for i, ident := range idents {
+		next, nextType, sig, err := g.stepField(expr, currentType, ident)
+		if err != nil {
+			return "", nil, errorAtLine(line, "field path %s: %w", strings.Join(idents, "."), err)
+		}
+		if g.readsThroughPointer(expr, currentType, sig) {
+			if checked := g.nilCheck(expr, path, line); checked != expr {
+				expr = checked
+				next, _, _, _ = g.stepField(expr, currentType, ident)
+			}
+		}
+		last := i == len(idents)-1
+		if sig == nil {
+			if last && (len(args) > 0 || final != nil) {
+				return "", nil, errorAtLine(line, "%s has arguments but cannot be invoked as function", ident)
+			}
+			expr, currentType = next, nextType
+			continue
+		}
+
+		var callArgs []parse.Node
+		var callFinal *operand
+		if last {
+			callArgs, callFinal = args, final
+		}
+		argExprs, sig, err := g.evalArgs(ident, sig, callArgs, callFinal, line)
 		if err != nil {
-			return "", nil, fmt.Errorf("field path %s: %w (line %d)",
-				strings.Join(idents, "."), err, lineNumberFor(g.LineIndex, pos))
+			return "", nil, err
+		}
+		expr, currentType, err = g.callResult(ident, fmt.Sprintf("%s(%s)", next, strings.Join(argExprs, ", ")), sig, line)
+		if err != nil {
+			return "", nil, err
 		}
-		expr = next
-		currentType = nextType
 	}
 	return expr, currentType, nil
 }
 
 // stepField navigates a single identifier from a value of the given
-// type. Returns the new Go expression and the resulting type.
-func (g *Generator) stepField(baseExpr string, baseType types.Type, ident string) (string, types.Type, error) {
+// type. For a field or map entry it returns the new Go expression and
+// its type. For a method it returns the method's selector and signature
+// for the caller to call.
+func (g *Generator) stepField(baseExpr string, baseType types.Type, ident string) (string, types.Type, *types.Signature, error) {
 	t := baseType
 	// Dereference pointers transparently (Go selector handles it; we
 	// just need to reason about the underlying type).
@@ -188,32 +725,54 @@ func (g *Generator) stepField(baseExpr string, baseType types.Type, ident string
 	if obj, _, _ := types.LookupFieldOrMethod(baseType, true, nil, ident); obj != nil {
 		switch o := obj.(type) {
 		case *types.Var: // struct field
-			return baseExpr + "." + ident, o.Type(), nil
+			return baseExpr + "." + ident, o.Type(), nil, nil
 		case *types.Func: // method
 			sig, ok := o.Type().(*types.Signature)
 			if !ok {
-				return "", nil, fmt.Errorf("method %s has unexpected type %T", ident, o.Type())
-			}
-			if sig.Params().Len() != 0 {
-				return "", nil, fmt.Errorf("method %s takes %d args; only zero-arg methods are supported in field paths",
-					ident, sig.Params().Len())
+				return "", nil, nil, fmt.Errorf("method %s has unexpected type %T", ident, o.Type())
 			}
-			if sig.Results().Len() == 0 {
-				return "", nil, fmt.Errorf("method %s returns no values", ident)
-			}
-			return baseExpr + "." + ident + "()", sig.Results().At(0).Type(), nil
+			return baseExpr + "." + ident, nil, sig, nil
 		}
 	}
 
 	// Map lookup: m["key"] for map[string]V
 	if m, ok := t.Underlying().(*types.Map); ok {
 		if basic, ok := m.Key().Underlying().(*types.Basic); ok && basic.Kind() == types.String {
-			return fmt.Sprintf("%s[%q]", baseExpr, ident), m.Elem(), nil
+			return fmt.Sprintf("%s[%q]", baseExpr, ident), m.Elem(), nil, nil
 		}
-		return "", nil, fmt.Errorf("map key type must be string, got %s", m.Key())
+		return "", nil, nil, fmt.Errorf("map key type must be string, got %s", m.Key())
 	}
 
-	return "", nil, fmt.Errorf("type %s has no field, method, or string-key map entry %q", baseType, ident)
+	return "", nil, nil, fmt.Errorf("type %s has no field, method, or string-key map entry %q", baseType, ident)
+}
+
+// readsThroughPointer reports whether stepping from expr, of type t, to
+// a field or to a method described by sig dereferences a pointer that
+// may be nil. Pointer-receiver methods accept nil, and with-bound
+// values were checked by their {{with}}.
+func (g *Generator) readsThroughPointer(expr string, t types.Type, sig *types.Signature) bool {
+	if _, ok := t.(*types.Pointer); !ok || g.NonNil[expr] {
+		return false
+	}
+	if sig == nil {
+		return true
+	}
+	_, ptrRecv := sig.Recv().Type().(*types.Pointer)
+	return !ptrRecv
+}
+
+// nilCheck writes a check that returns text/template's error for a nil
+// pointer in path if expr is nil. It returns the expression to step
+// through, a temporary when expr is costly or unsafe to repeat.
+func (g *Generator) nilCheck(expr, path string, line int) string {
+	if !isSimpleExpr(expr) {
+		tmp := fmt.Sprintf("ptr%d", g.NextVar())
+		g.Line("%s := %s", tmp, expr)
+		expr = tmp
+	}
+	msg := strings.ReplaceAll(fmt.Sprintf("%s:%d: nil pointer evaluating %s", g.TemplateName, line, path), "%", "%%")
+	g.Line("if %s == nil { return fmt.Errorf(%q) }", expr, msg)
+	return expr
 }
 
 // lineNumberFor is a small helper that returns 0 if the index is nil so
@@ -0,0 +1,1530 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// typedModels is the Go package typed codegen tests render against. It
+// lives at testpkg/models inside the harness module.
+const typedModels = `package models
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"iter"
+	"slices"
+)
+
+type Page struct {
+	Title  string
+	Count  int
+	Price  float64
+	Admin  bool
+	User   *User
+	Users  []User
+	Tags   []string
+	Scores map[string]int
+	Meta   any
+	Status Status
+	Hits   int64
+	Level  Level
+	Ratio  float32
+	Size   uint
+	Grade  uint8
+	Raw    template.HTML
+	Cost   Money
+	Blocks []Block
+}
+
+// Owner fails when there is no user, to test error checks mid-chain.
+func (p Page) Owner() (*User, error) {
+	if p.User == nil {
+		return nil, errors.New("no owner")
+	}
+	return p.User, nil
+}
+
+// Box and Pair are generic @data types.
+type Box[T any] struct {
+	Item  T
+	Items []T
+}
+
+type Pair[K comparable, V any] struct {
+	Key K
+	Val V
+}
+
+// Money is an amount in cents.
+type Money int64
+
+func (m Money) Format(currency string) string {
+	return fmt.Sprintf("%d.%02d %s", m/100, m%100, currency)
+}
+
+func (m Money) Convert(rate float64) (Money, error) {
+	if rate <= 0 {
+		return 0, fmt.Errorf("bad rate %v", rate)
+	}
+	return Money(float64(m) * rate), nil
+}
+
+type Status string
+
+type Level int
+
+func (l Level) String() string { return [...]string{"low", "high"}[l] }
+
+func (p Page) TagSeq() iter.Seq[string] { return slices.Values(p.Tags) }
+
+func (p Page) TagSeq2() iter.Seq2[int, string] { return slices.All(p.Tags) }
+
+func (p Page) TagChan() <-chan string {
+	ch := make(chan string, len(p.Tags))
+	for _, tag := range p.Tags {
+		ch <- tag
+	}
+	close(ch)
+	return ch
+}
+
+type User struct {
+	Name    string
+	Admin   bool
+	Profile *Profile
+}
+
+type Profile struct {
+	Bio string
+}
+
+// Block is a CMS content block, for type switches.
+type Block interface{ Kind() string }
+
+type TextBlock struct{ Text string }
+
+func (TextBlock) Kind() string { return "text" }
+
+type ImageBlock struct{ URL string }
+
+func (*ImageBlock) Kind() string { return "image" }
+
+type RuleBlock struct{}
+
+func (RuleBlock) Kind() string { return "rule" }
+`
+
+// typedHelpers is a @funcs package for typed codegen tests, at
+// testpkg/helpers. It mixes direct function references, a closure only
+// reachable through the map, error results and variadics.
+const typedHelpers = `package helpers
+
+import (
+	"errors"
+	"strings"
+	"text/template"
+)
+
+var FuncMap = template.FuncMap{
+	"upper": strings.ToUpper,
+	"greet": Greet,
+	"shout": func(s string) string { return s + "!" },
+	"check": Check,
+	"sum":   Sum,
+	"repeat": strings.Repeat,
+}
+
+func Greet(name string) string { return "Hello, " + name }
+
+func Check(s string) (string, error) {
+	if s == "" {
+		return "", errors.New("empty")
+	}
+	return s, nil
+}
+
+func Sum(xs ...int) int {
+	total := 0
+	for _, x := range xs {
+		total += x
+	}
+	return total
+}
+`
+
+// typedSupport are the support files every typed codegen test module
+// gets.
+var typedSupport = map[string]string{
+	"models/models.go":   typedModels,
+	"helpers/helpers.go": typedHelpers,
+}
+
+// typedFuncsRef is the @funcs directive for typedHelpers.
+const typedFuncsRef = "{{/* @funcs h=testpkg/helpers */}}"
+
+// typedDataRef is the @data directive prepended to every typed case.
+const typedDataRef = "{{/* @data testpkg/models.Page */}}"
+
+type typedCase struct {
+	name string
+	src  string // template body; typedDataRef is prepended
+	data string // Go expression of type models.Page; empty means the zero value
+	want string
+}
+
+// runTypedCases compiles every case as its own typed template in a
+// single harness module, renders them all through one driver program,
+// and compares each output. Batching keeps it to one build per test.
+func runTypedCases(t *testing.T, cases []typedCase) {
+	t.Helper()
+
+	srcs := map[string]string{}
+	var body strings.Builder
+	body.WriteString("\tvar buf bytes.Buffer\n\tvar err error\n\t_ = models.Page{}\n")
+	for i, tc := range cases {
+		name := fmt.Sprintf("case%d.html", i)
+		srcs[name] = typedDataRef + tc.src
+		data := tc.data
+		if data == "" {
+			data = "models.Page{}"
+		}
+		fmt.Fprintf(&body, "\tbuf.Reset()\n\terr = testpkg.%s(&buf, %s)\n", renderFuncName(name), data)
+		body.WriteString("\tif err != nil {\n\t\tfmt.Print(\"error: \", err)\n\t} else {\n\t\tfmt.Print(buf.String())\n\t}\n\tfmt.Print(\"\\x00\")\n")
+	}
+	res, out := runDriver(t, srcs, typedSupport, driverMain(body.String(), "bytes", "fmt", "testpkg/models"))
+
+	outputs := strings.Split(out, "\x00")
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := outputs[i]; got != tc.want {
+				t.Errorf("got %q, want %q\n\ngenerated:\n%s", got, tc.want, res.Generated)
+			}
+		})
+	}
+}
+
+// generateTypedErr runs Generate over a single typed template and
+// returns its error, for cases that must be rejected at generate time.
+func generateTypedErr(t *testing.T, src string) error {
+	t.Helper()
+	res := runCodegen(t, map[string]string{"page.html": typedDataRef + src},
+		typedSupport)
+	if res.Generated != "" {
+		t.Fatalf("expected generation to fail, got:\n%s", res.Generated)
+	}
+	return res.BuildErr
+}
+
+// runTypedErrCases checks that each case's source, with typedDataRef
+// prepended, fails to generate with an error mentioning want. Loading
+// the packages the templates use is most of what a run of Generate
+// costs, so every case is generated in one run.
+func runTypedErrCases(t *testing.T, cases map[string]struct{ src, want string }) {
+	t.Helper()
+	srcs := map[string]string{}
+	for name, tc := range cases {
+		srcs[name] = typedDataRef + tc.src
+	}
+	errs := generateErrs(t, "page.html", srcs)
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := errs[name]; err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("error %v does not mention %q", err, tc.want)
+			}
+		})
+	}
+}
+
+// generateErrs runs Generate once over srcs, each a template file of
+// its own, and returns the diagnostics of each by case name, with its
+// file named file in them as if it had been generated alone.
+func generateErrs(t *testing.T, file string, srcs map[string]string) map[string]error {
+	t.Helper()
+	names := make([]string, 0, len(srcs))
+	for name := range srcs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	files := map[string]string{}
+	byFile := map[string]string{}
+	for i, name := range names {
+		f := fmt.Sprintf("case%d.html", i)
+		files[f] = srcs[name]
+		byFile[f] = name
+	}
+	res := runCodegen(t, files, typedSupport)
+	if res.Generated != "" {
+		t.Fatalf("expected generation to fail, got:\n%s", res.Generated)
+	}
+	var diags Diagnostics
+	if !errors.As(res.BuildErr, &diags) {
+		t.Fatalf("expected diagnostics, got %v", res.BuildErr)
+	}
+	perCase := map[string]Diagnostics{}
+	for _, d := range diags {
+		f := filepath.Base(d.File)
+		name, ok := byFile[f]
+		if !ok {
+			t.Fatalf("diagnostic for no case: %s", d)
+		}
+		d.File = file
+		d.Message = strings.ReplaceAll(d.Message, f, file)
+		perCase[name] = append(perCase[name], d)
+	}
+	errs := map[string]error{}
+	for name, ds := range perCase {
+		errs[name] = ds
+	}
+	return errs
+}
+
+func TestTypedIfElse(t *testing.T) {
+	runTypedCases(t, []typedCase{
+		{name: "bool true", src: `{{if .Admin}}admin{{end}}`, data: `models.Page{Admin: true}`, want: "admin"},
+		{name: "bool false", src: `{{if .Admin}}admin{{else}}user{{end}}`, want: "user"},
+		{name: "string", src: `{{if .Title}}[{{.Title}}]{{else}}untitled{{end}}`, data: `models.Page{Title: "Hi"}`, want: "[Hi]"},
+		{name: "empty string", src: `{{if .Title}}[{{.Title}}]{{else}}untitled{{end}}`, want: "untitled"},
+		{name: "int", src: `{{if .Count}}some{{else}}none{{end}}`, data: `models.Page{Count: 3}`, want: "some"},
+		{name: "nil pointer", src: `{{if .User}}{{.User.Name}}{{else}}anon{{end}}`, want: "anon"},
+		{name: "pointer", src: `{{if .User}}{{.User.Name}}{{else}}anon{{end}}`, data: `models.Page{User: &models.User{Name: "Ann"}}`, want: "Ann"},
+		{name: "slice", src: `{{if .Tags}}tagged{{end}}`, data: `models.Page{Tags: []string{"a"}}`, want: "tagged"},
+		{name: "map", src: `{{if .Scores}}scored{{else}}unscored{{end}}`, want: "unscored"},
+		{name: "interface", src: `{{if .Meta}}meta{{else}}none{{end}}`, data: `models.Page{Meta: 1}`, want: "meta"},
+		{
+			name: "else if chain",
+			src:  `{{if .Admin}}admin{{else if .User}}user{{else if .Title}}titled{{else}}none{{end}}`,
+			data: `models.Page{Title: "t"}`,
+			want: "titled",
+		},
+		{
+			name: "nested",
+			src:  `{{if .User}}{{if .User.Admin}}boss{{else}}staff{{end}}{{end}}`,
+			data: `models.Page{User: &models.User{Admin: true}}`,
+			want: "boss",
+		},
+	})
+}
+
+// TestTypedIfNoReflection guards the point of typed conditions: the
+// generated render function must test truthiness natively.
+func TestTypedIfNoReflection(t *testing.T) {
+	res := runCodegen(t, map[string]string{
+		"page.html": typedDataRef + `{{if .Title}}a{{else if .User}}b{{end}}`,
+	}, typedSupport)
+	if res.BuildErr != nil {
+		t.Fatalf("build failed: %v\nstderr:\n%s\n\ngenerated:\n%s", res.BuildErr, res.BuildStderr, res.Generated)
+	}
+	typed := res.Generated[strings.Index(res.Generated, "func RenderPage"):]
+	if strings.Contains(typed, "templates.IsTrue") {
+		t.Errorf("typed render function uses reflection:\n%s", typed)
+	}
+	for _, want := range []string{"if len(data.Title) > 0 {", "} else if data.User != nil {"} {
+		if !strings.Contains(typed, want) {
+			t.Errorf("expected %q in:\n%s", want, typed)
+		}
+	}
+}
+
+func TestTypedIfUnknownField(t *testing.T) {
+	err := generateTypedErr(t, `{{if .Missing}}x{{end}}`)
+	if err == nil || !strings.Contains(err.Error(), "Missing") {
+		t.Fatalf("expected error naming the missing field, got %v", err)
+	}
+}
+
+func TestTypedRange(t *testing.T) {
+	tags := `models.Page{Title: "T", Tags: []string{"a", "b"}}`
+	runTypedCases(t, []typedCase{
+		{name: "slice index and elem", src: `{{range $i, $t := .Tags}}{{$i}}:{{$t}} {{end}}`, data: tags, want: "0:a 1:b "},
+		{name: "slice dot", src: `{{range .Tags}}({{.}}){{end}}`, data: tags, want: "(a)(b)"},
+		{name: "one variable is the element", src: `{{range $t := .Tags}}{{$t}}{{end}}`, data: tags, want: "ab"},
+		{name: "unused element", src: `{{range .Tags}}x{{end}}`, data: tags, want: "xx"},
+		{name: "slice else", src: `{{range .Tags}}x{{else}}empty{{end}}`, want: "empty"},
+		{
+			name: "struct elements",
+			src:  `{{range .Users}}{{.Name}},{{end}}`,
+			data: `models.Page{Users: []models.User{{Name: "a"}, {Name: "b"}}}`,
+			want: "a,b,",
+		},
+		{
+			name: "map in key order",
+			src:  `{{range $k, $v := .Scores}}{{$k}}={{$v}};{{end}}`,
+			data: `models.Page{Scores: map[string]int{"b": 2, "c": 3, "a": 1}}`,
+			want: "a=1;b=2;c=3;",
+		},
+		{
+			name: "map dot is the value",
+			src:  `{{range .Scores}}{{.}}{{end}}`,
+			data: `models.Page{Scores: map[string]int{"b": 2, "c": 3, "a": 1}}`,
+			want: "123",
+		},
+		{name: "map else", src: `{{range .Scores}}x{{else}}none{{end}}`, want: "none"},
+		{name: "int", src: `{{range .Count}}{{.}}{{end}}`, data: `models.Page{Count: 3}`, want: "012"},
+		{name: "int constant", src: `{{range 2}}{{.}}{{end}}`, want: "01"},
+		{name: "int else", src: `{{range .Count}}{{.}}{{else}}zero{{end}}`, want: "zero"},
+		{name: "channel", src: `{{range $i, $t := .TagChan}}{{$i}}{{$t}}{{end}}`, data: tags, want: "0a1b"},
+		{name: "channel else", src: `{{range .TagChan}}{{.}}{{else}}closed{{end}}`, want: "closed"},
+		{name: "iter.Seq", src: `{{range .TagSeq}}{{.}}{{end}}`, data: tags, want: "ab"},
+		{name: "iter.Seq else", src: `{{range .TagSeq}}{{.}}{{else}}none{{end}}`, want: "none"},
+		{name: "iter.Seq2", src: `{{range $i, $t := .TagSeq2}}{{$i}}{{$t}}{{end}}`, data: tags, want: "0a1b"},
+		{name: "iter.Seq2 one variable", src: `{{range $i := .TagSeq2}}{{$i}}{{end}}`, data: tags, want: "01"},
+		{name: "root variable", src: `{{range .Tags}}{{$.Title}}{{end}}`, data: tags, want: "TT"},
+		{name: "break", src: `{{range $i, $t := .Tags}}{{if $i}}{{break}}{{end}}{{$t}}{{end}}`, data: tags, want: "a"},
+		{name: "continue", src: `{{range $i, $t := .Tags}}{{if $i}}{{continue}}{{end}}{{$t}}{{end}}`, data: tags, want: "a"},
+		{
+			name: "nested",
+			src:  `{{range $u := .Users}}{{range $.Tags}}{{$u.Name}}{{.}} {{end}}{{end}}`,
+			data: `models.Page{Tags: []string{"a", "b"}, Users: []models.User{{Name: "x"}, {Name: "y"}}}`,
+			want: "xa xb ya yb ",
+		},
+	})
+}
+
+func TestTypedRangeErrors(t *testing.T) {
+	runTypedErrCases(t, map[string]struct{ src, want string }{
+		"string":           {`{{range .Title}}{{end}}`, "page.html:1:44: range can't iterate over string"},
+		"two vars for int": {`{{range $i, $v := .Count}}{{end}}`, "can't use int to iterate over more than one variable"},
+	})
+}
+
+// TestTypedVariables checks {{$x := ...}} declares a typed local, which
+// may be declared again, ends with its block, and keeps its type when
+// assigned, even from inside a {{range}} or {{with}}.
+func TestTypedVariables(t *testing.T) {
+	page := `models.Page{Title: "a\"b", Count: 2, Admin: true, Tags: []string{"x", "y", "z"}, User: &models.User{Name: "Ann"}}`
+	runTypedCases(t, []typedCase{
+		{name: "declare", src: `{{$x := .Title}}{{$x}}`, data: page, want: "a&#34;b"},
+		{name: "declare again", src: `{{$x := .Count}}{{$x := .Title}}{{$x}}`, data: page, want: "a&#34;b"},
+		{name: "block scope", src: `{{$x := 1}}{{if .Admin}}{{$x := "in"}}{{$x := printf "%s!" $x}}{{$x}}{{end}}{{$x}}`, data: page, want: "in!1"},
+		{name: "assign", src: `{{$x := .Count}}{{$x = 5}}{{$x}}`, data: page, want: "5"},
+		{name: "count in range", src: typedFuncsRef + `{{$n := 0}}{{range .Tags}}{{$n = sum $n 1}}{{end}}{{$n}}`, data: page, want: "3"},
+		{name: "widen", src: `{{$n := .Count}}{{$n = .Hits}}{{$n}}`, data: `models.Page{Hits: 7}`, want: "7"},
+		{name: "assign in with", src: `{{$s := "anon"}}{{with .User}}{{$s = .Name}}{{end}}[{{$s}}]`, data: page, want: "[Ann]"},
+		{name: "range body", src: `{{range .Tags}}{{$t := .}}{{$t := printf "%s." $t}}{{$t}}{{end}}`, data: page, want: "x.y.z."},
+		{name: "attribute", src: `<a title="{{$x := .Title}}{{$x}}">`, data: page, want: `<a title="a&#34;b">`},
+	})
+}
+
+func TestTypedVariableErrors(t *testing.T) {
+	runTypedErrCases(t, map[string]struct{ src, want string }{
+		"wrong type":    {`{{$x := .Count}}{{$x = .Title}}`, "page.html:1:54: can't assign .Title of type string to $x of type int"},
+		"narrowing":     {`{{$x := .Grade}}{{$x = .Count}}`, "can't assign .Count of type int to $x of type uint8"},
+		"range":         {`{{range $t := .Tags}}{{$t = "x"}}{{end}}`, "typed mode can only assign to variables declared with $t :="},
+		"parenthesized": {`{{print ($x := .Title)}}`, "page.html:1:38: argument 1 to print: typed mode does not yet support declaring variables inside parentheses"},
+	})
+}
+
+func TestTypedWith(t *testing.T) {
+	user := `models.Page{Title: "T", User: &models.User{Name: "Ann"}}`
+	runTypedCases(t, []typedCase{
+		{name: "pointer", src: `{{with .User}}{{.Name}}{{else}}anon{{end}}`, data: user, want: "Ann"},
+		{name: "nil pointer", src: `{{with .User}}{{.Name}}{{else}}anon{{end}}`, want: "anon"},
+		{name: "string", src: `{{with .Title}}[{{.}}]{{end}}`, data: user, want: "[T]"},
+		{name: "unused dot", src: `{{with .Title}}titled{{end}}`, data: user, want: "titled"},
+		{name: "declared variable", src: `{{with $u := .User}}{{$u.Name}}{{end}}`, data: user, want: "Ann"},
+		{name: "root variable", src: `{{with .User}}{{$.Title}}/{{.Name}}{{end}}`, data: user, want: "T/Ann"},
+		{
+			name: "else with",
+			src:  `{{with .User}}u{{else with .Title}}t:{{.}}{{else}}none{{end}}`,
+			data: `models.Page{Title: "T"}`,
+			want: "t:T",
+		},
+		{name: "else with falls through", src: `{{with .User}}u{{else with .Title}}t{{else}}none{{end}}`, want: "none"},
+		{
+			name: "nested nil pointer",
+			src:  `{{with .User}}{{with .Profile}}{{.Bio}}{{else}}no bio{{end}}{{end}}`,
+			data: user,
+			want: "no bio",
+		},
+		{
+			name: "inside range",
+			src:  `{{range .Users}}{{with .Profile}}{{.Bio}}{{else}}-{{end}}{{end}}`,
+			data: `models.Page{Users: []models.User{{Profile: &models.Profile{Bio: "b"}}, {}}}`,
+			want: "b-",
+		},
+	})
+}
+
+// TestTypedWithNarrowsDot checks the shape of the generated code: the
+// pipeline is evaluated once into a local that the body reads from.
+func TestTypedWithNarrowsDot(t *testing.T) {
+	res := runCodegen(t, map[string]string{
+		"page.html": typedDataRef + `{{with .User}}{{.Name}}{{else with .Title}}{{.}}{{end}}`,
+	}, typedSupport)
+	if res.BuildErr != nil {
+		t.Fatalf("build failed: %v\nstderr:\n%s\n\ngenerated:\n%s", res.BuildErr, res.BuildStderr, res.Generated)
+	}
+	typed := res.Generated[strings.Index(res.Generated, "func RenderPage"):]
+	for _, want := range []string{
+		"if with0 := data.User; with0 != nil {",
+		"templates.WriteEscapedString(writer, with0.Name)",
+		"} else if with1 := data.Title; len(with1) > 0 {",
+	} {
+		if !strings.Contains(typed, want) {
+			t.Errorf("expected %q in:\n%s", want, typed)
+		}
+	}
+}
+
+func TestTypedNilPointers(t *testing.T) {
+	noProfile := `models.Page{User: &models.User{Name: "Ann"}}`
+	runTypedCases(t, []typedCase{
+		{name: "nil field", src: `{{.User.Name}}`, want: "error: case0.html:1: nil pointer evaluating .User.Name"},
+		{name: "nil mid-chain", src: `{{.User.Profile.Bio}}`, data: noProfile, want: "error: case1.html:1: nil pointer evaluating .User.Profile.Bio"},
+		{name: "variable", src: `{{with $u := .User}}{{$u.Profile.Bio}}{{end}}`, data: noProfile, want: "error: case2.html:1: nil pointer evaluating $u.Profile.Bio"},
+		{name: "chain", src: "\n{{(.Owner).Profile.Bio}}", data: noProfile, want: "error: case3.html:2: nil pointer evaluating (.Owner).Profile.Bio"},
+		{
+			name: "set",
+			src:  `{{.User.Profile.Bio}}`,
+			data: `models.Page{User: &models.User{Profile: &models.Profile{Bio: "b"}}}`,
+			want: "b",
+		},
+	})
+}
+
+// TestTypedNilPointersAfterWith checks that a {{with}} proves its value
+// non-nil, so reads through it are not checked again.
+func TestTypedNilPointersAfterWith(t *testing.T) {
+	res := runCodegen(t, map[string]string{
+		"page.html": typedDataRef + `{{with .User}}{{.Name}}{{.Profile.Bio}}{{end}}`,
+	}, typedSupport)
+	if res.BuildErr != nil {
+		t.Fatalf("build failed: %v\nstderr:\n%s\n\ngenerated:\n%s", res.BuildErr, res.BuildStderr, res.Generated)
+	}
+	typed := res.Generated[strings.Index(res.Generated, "func RenderPage"):]
+	if strings.Contains(typed, "with0 == nil") {
+		t.Errorf("with-bound pointer checked again:\n%s", typed)
+	}
+	if !strings.Contains(typed, "if with0.Profile == nil {") {
+		t.Errorf("expected a check of with0.Profile in:\n%s", typed)
+	}
+}
+
+func TestTypedFuncCalls(t *testing.T) {
+	title := `models.Page{Title: "ann", Count: 2}`
+	runTypedCases(t, []typedCase{
+		{name: "stdlib function", src: typedFuncsRef + `{{upper .Title}}`, data: title, want: "ANN"},
+		{name: "package function", src: typedFuncsRef + `{{greet .Title}}`, data: title, want: "Hello, ann"},
+		{name: "closure through the map", src: typedFuncsRef + `{{shout .Title}}`, data: title, want: "ann!"},
+		{name: "constant arguments", src: typedFuncsRef + `{{repeat "ab" 2}}`, want: "abab"},
+		{name: "variadic", src: typedFuncsRef + `{{sum 1 .Count 3}}`, data: title, want: "6"},
+		{name: "nested call", src: typedFuncsRef + `{{greet (upper .Title)}}`, data: title, want: "Hello, ANN"},
+		{name: "in condition", src: typedFuncsRef + `{{if sum .Count}}yes{{end}}`, data: title, want: "yes"},
+		{name: "error result", src: typedFuncsRef + `{{check .Title}}`, data: title, want: "ann"},
+		{name: "error returned", src: typedFuncsRef + "\n{{check .Title}}", want: "error: case8.html:2: error calling check: empty"},
+	})
+}
+
+// TestTypedFuncCallsAreDirect checks that calls resolve to Go functions
+// at generate time rather than going through CallFunc.
+func TestTypedFuncCallsAreDirect(t *testing.T) {
+	res := runCodegen(t, map[string]string{
+		"page.html": typedDataRef + typedFuncsRef + `{{greet .Title}}{{upper .Title}}{{shout .Title}}`,
+	}, typedSupport)
+	if res.BuildErr != nil {
+		t.Fatalf("build failed: %v\nstderr:\n%s\n\ngenerated:\n%s", res.BuildErr, res.BuildStderr, res.Generated)
+	}
+	typed := res.Generated[strings.Index(res.Generated, "func RenderPage"):]
+	for _, want := range []string{"h.Greet(data.Title)", "strings.ToUpper(data.Title)", `h.FuncMap["shout"].(func(s string) string)(data.Title)`} {
+		if !strings.Contains(typed, want) {
+			t.Errorf("expected %q in:\n%s", want, typed)
+		}
+	}
+	if strings.Contains(typed, "CallFunc") {
+		t.Errorf("typed render function calls through reflection:\n%s", typed)
+	}
+}
+
+func TestTypedFuncCallErrors(t *testing.T) {
+	runTypedErrCases(t, map[string]struct{ src, want string }{
+		"wrong type":         {typedFuncsRef + `{{greet .Count}}`, "page.html:1:72: argument 1 to greet: have int, want string"},
+		"too many arguments": {typedFuncsRef + `{{greet .Title .Title}}`, "wrong number of args for greet: want 1 got 2"},
+		"too few arguments":  {typedFuncsRef + `{{repeat .Title}}`, "wrong number of args for repeat: want 2 got 1"},
+		"constant mismatch":  {typedFuncsRef + `{{greet 3}}`, "argument 1 to greet: have int, want string"},
+	})
+
+	// An unknown function fails parsing the whole set, so it can't
+	// share a run with the others.
+	t.Run("unknown function", func(t *testing.T) {
+		err := generateTypedErr(t, typedFuncsRef+`{{nope .Title}}`)
+		if want := `function "nope" not defined`; err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %v does not mention %q", err, want)
+		}
+	})
+}
+
+// TestTypedFuncsConflict checks a function provided by two @funcs
+// packages is reported the same way whatever the map order.
+func TestTypedFuncsConflict(t *testing.T) {
+	res := runCodegen(t, map[string]string{
+		"page.html": typedDataRef + typedFuncsRef + "{{/* @funcs x=testpkg/more */}}{{/* @funcs a=testpkg/more */}}",
+	}, map[string]string{
+		"models/models.go":   typedModels,
+		"helpers/helpers.go": typedHelpers,
+		"more/more.go":       strings.Replace(typedHelpers, "package helpers", "package more", 1),
+	})
+	if res.Generated != "" {
+		t.Fatalf("expected generation to fail, got:\n%s", res.Generated)
+	}
+	if want := `function "check" is provided by both testpkg/more and testpkg/helpers`; !strings.Contains(res.BuildErr.Error(), want) {
+		t.Errorf("error %q does not mention %q", res.BuildErr, want)
+	}
+}
+
+func TestTypedPipelines(t *testing.T) {
+	title := `models.Page{Title: "ann", Count: 2}`
+	runTypedCases(t, []typedCase{
+		{name: "single stage", src: typedFuncsRef + `{{.Title | upper}}`, data: title, want: "ANN"},
+		{name: "chained stages", src: typedFuncsRef + `{{.Title | upper | greet}}`, data: title, want: "Hello, ANN"},
+		{name: "builtin printf", src: `{{.Title | printf "%q"}}`, data: title, want: "&#34;ann&#34;"},
+		{name: "printf after function", src: typedFuncsRef + `{{.Title | upper | printf "%q"}}`, data: title, want: "&#34;ANN&#34;"},
+		{name: "into variadic", src: typedFuncsRef + `{{.Count | sum 1 2}}`, data: title, want: "5"},
+		{name: "into final argument", src: typedFuncsRef + `{{2 | repeat .Title}}`, data: title, want: "annann"},
+		{name: "error stage", src: typedFuncsRef + "\n\n{{.Title | check | upper}}", want: "error: case6.html:3: error calling check: empty"},
+		{name: "in condition", src: typedFuncsRef + `{{if .Title | upper}}yes{{end}}`, data: title, want: "yes"},
+	})
+}
+
+func TestTypedPrintf(t *testing.T) {
+	page := `models.Page{Title: "<ann>", Count: 3, Price: 1.5, Tags: []string{"a", "b"}, Level: 1}`
+	runTypedCases(t, []typedCase{
+		{name: "verbs", src: `{{printf "%d items at %.2f" .Count .Price}}`, data: page, want: "3 items at 1.50"},
+		{name: "escaped", src: `{{printf "%s & %q" .Title .Title}}`, data: page, want: "&lt;ann&gt; &amp; &#34;&lt;ann&gt;&#34;"},
+		{name: "piped", src: `{{.Count | printf "%03d"}}`, data: page, want: "003"},
+		{name: "argument index", src: `{{printf "%[2]s-%[1]d" .Count "x"}}`, data: page, want: "x-3"},
+		{name: "star width", src: `{{printf "[%*d]" 4 .Count}}`, data: page, want: "[   3]"},
+		{name: "percent", src: `{{printf "100%%"}}`, want: "100%"},
+		{name: "stringer", src: `{{printf "%s" .Level}}`, data: page, want: "high"},
+		{name: "slice", src: `{{printf "%s" .Tags}}`, data: page, want: "[a b]"},
+		{name: "as argument", src: typedFuncsRef + `{{printf "%s!" .Title | upper}}`, data: page, want: "&lt;ANN&gt;!"},
+	})
+}
+
+// TestTypedPrintfFormatsDirectly checks that printing printf with a
+// constant format skips the intermediate string.
+func TestTypedPrintfFormatsDirectly(t *testing.T) {
+	res := runCodegen(t, map[string]string{
+		"page.html": typedDataRef + `{{printf "%d items" .Count}}`,
+	}, typedSupport)
+	if res.BuildErr != nil {
+		t.Fatalf("build failed: %v\nstderr:\n%s\n\ngenerated:\n%s", res.BuildErr, res.BuildStderr, res.Generated)
+	}
+	typed := res.Generated[strings.Index(res.Generated, "func RenderPage"):]
+	if want := `fmt.Fprintf(templates.HTMLEscaper{Writer: writer}, "%d items", data.Count)`; !strings.Contains(typed, want) {
+		t.Errorf("expected %q in:\n%s", want, typed)
+	}
+	if strings.Contains(typed, "Sprintf") {
+		t.Errorf("printf built a string:\n%s", typed)
+	}
+}
+
+func TestTypedPrintfErrors(t *testing.T) {
+	runTypedErrCases(t, map[string]struct{ src, want string }{
+		"wrong type":       {`{{printf "%d" .Title}}`, "page.html:1:38: printf format %d has arg .Title of wrong type string"},
+		"later line":       {"\n\n{{printf \"%t\" .Count}}", "page.html:3:3: printf format %t has arg .Count of wrong type int"},
+		"missing arg":      {`{{printf "%s and %s" .Title}}`, "printf format %s reads arg #2, but call has 1 arg"},
+		"extra arg":        {`{{printf "%s" .Title .Count}}`, "printf call needs 1 arg but has 2 args"},
+		"unknown verb":     {`{{printf "%z" .Title}}`, "printf format %z has unknown verb z"},
+		"wrapping":         {`{{printf "%w" .Title}}`, "printf does not support error-wrapping directive %w"},
+		"no verb":          {`{{printf "50%" .Title}}`, "printf format % is missing a verb at the end"},
+		"bad index":        {`{{printf "%[3]s" .Title}}`, "printf format %[3] has invalid argument index [3]"},
+		"non-int star":     {`{{printf "%*d" .Title .Count}}`, "printf format %* uses non-int .Title as argument of *"},
+		"piped wrong type": {`{{.Title | printf "%d"}}`, "printf format %d has arg the piped value of wrong type string"},
+		"inside pipeline":  {typedFuncsRef + `{{printf "%d" .Title | upper}}`, "printf format %d has arg .Title of wrong type string"},
+		"element type":     {`{{printf "%d" .Tags}}`, "printf format %d has arg .Tags of wrong type []string"},
+	})
+}
+
+func TestTypedSprig(t *testing.T) {
+	page := `models.Page{Title: "Dr. Ann", Count: 2, Tags: []string{"a", "b"}}`
+	runTypedCases(t, []typedCase{
+		{name: "stdlib", src: `{{upper .Title}}`, data: page, want: "DR. ANN"},
+		{name: "piped", src: `{{.Title | trimPrefix "Dr. " | lower}}`, data: page, want: "ann"},
+		{name: "wrapper", src: `{{.Title | trunc 2}}`, data: page, want: "Dr"},
+		{name: "default set", src: `{{.Title | default "anon"}}`, data: page, want: "Dr. Ann"},
+		{name: "default empty", src: `{{.Title | default "anon"}}`, want: "anon"},
+		{name: "join", src: `{{.Tags | join ", "}}`, data: page, want: "a, b"},
+		{name: "predicate", src: `{{if .Title | hasPrefix "Dr."}}doctor{{end}}`, data: page, want: "doctor"},
+		{name: "variadic", src: `{{quote .Title .Count}}`, data: page, want: "&#34;Dr. Ann&#34; &#34;2&#34;"},
+		{name: "plural", src: `{{plural "item" "items" .Count}}`, data: page, want: "items"},
+		{name: "fail", src: `{{fail "boom"}}`, want: "error: case9.html:1: error calling fail: boom"},
+		{name: "funcs first", src: typedFuncsRef + `{{shout .Title | upper}}`, data: page, want: "DR. ANN!"},
+		{name: "default piped on", src: `{{.Title | default "x" | upper}}`, want: "X"},
+		{name: "default named type", src: `{{.Status | default "draft" | printf "%s!"}}`, want: "draft!"},
+		{name: "default number", src: `{{.Price | default 1.5 | printf "%.2f"}}`, want: "1.50"},
+		{name: "coalesce", src: `{{coalesce .Title "" "anon" | upper}}`, want: "ANON"},
+		{name: "ternary", src: `{{ternary "many" .Title (gt .Count 1) | upper}}`, data: page, want: "MANY"},
+	})
+}
+
+// TestTypedSprigIsDirect checks that sprig calls compile to the Go
+// functions themselves, without linking in sprig's FuncMap.
+func TestTypedSprigIsDirect(t *testing.T) {
+	res := runCodegen(t, map[string]string{
+		"page.html": typedDataRef + `{{upper .Title}}{{.Title | trunc 3}}`,
+	}, typedSupport)
+	if res.BuildErr != nil {
+		t.Fatalf("build failed: %v\nstderr:\n%s\n\ngenerated:\n%s", res.BuildErr, res.BuildStderr, res.Generated)
+	}
+	for _, want := range []string{"strings.ToUpper(data.Title)", "sprig.Trunc(3, data.Title)", `"github.com/jtarchie/comtmpl/templates/sprig"`} {
+		if !strings.Contains(res.Generated, want) {
+			t.Errorf("expected %q in:\n%s", want, res.Generated)
+		}
+	}
+	if strings.Contains(res.Generated, "slim-sprig") {
+		t.Errorf("generated code links all of sprig:\n%s", res.Generated)
+	}
+}
+
+func TestTypedSprigErrors(t *testing.T) {
+	runTypedErrCases(t, map[string]struct{ src, want string }{
+		"argument type": {`{{trunc .Title 3}}`, "argument 1 to trunc: have string, want int"},
+		"piped type":    {`{{.Count | upper}}`, "cannot pipe data.Count into upper: have int, want string"},
+		"arity":         {`{{replace "a" .Title}}`, "wrong number of args for replace: want 3 got 2"},
+		"untyped sprig": {`{{list 1 2}}`, `no Go signature for function "list"`},
+		"overflow":      {`{{ternary .Grade 300 .Admin}}`, "argument 2 to ternary: constant 300 overflows uint8"},
+	})
+}
+
+func TestTypedPipelineErrors(t *testing.T) {
+	runTypedErrCases(t, map[string]struct{ src, want string }{
+		"type mismatch":      {typedFuncsRef + "\n{{.Count | greet}}", "page.html:2:3: cannot pipe data.Count into greet: have int, want string"},
+		"mismatch mid-chain": {typedFuncsRef + "\n\n{{.Title | sum | upper}}", "page.html:3:"},
+		"non-function stage": {typedFuncsRef + "{{.Title | .Count}}", "Count has arguments but cannot be invoked as function"},
+		"too many arguments": {typedFuncsRef + "{{.Title | greet .Title}}", "wrong number of args for greet"},
+	})
+}
+
+// typedCardRef is the @data directive of card.html in template-call
+// tests.
+const typedCardRef = "{{/* @data testpkg/models.User */}}"
+
+func TestTypedTemplateCalls(t *testing.T) {
+	res, out := runDriver(t, map[string]string{
+		"page.html":  typedDataRef + `{{range .Users}}{{template "card.html" .}}{{end}}|{{template "title.html" .Title}}`,
+		"card.html":  typedCardRef + `[{{.Name}}]`,
+		"title.html": "{{/* @data testpkg/models.Title */}}<{{.}}>",
+	}, map[string]string{
+		"models/models.go":   typedModels + "\ntype Title = string\n",
+		"helpers/helpers.go": typedHelpers,
+	}, driverMain(`
+	page := models.Page{Title: "T", Users: []models.User{{Name: "a"}, {Name: "b"}}}
+	if err := testpkg.RenderPage(os.Stdout, page); err != nil {
+		panic(err)
+	}
+	fmt.Print("\x00")
+	if err := testpkg.Parsed.ExecuteTemplate(os.Stdout, "page.html", page); err != nil {
+		panic(err)
+	}
+`, "fmt", "os", "testpkg/models"))
+	typed := res.Generated[strings.Index(res.Generated, "func RenderPage"):]
+	for _, want := range []string{"RenderCard(writer, elem", "RenderTitle(writer, data.Title)"} {
+		if !strings.Contains(typed, want) {
+			t.Errorf("expected %q in:\n%s", want, typed)
+		}
+	}
+	if strings.Contains(typed, "ExecuteTemplate") {
+		t.Errorf("typed render function calls through the registry:\n%s", typed)
+	}
+
+	// html/template escapes the "<" that starts no tag.
+	if want := "[a][b]|&lt;T>\x00[a][b]|&lt;T>"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestTypedTemplateCallErrors(t *testing.T) {
+	cases := map[string]struct {
+		srcs map[string]string
+		want []string
+	}{
+		"type mismatch": {
+			srcs: map[string]string{
+				"page.html": typedDataRef + "\n\n{{template \"card.html\" .User}}",
+				"card.html": "\n" + typedCardRef + "{{.Name}}",
+			},
+			want: []string{"page.html:3:12:", "card.html:2", "*testpkg/models.User"},
+		},
+		"dynamic callee": {
+			srcs: map[string]string{
+				"page.html": typedDataRef + `{{template "card.html" .User}}`,
+				"card.html": `{{.Name}}`,
+			},
+			want: []string{"has no data type"},
+		},
+		"missing data": {
+			srcs: map[string]string{
+				"page.html": typedDataRef + `{{template "card.html"}}`,
+				"card.html": typedCardRef + `{{.Name}}`,
+			},
+			want: []string{"passes untyped nil"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			res := runCodegen(t, tc.srcs, typedSupport)
+			if res.Generated != "" {
+				t.Fatalf("expected generation to fail, got:\n%s", res.Generated)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(res.BuildErr.Error(), want) {
+					t.Errorf("error %q does not mention %q", res.BuildErr, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTypedComparisons(t *testing.T) {
+	page := `models.Page{Title: "ann", Count: 12, Price: 2.5, Status: "active", Hits: 12, Meta: "x"}`
+	runTypedCases(t, []typedCase{
+		{name: "eq string", src: `{{if eq .Title "ann"}}yes{{end}}`, data: page, want: "yes"},
+		{name: "eq named string", src: `{{if eq .Status "active"}}on{{else}}off{{end}}`, data: page, want: "on"},
+		{name: "named and plain string", src: `{{if eq .Status .Title}}same{{else}}differ{{end}}`, data: page, want: "differ"},
+		{name: "ne", src: `{{if ne .Count 3}}yes{{end}}`, data: page, want: "yes"},
+		{name: "gt", src: `{{if gt .Count 10}}big{{else}}small{{end}}`, data: page, want: "big"},
+		{name: "lt float", src: `{{if lt .Price 3.0}}cheap{{end}}`, data: page, want: "cheap"},
+		{name: "le ge", src: `{{if le .Count 12}}a{{end}}{{if ge .Count 13}}b{{end}}`, data: page, want: "a"},
+		{name: "mixed int sizes", src: `{{if eq .Count .Hits}}equal{{end}}`, data: page, want: "equal"},
+		{name: "negative and unsigned", src: `{{if lt .Count .Size}}a{{end}}{{if eq .Count .Size}}b{{end}}{{if gt .Size .Count}}c{{end}}`, data: `models.Page{Count: -1, Size: 7}`, want: "ac"},
+		{name: "signed and unsigned", src: `{{if eq .Size .Count}}a{{end}}{{if ne .Count .Size}}b{{end}}{{if le .Size .Count}}c{{end}}{{if ge .Count .Size}}d{{end}}`, data: `models.Page{Count: 7, Size: 7}`, want: "acd"},
+		{name: "larger unsigned", src: `{{if gt .Size .Count}}a{{end}}{{if lt .Count .Size}}b{{end}}`, data: `models.Page{Count: 7, Size: 1 << 63}`, want: "ab"},
+		{name: "constant out of range", src: `{{if eq .Grade 300}}a{{end}}{{if lt .Grade 300}}b{{end}}{{if ne .Size -1}}c{{end}}{{if gt .Size -1}}d{{end}}{{if lt .Ratio 1e300}}e{{end}}`, data: `models.Page{Grade: 255, Size: 7}`, want: "bcde"},
+		{name: "eq any of", src: `{{if eq .Count 1 2 12}}listed{{end}}`, data: page, want: "listed"},
+		{name: "interface", src: `{{if eq .Meta "x"}}x{{end}}`, data: page, want: "x"},
+		{name: "nil pointer", src: `{{if eq .User nil}}anon{{end}}`, want: "anon"},
+		{name: "printed", src: `{{eq .Count 12}} {{lt .Title "b"}}`, data: page, want: "true true"},
+		{name: "piped", src: `{{if .Count | eq 12}}yes{{end}}`, data: page, want: "yes"},
+	})
+}
+
+func TestTypedLogic(t *testing.T) {
+	page := `models.Page{Title: "ann", Admin: true}`
+	runTypedCases(t, []typedCase{
+		{name: "and mixed types", src: `{{if and .User .Admin}}yes{{else}}no{{end}}`, data: page, want: "no"},
+		{name: "or mixed types", src: `{{if or .User .Admin}}yes{{end}}`, data: page, want: "yes"},
+		{name: "not", src: `{{if not .User}}anon{{end}}`, want: "anon"},
+		{name: "nested", src: `{{if and (not .User) (or (eq .Title "x") .Admin)}}yes{{end}}`, data: page, want: "yes"},
+		{name: "or value", src: `{{or .Title "untitled"}}`, want: "untitled"},
+		{name: "and value", src: `{{and .Title "set"}}`, data: page, want: "set"},
+		{name: "not value", src: `{{not .Admin}}`, data: page, want: "false"},
+		{name: "or named constant", src: `{{or .Status "draft"}}`, want: "draft"},
+		{name: "or leading constant", src: `{{or "" .Status "draft"}}`, data: `models.Page{Status: "active"}`, want: "active"},
+		{name: "and leading constant", src: `{{and 0 .Status}}`, data: `models.Page{Status: "active"}`, want: "0"},
+		// check fails on an empty string, so it must not run when an
+		// earlier argument already decides the result.
+		{name: "and short-circuits", src: typedFuncsRef + `{{if and .Admin (check .Title)}}ran{{else}}skipped{{end}}`, want: "skipped"},
+		{name: "or short-circuits", src: typedFuncsRef + `{{if or .Admin (check .Title)}}yes{{end}}`, data: page, want: "yes"},
+		{name: "or value short-circuits", src: typedFuncsRef + `{{or .Title (check .Title)}}`, data: page, want: "ann"},
+		{name: "reached call errors", src: typedFuncsRef + `{{if or .Admin (check .Title)}}yes{{end}}`, want: "error: case13.html:1: error calling check: empty"},
+	})
+}
+
+// TestTypedComparisonsAreNative guards that comparisons and logic in
+// typed templates compile to Go operators instead of runtime calls.
+func TestTypedComparisonsAreNative(t *testing.T) {
+	res := runCodegen(t, map[string]string{
+		"page.html": typedDataRef + `{{if gt .Count 10}}a{{end}}{{if and (eq .Status "active") .Admin}}b{{end}}`,
+	}, typedSupport)
+	if res.BuildErr != nil {
+		t.Fatalf("build failed: %v\nstderr:\n%s\n\ngenerated:\n%s", res.BuildErr, res.BuildStderr, res.Generated)
+	}
+	typed := res.Generated[strings.Index(res.Generated, "func RenderPage"):]
+	for _, want := range []string{"if data.Count > 10 {", `if data.Status == "active" && data.Admin {`} {
+		if !strings.Contains(typed, want) {
+			t.Errorf("expected %q in:\n%s", want, typed)
+		}
+	}
+	if strings.Contains(typed, "CallFunc") {
+		t.Errorf("typed render function calls through reflection:\n%s", typed)
+	}
+}
+
+func TestTypedComparisonErrors(t *testing.T) {
+	runTypedErrCases(t, map[string]struct{ src, want string }{
+		"constant of wrong type": {"\n{{if eq .Count \"x\"}}{{end}}", "page.html:2:"},
+		"int and float":          {`{{if eq .Count .Price}}{{end}}`, "incompatible types for comparison"},
+		"ordered bools":          {`{{if lt .Admin true}}{{end}}`, "invalid type for comparison"},
+		"ordered pointers":       {`{{if lt .User .User}}{{end}}`, "invalid type for comparison"},
+		"incomparable":           {`{{if eq .Tags .Tags}}{{end}}`, "incomparable types"},
+		"too few arguments":      {`{{if lt .Count}}{{end}}`, "wrong number of args for lt"},
+		"mixed and value":        {`{{and .Title .Count}}`, "share one type"},
+		"constant of other type": {`{{or .Count "none"}}`, "share one type"},
+		"constant out of range":  {"\n{{or .Grade 300}}", "page.html:2:3: typed mode needs the arguments of or to share one type to use its value: constant 300 overflows uint8"},
+	})
+}
+
+func TestTypedPrinting(t *testing.T) {
+	runTypedCases(t, []typedCase{
+		{name: "escaped string", src: `{{.Title}}`, data: `models.Page{Title: "<b>\"a\" & 'b'+</b>"}`, want: "&lt;b&gt;&#34;a&#34; &amp; &#39;b&#39;&#43;&lt;/b&gt;"},
+		{name: "named string", src: `{{.Status}}`, data: `models.Page{Status: "a&b"}`, want: "a&amp;b"},
+		{name: "int", src: `{{.Count}}`, data: `models.Page{Count: -3}`, want: "-3"},
+		{name: "int64", src: `{{.Hits}}`, data: `models.Page{Hits: 1 << 40}`, want: "1099511627776"},
+		{name: "uint", src: `{{.Size}}`, data: `models.Page{Size: 7}`, want: "7"},
+		{name: "float", src: `{{.Price}}`, data: `models.Page{Price: 2.5}`, want: "2.5"},
+		{name: "float exponent", src: `{{.Price}}`, data: `models.Page{Price: 1e21}`, want: "1e&#43;21"},
+		{name: "float32", src: `{{.Ratio}}`, data: `models.Page{Ratio: 0.1}`, want: "0.1"},
+		{name: "bool", src: `{{.Admin}}`, data: `models.Page{Admin: true}`, want: "true"},
+		{name: "stringer", src: `{{.Level}}`, data: `models.Page{Level: 1}`, want: "high"},
+		{name: "trusted html", src: `{{.Raw}}`, data: `models.Page{Raw: "<i>x</i>"}`, want: "<i>x</i>"},
+		{name: "pointer", src: `{{.User}}`, data: `models.Page{User: &models.User{Name: "a"}}`, want: "{a false &lt;nil&gt;}"},
+		{name: "nil pointer", src: `{{.User}}`, want: "&lt;nil&gt;"},
+		{name: "interface", src: `{{.Meta}}`, data: `models.Page{Meta: "<x>"}`, want: "&lt;x&gt;"},
+		{name: "nil interface", src: `[{{.Meta}}]`, want: "[]"},
+		{name: "nil pointer in interface", src: `{{.Meta}}`, data: `models.Page{Meta: (*models.User)(nil)}`, want: "&lt;nil&gt;"},
+		{name: "slice", src: `{{.Tags}}`, data: `models.Page{Tags: []string{"a", "b"}}`, want: "[a b]"},
+	})
+}
+
+// TestTypedContextualEscaping checks that values printed outside HTML
+// text are escaped as html/template escapes them there, whose output
+// each case expects.
+func TestTypedContextualEscaping(t *testing.T) {
+	runTypedCases(t, []typedCase{
+		{name: "href unsafe scheme", src: `<a href="{{.Title}}">`, data: `models.Page{Title: "javascript:alert(1)"}`, want: `<a href="#ZgotmplZ">`},
+		{name: "href normalized", src: `<a href="{{.Title}}">`, data: `models.Page{Title: "http://a b/?q=<x>"}`, want: `<a href="http://a%20b/?q=%3cx%3e">`},
+		{name: "href query", src: `<a href="/s?q={{.Title}}&n={{.Count}}">`, data: `models.Page{Title: "a&b c/d", Count: 2}`, want: `<a href="/s?q=a%26b%20c%2fd&n=2">`},
+		{name: "script value", src: `<script>var t = {{.Title}}, n = {{.Count}};</script>`, data: `models.Page{Title: "</script>\"'", Count: 3}`, want: `<script>var t = "\u003c/script\u003e\"'", n =  3 ;</script>`},
+		{name: "script string", src: `<script>var t = "{{.Title}}";</script>`, data: `models.Page{Title: "\"</script>\n"}`, want: `<script>var t = "\u0022\u003c\/script\u003e\n";</script>`},
+		{name: "onclick value", src: `<button onclick="f({{.Title}})">`, data: `models.Page{Title: "a\"b'<"}`, want: `<button onclick="f(&#34;a\&#34;b&#39;\u003c&#34;)">`},
+		{name: "onclick string", src: `<button onclick='alert("{{.Title}}")'>`, data: `models.Page{Title: "a\"b'<"}`, want: `<button onclick='alert("a\u0022b\u0027\u003c")'>`},
+		{name: "style value", src: `<p style="color: {{.Title}}">`, data: `models.Page{Title: "red"}`, want: `<p style="color: red">`},
+		{name: "style unsafe value", src: `<p style="color: {{.Title}}">`, data: `models.Page{Title: "expression(alert(1))"}`, want: `<p style="color: ZgotmplZ">`},
+		{name: "style url", src: `<p style="background: url('{{.Title}}')">`, data: `models.Page{Title: "a b'"}`, want: `<p style="background: url('a%20b%27')">`},
+		{name: "unquoted attribute", src: `<p title={{.Title}}>`, data: `models.Page{Title: "a b=c"}`, want: `<p title=a&#32;b&#61;c>`},
+		{name: "empty unquoted attribute", src: `<p title={{.Title}}>`, want: `<p title=ZgotmplZ>`},
+		{name: "textarea", src: `<textarea>{{.Title}}</textarea>`, data: `models.Page{Title: "</textarea>&"}`, want: `<textarea>&lt;/textarea&gt;&amp;</textarea>`},
+		{name: "comment", src: `a<!-- {{.Title}} -->b`, data: `models.Page{Title: "x"}`, want: `ab`},
+		{name: "trusted html in attribute", src: `<p title="{{.Raw}}">`, data: `models.Page{Raw: "<b>x</b>"}`, want: `<p title="x">`},
+	})
+}
+
+// TestTypedContextualEscapingErrors checks that generation fails where
+// typed code can't escape as html/template would, or html/template
+// refuses to.
+func TestTypedContextualEscapingErrors(t *testing.T) {
+	runTypedErrCases(t, map[string]struct{ src, want string }{
+		"attribute name":    {"\n<img {{.Title}}>", "page.html:2:8: typed mode can't print {{.Title}} in an attribute name"},
+		"template in tag":   {`{{define "x"}}y{{end}}<a title="{{template "x"}}">`, `typed mode can only call "x" in HTML text`},
+		"ambiguous url":     {"\n<a href=\"{{if .Count}}/x?{{else}}/y{{end}}{{.Title}}\">", "page.html:2:45: html/template: {{.Title}} appears in an ambiguous context within a URL"},
+		"non-text end":      {`<a href="{{.Title}}`, "html/template: page.html ends in a non-text context"},
+		"predefined escape": {`{{.Title | html}}`, "remove html from {{.Title | html}}"},
+	})
+}
+
+// TestTypedPrintingAllocs renders a typed template into a preallocated
+// buffer, and into a writer without spare capacity to format numbers
+// in, and requires that printing strings, numbers, booleans and
+// Stringers allocates nothing. Cost has a Format method that isn't
+// fmt.Formatter, so it prints as a plain number too.
+func TestTypedPrintingAllocs(t *testing.T) {
+	res, out := runDriver(t, map[string]string{
+		"page.html": typedDataRef + `<p>{{.Title}} {{.Count}} {{.Hits}} {{.Size}} {{.Price}} {{.Ratio}} {{.Admin}} {{.Level}} {{.Status}} {{.Cost}}</p>`,
+	}, typedSupport, driverMain(`
+	page := models.Page{Title: "a & b", Count: 42, Hits: -7, Size: 3, Price: 1e21, Ratio: 0.5, Admin: true, Level: 1, Status: "ok", Cost: 1250}
+	var buf bytes.Buffer
+	buf.Grow(1024)
+	allocs := testing.AllocsPerRun(100, func() {
+		buf.Reset()
+		if err := testpkg.RenderPage(&buf, page); err != nil {
+			panic(err)
+		}
+	})
+	discardAllocs := testing.AllocsPerRun(100, func() {
+		if err := testpkg.RenderPage(io.Discard, page); err != nil {
+			panic(err)
+		}
+	})
+	fmt.Printf("%s\n%v %v", buf.String(), allocs, discardAllocs)
+`, "bytes", "fmt", "io", "testing", "testpkg/models"))
+	typed := res.Generated[strings.Index(res.Generated, "func RenderPage"):]
+	if strings.Contains(typed, "fmt.Fprint") {
+		t.Errorf("typed render function prints through fmt:\n%s", typed)
+	}
+
+	want := "<p>a &amp; b 42 -7 3 1e&#43;21 0.5 true high ok 1250</p>\n0 0"
+	if out != want {
+		t.Errorf("got %q, want %q\n\ngenerated:\n%s", out, want, typed)
+	}
+}
+
+func TestTypedMethodCalls(t *testing.T) {
+	page := `models.Page{Cost: 1250, User: &models.User{Name: "ann"}}`
+	runTypedCases(t, []typedCase{
+		{name: "constant argument", src: `{{.Cost.Format "USD"}}`, data: page, want: "12.50 USD"},
+		{name: "piped argument", src: `{{"EUR" | .Cost.Format}}`, data: page, want: "12.50 EUR"},
+		{name: "error result", src: `{{(.Cost.Convert 2.0).Format "USD"}}`, data: page, want: "25.00 USD"},
+		{name: "error returned", src: "\n{{.Cost.Convert -1.0}}", data: page, want: "error: case3.html:2: error calling Convert: bad rate -1"},
+		{name: "error result mid-chain", src: `{{.Owner.Name}}`, data: page, want: "ann"},
+		{name: "error mid-chain returned", src: `{{.Owner.Name}}`, want: "error: case5.html:1: error calling Owner: no owner"},
+		{name: "on variable", src: `{{with $c := .Cost}}{{$c.Format "GBP"}}{{end}}`, data: page, want: "12.50 GBP"},
+		{name: "in condition", src: `{{if eq (.Cost.Format "USD") "12.50 USD"}}match{{end}}`, data: page, want: "match"},
+	})
+}
+
+func TestTypedMethodCallErrors(t *testing.T) {
+	runTypedErrCases(t, map[string]struct{ src, want string }{
+		"wrong argument type": {"\n{{.Cost.Format 1}}", "argument 1 to Format"},
+		"missing argument":    {`{{.Cost.Format}}`, "wrong number of args for Format: want 1 got 0"},
+		"arguments to field":  {`{{.Title "x"}}`, "Title has arguments but cannot be invoked as function"},
+		"piped wrong type":    {`{{.Count | .Cost.Format}}`, "cannot pipe data.Count into Format"},
+		"arguments mid-chain": {`{{.Cost.Convert.Format "USD"}}`, "wrong number of args for Convert"},
+	})
+}
+
+func TestTypedGenericData(t *testing.T) {
+	res, out := runDriver(t, map[string]string{
+		"box.html":  "{{/* @data testpkg/models.Box[testpkg/models.User] */}}{{.Item.Name}}:{{range .Items}}{{.Name}}{{end}}",
+		"pair.html": "{{/* @import m=testpkg/models */}}{{/* @data m.Pair[string, *m.User] */}}{{.Key}}={{.Val.Name}}",
+	}, typedSupport, driverMain(`
+	box := models.Box[models.User]{Item: models.User{Name: "a"}, Items: []models.User{{Name: "b"}, {Name: "c"}}}
+	pair := models.Pair[string, *models.User]{Key: "k", Val: &models.User{Name: "v"}}
+	if err := testpkg.RenderBox(os.Stdout, box); err != nil {
+		panic(err)
+	}
+	fmt.Print(" ")
+	if err := testpkg.RenderPair(os.Stdout, pair); err != nil {
+		panic(err)
+	}
+	fmt.Print(" ")
+	if err := testpkg.Parsed.ExecuteTemplate(os.Stdout, "box.html", box); err != nil {
+		panic(err)
+	}
+`, "fmt", "os", "testpkg/models"))
+	for _, want := range []string{
+		"func RenderBox(writer io.Writer, data models.Box[models.User]) error",
+		"func RenderPair(writer io.Writer, data models.Pair[string, *models.User]) error",
+	} {
+		if !strings.Contains(res.Generated, want) {
+			t.Errorf("expected %q in:\n%s", want, res.Generated)
+		}
+	}
+
+	if want := "a:bc k=v a:bc"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestTypedGenericDataErrors(t *testing.T) {
+	cases := map[string]struct {
+		ref  string
+		want string
+	}{
+		"missing type arguments": {"testpkg/models.Box", "needs 1 type arguments"},
+		"not generic":            {"testpkg/models.User[int]", "is not generic"},
+		"unsatisfied constraint": {"testpkg/models.Pair[[]string, int]", "does not satisfy comparable"},
+		"unknown argument":       {"testpkg/models.Box[testpkg/models.Nope]", "Nope"},
+		"malformed":              {"testpkg/models.Box[int", "unterminated"},
+	}
+	srcs := map[string]string{}
+	for name, tc := range cases {
+		srcs[name] = "{{/* @data " + tc.ref + " */}}x"
+	}
+	errs := generateErrs(t, "page.html", srcs)
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := errs[name]; err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("error %v does not mention %q", err, tc.want)
+			}
+		})
+	}
+}
+
+// typedSourceTypes declares template data types in the generated
+// package itself, with //comtmpl:template comments.
+const typedSourceTypes = `package testpkg
+
+//comtmpl:template index.html footer.html
+type IndexData struct {
+	Title string
+	Year  int
+	Card  Card
+}
+
+type (
+	Other struct{}
+
+	//comtmpl:template card.html
+	Card struct {
+		Name string
+	}
+)
+`
+
+func TestTypedSourceDeclaredTypes(t *testing.T) {
+	res, out := runDriver(t, map[string]string{
+		"index.html":  `<h1>{{.Title}}</h1>{{template "card.html" .Card}}{{template "footer.html" .}}`,
+		"card.html":   `[{{.Name}}]`,
+		"footer.html": `{{.Year}}`,
+		"plain.html":  `{{.}}`,
+	}, map[string]string{
+		"types.go": typedSourceTypes,
+	}, driverMain(`
+	data := testpkg.IndexData{Title: "Hi", Year: 2024, Card: testpkg.Card{Name: "ann"}}
+	if err := testpkg.RenderIndex(os.Stdout, data); err != nil {
+		panic(err)
+	}
+`, "os"))
+	for _, want := range []string{
+		"func RenderIndex(writer io.Writer, data IndexData) error",
+		"func RenderCard(writer io.Writer, data Card) error",
+		"func RenderFooter(writer io.Writer, data IndexData) error",
+	} {
+		if !strings.Contains(res.Generated, want) {
+			t.Errorf("expected %q in:\n%s", want, res.Generated)
+		}
+	}
+	if strings.Contains(res.Generated, "RenderPlain") {
+		t.Errorf("template without a declared type was compiled as typed:\n%s", res.Generated)
+	}
+
+	if want := "<h1>Hi</h1>[ann]2024"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+// TestTypedSourceDeclaredTypesRegenerate generates into a package
+// whose types changed since the last run, so the file generated then,
+// and code using it, no longer type-check. Types are found in the
+// output's package without a Dir.
+func TestTypedSourceDeclaredTypesRegenerate(t *testing.T) {
+	tmp := t.TempDir()
+	views := filepath.Join(tmp, "views")
+	files := map[string]string{
+		"go.mod":          "module testpkg\n\ngo 1.24\n",
+		"views/types.go":  "package views\n\n//comtmpl:template page.html\ntype PageData struct{ Title string }\n",
+		"views/use.go":    "package views\n\nvar _ = RenderPage\n",
+		"views/gen.go":    "package views\n\nfunc RenderPage(data PageData) string { return data.Removed }\n",
+		"views/page.html": "{{.Title}}",
+	}
+	for name, content := range files {
+		path := filepath.Join(tmp, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := Generate(GenOptions{
+		Filenames:   []string{filepath.Join(views, "page.html")},
+		PackageName: "views",
+		Output:      &buf,
+		OutputPath:  filepath.Join(views, "gen.go"),
+	})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if want := "func RenderPage(writer io.Writer, data PageData) error"; !strings.Contains(buf.String(), want) {
+		t.Errorf("expected %q in:\n%s", want, buf.String())
+	}
+}
+
+func TestTypedSourceDeclaredTypeErrors(t *testing.T) {
+	cases := map[string]struct {
+		srcs  map[string]string
+		types string
+		want  string
+	}{
+		"declared twice": {
+			srcs:  map[string]string{"card.html": "{{/* @data testpkg/models.User */}}{{.Name}}"},
+			types: typedSourceTypes,
+			want:  "declared both by directives and by //comtmpl:template at types.go:13",
+		},
+		"same template on two types": {
+			srcs:  map[string]string{"card.html": "{{.Name}}"},
+			types: "package testpkg\n\n//comtmpl:template card.html\ntype A struct{}\n\n//comtmpl:template card.html\ntype B struct{}\n",
+			want:  "types.go:6: template card.html is already declared as A at types.go:3",
+		},
+		"generic type": {
+			srcs:  map[string]string{"card.html": "{{.Name}}"},
+			types: "package testpkg\n\n//comtmpl:template card.html\ntype Box[T any] struct{}\n",
+			want:  "use @data with type arguments",
+		},
+		"call mismatch": {
+			srcs:  map[string]string{"index.html": `{{template "card.html" .Title}}`, "card.html": "{{.Name}}"},
+			types: typedSourceTypes,
+			want:  "passes string, but types.go:13 declares data type testpkg.Card",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			support := map[string]string{"types.go": tc.types}
+			for path, content := range typedSupport {
+				support[path] = content
+			}
+			res := runCodegen(t, tc.srcs, support)
+			if res.Generated != "" {
+				t.Fatalf("expected generation to fail, got:\n%s", res.Generated)
+			}
+			if !strings.Contains(res.BuildErr.Error(), tc.want) {
+				t.Fatalf("error %q does not mention %q", res.BuildErr, tc.want)
+			}
+		})
+	}
+}
+
+// typedProfile is a template typed by @param directives alone.
+const typedProfile = `{{/* @param user testpkg/models.User */}}
+{{/* @import m=testpkg/models */}}{{/* @param $viewer *m.User */}}
+{{$user.Name}}{{if $viewer}} seen by {{$viewer.Name}}{{end}}{{with $user.Profile}} ({{.Bio}}){{end}}`
+
+func TestTypedParams(t *testing.T) {
+	res, out := runDriver(t, map[string]string{"profile.html": typedProfile}, typedSupport, driverMain(`
+	user := models.User{Name: "ann", Profile: &models.Profile{Bio: "hi"}}
+	if err := testpkg.RenderProfile(os.Stdout, user, &models.User{Name: "bob"}); err != nil {
+		panic(err)
+	}
+	fmt.Print("|")
+	if err := testpkg.Parsed.ExecuteTemplate(os.Stdout, "profile.html", map[string]any{"user": user, "viewer": (*models.User)(nil)}); err != nil {
+		panic(err)
+	}
+	fmt.Print("|")
+	err := testpkg.Parsed.ExecuteTemplate(os.Stdout, "profile.html", map[string]any{"user": &user})
+	fmt.Print(err)
+`, "fmt", "os", "testpkg/models"))
+	if want := "func RenderProfile(writer io.Writer, user models.User, viewer *models.User) error"; !strings.Contains(res.Generated, want) {
+		t.Errorf("expected %q in:\n%s", want, res.Generated)
+	}
+
+	want := "\n\nann seen by bob (hi)|\n\nann (hi)|profile.html: parameter user: expected models.User, got *models.User"
+	if out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+// TestTypedParamTypeConstructors checks each * and [] of a @param type
+// applies to the type after it, and that range follows pointers.
+func TestTypedParamTypeConstructors(t *testing.T) {
+	srcs := map[string]string{"users.html": `{{/* @param users *[]testpkg/models.User */}}{{/* @param ptrs []*testpkg/models.User */}}{{range $users}}{{.Name}}{{end}}|{{range $ptrs}}{{.Name}}{{end}}`}
+	res, out := runDriver(t, srcs, typedSupport, driverMain(`
+	users := []models.User{{Name: "a"}, {Name: "b"}}
+	if err := testpkg.RenderUsers(os.Stdout, &users, []*models.User{&users[1]}); err != nil {
+		panic(err)
+	}
+	fmt.Print("|", testpkg.RenderUsers(os.Stdout, nil, nil))
+`, "fmt", "os", "testpkg/models"))
+	if want := "func RenderUsers(writer io.Writer, users *[]models.User, ptrs []*models.User) error"; !strings.Contains(res.Generated, want) {
+		t.Errorf("expected %q in:\n%s", want, res.Generated)
+	}
+	if want := "ab|b|users.html:1: range can't iterate over <nil>"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestTypedParamErrors(t *testing.T) {
+	cases := map[string]struct {
+		src  string
+		want string
+	}{
+		"position after declarations": {"{{/* @param user testpkg/models.User */}}\n\n{{$user.Missing}}", "profile.html:3:3:"},
+		"position on the first line":  {"{{/* @param user testpkg/models.User */}}{{$user.Missing}}", "profile.html:1:44:"},
+		"position in a define":        {"{{/* @param user testpkg/models.User */}}{{define \"x\"}}{{/* @data testpkg/models.User */}}{{.Missing}}{{end}}", "profile.html:1:93:"},
+		"untyped dot":                 {"{{/* @param user testpkg/models.User */}}{{.Name}}", "dot has no type"},
+		"reserved name":               {"{{/* @param data testpkg/models.User */}}{{$data.Name}}", "@param data is reserved"},
+		"predeclared name":            {"{{/* @param len testpkg/models.User */}}{{$len.Name}}", "@param len is reserved"},
+		"hides an import":             {"{{/* @param fmt testpkg/models.User */}}{{$fmt.Name}}", `hides the generated code's import of "fmt"`},
+		"unknown type":                {"{{/* @param user testpkg/models.Nope */}}", "@param user"},
+		"malformed type":              {"{{/* @param user *testpkg/models.User] */}}", `@param user "*testpkg/models.User]": unexpected "]" after the type`},
+	}
+	srcs := map[string]string{}
+	for name, tc := range cases {
+		srcs[name] = tc.src
+	}
+	errs := generateErrs(t, "profile.html", srcs)
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := errs[name]; err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("error %v does not mention %q", err, tc.want)
+			}
+		})
+	}
+
+	t.Run("called as template", func(t *testing.T) {
+		res := runCodegen(t, map[string]string{
+			"page.html":    typedDataRef + `{{template "profile.html" .User}}`,
+			"profile.html": typedProfile,
+		}, typedSupport)
+		if res.Generated != "" {
+			t.Fatalf("expected generation to fail, got:\n%s", res.Generated)
+		}
+		if want := "profile.html takes @param parameters"; !strings.Contains(res.BuildErr.Error(), want) {
+			t.Fatalf("error %q does not mention %q", res.BuildErr, want)
+		}
+	})
+}
+
+const typedPartials = `{{define "row"}}{{/* @data testpkg/models.User */}}<{{.Name}}>{{end}}
+{{define "heading"}}
+	{{- /* @data string */ -}}
+	<h1>{{.}}</h1>
+{{- end}}`
+
+func TestTypedDefines(t *testing.T) {
+	res, out := runDriver(t, map[string]string{
+		"page.html":     typedDataRef + `{{template "heading" .Title}}{{range .Users}}{{template "row" .}}{{end}}`,
+		"partials.html": typedPartials,
+	}, typedSupport, driverMain(`
+	page := models.Page{Title: "T", Users: []models.User{{Name: "a"}, {Name: "b"}}}
+	if err := testpkg.RenderPage(os.Stdout, page); err != nil {
+		panic(err)
+	}
+	fmt.Print("\x00")
+	if err := testpkg.RenderRow(os.Stdout, models.User{Name: "c"}); err != nil {
+		panic(err)
+	}
+	fmt.Print("\x00")
+	if err := testpkg.Parsed.ExecuteTemplate(os.Stdout, "heading", "<d>"); err != nil {
+		panic(err)
+	}
+`, "fmt", "os", "testpkg/models"))
+	typed := res.Generated[strings.Index(res.Generated, "func RenderPage"):]
+	for _, want := range []string{"RenderHeading(writer, data.Title)", "RenderRow(writer, elem"} {
+		if !strings.Contains(typed, want) {
+			t.Errorf("expected %q in:\n%s", want, typed)
+		}
+	}
+
+	if want := "<h1>T</h1>&lt;a>&lt;b>\x00&lt;c>\x00<h1>&lt;d&gt;</h1>"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestTypedDefineErrors(t *testing.T) {
+	cases := map[string]struct {
+		srcs map[string]string
+		want []string
+	}{
+		"type mismatch": {
+			srcs: map[string]string{
+				"page.html":     typedDataRef + `{{template "row" .Title}}`,
+				"partials.html": typedPartials,
+			},
+			want: []string{`{{template "row"}} passes string`, "partials.html:1", "testpkg/models.User"},
+		},
+		"error in body": {
+			srcs: map[string]string{
+				"partials.html": "\n{{define \"row\"}}{{/* @data testpkg/models.User */}}\n{{.Missing}}{{end}}",
+			},
+			want: []string{"partials.html:3:3:", "no field"},
+		},
+		"untyped define": {
+			srcs: map[string]string{
+				"page.html":     typedDataRef + `{{template "plain" .}}`,
+				"partials.html": `{{define "plain"}}x{{end}}`,
+			},
+			want: []string{"plain is neither a template file nor a {{define}} with @data"},
+		},
+		"function name clash": {
+			srcs: map[string]string{
+				"page.html":     typedDataRef + `{{.Title}}`,
+				"partials.html": `{{define "page"}}{{/* @data testpkg/models.Page */}}{{.Title}}{{end}}`,
+			},
+			want: []string{"both compile to RenderPage"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			res := runCodegen(t, tc.srcs, typedSupport)
+			if res.Generated != "" {
+				t.Fatalf("expected generation to fail, got:\n%s", res.Generated)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(res.BuildErr.Error(), want) {
+					t.Errorf("error %q does not mention %q", res.BuildErr, want)
+				}
+			}
+		})
+	}
+}
+
+// TestTypedFallbackLoopControl checks {{break}} and {{continue}} in a
+// node that falls back to dynamic code still leave or advance the typed
+// loop around it, from inside a type switch too.
+func TestTypedFallbackLoopControl(t *testing.T) {
+	src := typedBlocksRef + `{{range .Blocks}}{{with asType . "models.TextBlock"}}
+{{- if contains "b" (toJson .Text)}}{{continue}}{{end}}
+{{- if contains "d" (toJson .Text)}}{{break}}{{end}}
+{{- .Text}}{{end}}{{end}}`
+	_, out := runDriverWith(t, GenOptions{Fallback: true}, map[string]string{"page.html": src}, typedSupport, driverMain(`
+	testpkg.Parsed.Funcs(template.FuncMap{
+		"contains": func(substr, s string) bool { return strings.Contains(s, substr) },
+		"toJson": func(v any) string {
+			b, _ := json.Marshal(v)
+			return string(b)
+		},
+	})
+	var page models.Page
+	for _, text := range []string{"a", "b", "c", "d", "e"} {
+		page.Blocks = append(page.Blocks, models.TextBlock{Text: text})
+	}
+	if err := testpkg.RenderPage(os.Stdout, page); err != nil {
+		panic(err)
+	}
+`, "encoding/json", "os", "strings", "text/template", "testpkg/models"))
+	if want := "ac"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestTypedFallback(t *testing.T) {
+	// toJson is a sprig function typed mode has no signature for.
+	src := typedDataRef + `<{{.Title}}>
+{{range .Users}}[{{toJson .Name}}]{{end}}
+{{with $t := .Title}}{{toJson $t}}{{end}}
+{{$x := toJson .Title}}({{$x}})
+<a href="/{{toJson .Title}}">
+{{$y := .Title}}{{if .Title}}{{$y = toJson .Title}}{{end}}[{{$y}}]`
+	srcs := map[string]string{"page.html": src}
+
+	var warnings bytes.Buffer
+	res, out := runDriverWith(t, GenOptions{Fallback: true, Warnings: &warnings}, srcs, typedSupport, driverMain(`
+	testpkg.Parsed.Funcs(template.FuncMap{"toJson": func(v any) string {
+		var b strings.Builder
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		_ = enc.Encode(v)
+		return strings.TrimSpace(b.String())
+	}})
+	page := models.Page{Title: "<t>", Users: []models.User{{Name: "a"}, {Name: "b"}}}
+	if err := testpkg.RenderPage(os.Stdout, page); err != nil {
+		panic(err)
+	}
+`, "encoding/json", "os", "strings", "text/template", "testpkg/models"))
+
+	got := strings.Split(strings.TrimSpace(warnings.String()), "\n")
+	if len(got) != 5 || !strings.Contains(got[0], "page.html:2:20: warning:") || !strings.Contains(got[1], "page.html:3:24: warning:") ||
+		!strings.Contains(got[2], "page.html:4:") || !strings.Contains(got[3], "page.html:5:") || !strings.Contains(got[4], "page.html:6:") {
+		t.Errorf("expected a warning for each toJson call, got:\n%s", warnings.String())
+	}
+	typed := res.Generated[strings.Index(res.Generated, "func RenderPage"):]
+	for _, want := range []string{"range data.Users {", "data := any(elem", "var_t := any(with", "var local", "WriteEscaped(writer, local",
+		"var_y := any(local", "; ok {",
+		"templates.NormalizeURL, templates.EscapeAttr)"} {
+		if !strings.Contains(typed, want) {
+			t.Errorf("expected %q in:\n%s", want, typed)
+		}
+	}
+
+	// Fallback output is escaped like the typed output around it, and
+	// as html/template escapes it where it is.
+	if want := "&lt;&lt;t&gt;>\n[&#34;a&#34;][&#34;b&#34;]\n&#34;&lt;t&gt;&#34;\n(&#34;&lt;t&gt;&#34;)\n<a href=\"/%22%3ct%3e%22\">\n[&#34;&lt;t&gt;&#34;]"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		res := runCodegen(t, srcs, typedSupport)
+		if res.Generated != "" {
+			t.Fatalf("expected generation to fail without fallback, got:\n%s", res.Generated)
+		}
+	})
+}
+
+func TestTypedDiagnostics(t *testing.T) {
+	res := runCodegen(t, map[string]string{
+		"page.html":   typedDataRef + "\n{{.Missing}}\n{{if .Nope}}x{{end}}{{.Title}}",
+		"card.html":   typedCardRef + "\n\n{{.Bad}}",
+		"broken.html": "{{/* @data */}}",
+	}, typedSupport)
+	if res.Generated != "" {
+		t.Fatalf("expected generation to fail, got:\n%s", res.Generated)
+	}
+	var diags Diagnostics
+	if !errors.As(res.BuildErr, &diags) {
+		t.Fatalf("expected Diagnostics, got %T: %v", res.BuildErr, res.BuildErr)
+	}
+
+	var got []string
+	for _, d := range diags {
+		got = append(got, fmt.Sprintf("%s:%d", filepath.Base(d.File), d.Line))
+	}
+	want := []string{"broken.html:0", "card.html:3", "page.html:2", "page.html:3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("diagnostics at %v, want %v:\n%v", got, want, diags)
+	}
+	if d := diags[2]; d.Col != 3 || !strings.Contains(d.Message, `"Missing"`) || strings.Contains(d.Message, "(line") {
+		t.Errorf("unexpected diagnostic %+v", d)
+	}
+}
+
+const typedBlocksRef = typedDataRef + "{{/* @import models=testpkg/models */}}"
+
+func TestTypedTypeSwitch(t *testing.T) {
+	src := typedBlocksRef + `{{range .Blocks -}}
+{{with asType . "models.TextBlock"}}<p>{{.Text}}</p>
+{{- else with asType . "*models.ImageBlock"}}<img src="{{.URL}}">
+{{- else}}{{break}}{{end}}
+{{- end}}|{{range .Blocks}}{{with $t := asType . "models.TextBlock"}}{{$t.Text}}{{end}}{{end}}`
+	res, out := runDriver(t, map[string]string{"page.html": src}, typedSupport, driverMain(`
+	page := models.Page{Blocks: []models.Block{
+		models.TextBlock{Text: "a"},
+		&models.ImageBlock{URL: "u"},
+		models.RuleBlock{},
+		models.TextBlock{Text: "b"},
+	}}
+	if err := testpkg.RenderPage(os.Stdout, page); err != nil {
+		panic(err)
+	}
+`, "os", "testpkg/models"))
+	typed := res.Generated[strings.Index(res.Generated, "func RenderPage"):]
+	for _, want := range []string{".(type) {", "case models.TextBlock:", "case *models.ImageBlock:", "if typed", "!= nil {", "break loop"} {
+		if !strings.Contains(typed, want) {
+			t.Errorf("expected %q in:\n%s", want, typed)
+		}
+	}
+
+	if want := "<p>a</p><img src=\"u\">|ab"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+// TestTypedTypeSwitchMatchesRuntime renders one template through its
+// typed render function and through the runtime registry, which must
+// agree on which asType branches a value takes.
+func TestTypedTypeSwitchMatchesRuntime(t *testing.T) {
+	src := typedBlocksRef + `{{range .Blocks}}
+{{- with asType . "models.TextBlock"}}t{{.Text}}
+{{- else with asType . "*testpkg/models.ImageBlock"}}i{{.URL}}
+{{- else}}-{{end}};{{end}}`
+	_, out := runDriver(t, map[string]string{"page.html": src}, typedSupport, driverMain(`
+	page := models.Page{Blocks: []models.Block{
+		models.TextBlock{Text: "a"},
+		&models.ImageBlock{URL: "u"},
+		(*models.ImageBlock)(nil),
+		models.RuleBlock{},
+	}}
+	if err := testpkg.RenderPage(os.Stdout, page); err != nil {
+		panic(err)
+	}
+	fmt.Print("|")
+	if err := testpkg.Parsed.ExecuteTemplate(os.Stdout, "page.html", page); err != nil {
+		panic(err)
+	}
+`, "fmt", "os", "testpkg/models"))
+	if want := "ta;iu;-;-;|ta;iu;-;-;"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestTypedTypeSwitchErrors(t *testing.T) {
+	const imports = "{{/* @import models=testpkg/models */}}{{/* @import m=testpkg/models */}}"
+	runTypedErrCases(t, map[string]struct{ src, want string }{
+		"not an interface":    {imports + `{{with asType .Title "models.TextBlock"}}{{end}}`, "asType needs an interface value"},
+		"impossible type":     {imports + `{{range .Blocks}}{{with asType . "models.User"}}{{end}}{{end}}`, "impossible asType"},
+		"pointer receiver":    {imports + `{{range .Blocks}}{{with asType . "models.ImageBlock"}}{{end}}{{end}}`, "impossible asType"},
+		"duplicate case":      {imports + `{{range .Blocks}}{{with asType . "models.TextBlock"}}{{else with asType . "models.TextBlock"}}{{end}}{{end}}`, "duplicate asType case"},
+		"unknown type":        {imports + `{{range .Blocks}}{{with asType . "models.Nope"}}{{end}}{{end}}`, `asType "models.Nope"`},
+		"outside of {{with}}": {imports + `{{range .Blocks}}{{asType . "models.TextBlock"}}{{end}}`, "only as a whole {{with}} pipeline"},
+		"import alias":        {imports + `{{range .Blocks}}{{with asType . "m.TextBlock"}}{{end}}{{end}}`, `write the type as "models.TextBlock" or "testpkg/models.TextBlock"`},
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"go/types"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"text/template/parse"
+)
+
+// fallbackTemplatesVar names the variable holding Parsed for the dynamic
+// code of typed render functions, which calls functions and templates
+// through it. It is set in init: Parsed's initializer refers to the
+// render functions, so they can't refer to Parsed directly without an
+// initialization cycle.
+const fallbackTemplatesVar = "fallbackTemplates"
+
+// writeFallbackTemplates declares fallbackTemplatesVar.
+func writeFallbackTemplates(writer io.Writer) {
+	writeString(writer, fmt.Sprintf("\nvar %s *templates.Templates\n", fallbackTemplatesVar))
+	writeString(writer, fmt.Sprintf("\nfunc init() { %s = Parsed }\n", fallbackTemplatesVar))
+}
+
+// emitFallback writes node as dynamic code in a block of its own, which
+// rebinds what that code expects as untyped values: data to the current
+// dot, t to the registry and each $variable in scope to var_<name>.
+// Those are copies, so the $variables the node assigns are copied back
+// to their typed variables after, failing at runtime if a value doesn't
+// have the variable's type. One the node declares is declared as any
+// before the block, bound in the current scope so later typed nodes can
+// read it, and then assigned.
+func (g *Generator) emitFallback(node parse.Node) {
+	if action, ok := node.(*parse.ActionNode); ok && len(action.Pipe.Decl) > 0 && !action.Pipe.IsAssign {
+		local := fmt.Sprintf("local%d", g.NextVar())
+		g.Line("var %s any", local)
+		g.Line("_ = %s", local)
+		g.BindVar(action.Pipe.Decl[0].Ident[0], ScopeBinding{GoExpr: local, Type: types.Universe.Lookup("any").Type(), Assignable: true})
+
+		pipe := *action.Pipe
+		pipe.IsAssign = true
+		assign := *action
+		assign.Pipe = &pipe
+		node = &assign
+	}
+
+	g.Line("{")
+	g.Depth++
+
+	// Variables first, as their expressions may refer to data.
+	vars := map[string]string{}
+	for _, scope := range g.Scopes {
+		for name, b := range scope.Vars {
+			vars[sanitizeVarName(name)] = b.GoExpr
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(vars)) {
+		if vars[name] == "" {
+			continue
+		}
+		g.Line("%s := any(%s)", name, vars[name])
+		g.Line("_ = %s", name)
+	}
+	dot := g.DotExpr
+	if dot == "" {
+		dot = "nil"
+	}
+	g.Line("data := any(%s)", dot)
+	g.Line("t := %s", fallbackTemplatesVar)
+	g.Line("_, _ = data, t")
+
+	g.emitDynamicNode(node)
+	for _, name := range assignedVars(node) {
+		// canFallBack made sure each has a Go variable of its own.
+		if b, ok := g.LookupVar(name); ok {
+			g.assignBack(node, name, b)
+		}
+	}
+	g.Depth--
+	g.Line("}")
+}
+
+// assignBack writes code setting the typed variable b, for the
+// $variable name, to the value the dynamic code of node assigned to its
+// copy.
+func (g *Generator) assignBack(node parse.Node, name string, b ScopeBinding) {
+	goName := sanitizeVarName(name)
+	if types.Identical(b.Type, types.Universe.Lookup("any").Type()) {
+		g.Line("%s = %s", b.GoExpr, goName)
+		return
+	}
+	value := fmt.Sprintf("assigned%d", g.NextVar())
+	line := lineNumberFor(g.LineIndex, int64(node.Position()))
+	typ := g.TypeExpr(b.Type)
+	msg := fmt.Sprintf("%s:%d: can't assign %%T to %s of type %s", strings.ReplaceAll(g.TemplateName, "%", "%%"), line, name, typ)
+	ok := "ok"
+	if types.IsInterface(b.Type) {
+		// A nil value is any interface's zero value.
+		ok = fmt.Sprintf("ok || %s == nil", goName)
+	}
+	g.Line("if %s, ok := %s.(%s); %s {", value, goName, typ, ok)
+	g.Line("%s = %s", b.GoExpr, value)
+	g.Line("} else {")
+	g.Line("return fmt.Errorf(%q, %s)", msg, goName)
+	g.Line("}")
+}
+
+// canFallBack reports whether dynamic code can stand in for node. It
+// works on copies of the typed variables, so it can only assign those
+// with a Go variable of their own to copy the values back to.
+func (g *Generator) canFallBack(node parse.Node) bool {
+	for _, name := range assignedVars(node) {
+		if b, ok := g.LookupVar(name); ok && !b.Assignable {
+			return false
+		}
+	}
+	return true
+}
+
+// assignedVars returns the $variables node and the blocks in it assign,
+// sorted.
+func assignedVars(node parse.Node) []string {
+	names := map[string]bool{}
+	var walk func(parse.Node)
+	walkBranch := func(b *parse.BranchNode) {
+		if b.Pipe.IsAssign {
+			for _, v := range b.Pipe.Decl {
+				names[v.Ident[0]] = true
+			}
+		}
+		walk(b.List)
+		walk(b.ElseList)
+	}
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, node := range n.Nodes {
+				walk(node)
+			}
+		case *parse.ActionNode:
+			if n.Pipe.IsAssign {
+				names[n.Pipe.Decl[0].Ident[0]] = true
+			}
+		case *parse.IfNode:
+			walkBranch(&n.BranchNode)
+		case *parse.RangeNode:
+			walkBranch(&n.BranchNode)
+		case *parse.WithNode:
+			walkBranch(&n.BranchNode)
+		}
+	}
+	walk(node)
+	return slices.Sorted(maps.Keys(names))
+}
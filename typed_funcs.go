@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template/parse"
+)
+
+// operand is an evaluated pipeline stage: a Go expression and its
+// static type.
+type operand struct {
+	expr string
+	typ  types.Type
+}
+
+// typedBuiltins are the text/template builtins with an exact Go
+// equivalent. Typed templates call these functions directly unless a
+// @funcs package provides the same name.
+var typedBuiltins = map[string]struct{ pkg, name string }{
+	"print":   {"fmt", "Sprint"},
+	"printf":  {"fmt", "Sprintf"},
+	"println": {"fmt", "Sprintln"},
+}
+
+// addBuiltinFuncs adds typedBuiltins to funcs where not already present.
+func addBuiltinFuncs(resolver *TypeResolver, funcs map[string]FuncRef) error {
+	for name, b := range typedBuiltins {
+		if _, ok := funcs[name]; ok {
+			continue
+		}
+		fn, err := resolver.LookupFunc(b.pkg, b.name)
+		if err != nil {
+			return fmt.Errorf("builtin %s: %w", name, err)
+		}
+		funcs[name] = FuncRef{Name: name, Sig: fn.Type().(*types.Signature), Func: fn}
+	}
+	return nil
+}
+
+// evalCommand evaluates one command of a pipeline: a function or method
+// call with its arguments, or a single operand. final is the result of the
+// previous pipeline stage, passed as the call's last argument, or nil
+// for the first command.
+func (g *Generator) evalCommand(cmd *parse.CommandNode, final *operand) (string, types.Type, error) {
+	switch first := cmd.Args[0].(type) {
+	case *parse.IdentifierNode:
+		return g.evalCall(first, cmd.Args[1:], final)
+	case *parse.FieldNode:
+		if err := g.checkDot(first.Position()); err != nil {
+			return "", nil, err
+		}
+		return g.fieldExpr(g.DotExpr, g.DotType, first.Ident, first.String(), int64(first.Position()), cmd.Args[1:], final)
+	case *parse.VariableNode:
+		return g.evalVariable(first, cmd.Args[1:], final)
+	case *parse.ChainNode:
+		return g.evalChain(first, cmd.Args[1:], final)
+	}
+	if len(cmd.Args) > 1 || final != nil {
+		return "", nil, errorAtLine(lineNumberFor(g.LineIndex, int64(cmd.Position())), "can't give argument to non-function %s",
+			cmd.Args[0])
+	}
+	return g.evalCommandArg(cmd.Args[0])
+}
+
+// evalCall type-checks a call to a @funcs function against its Go
+// signature and returns a direct call expression, so no reflection
+// happens at runtime.
+func (g *Generator) evalCall(ident *parse.IdentifierNode, args []parse.Node, final *operand) (string, types.Type, error) {
+	line := lineNumberFor(g.LineIndex, int64(ident.Position()))
+	if g.isTypedBuiltinOp(ident.Ident) {
+		return g.evalBuiltinOp(ident.Ident, args, final, line)
+	}
+	ref, ok := g.Funcs[ident.Ident]
+	if !ok {
+		var err error
+		if ref, ok, err = g.sprigFunc(ident.Ident); err != nil {
+			return "", nil, atLine(line, err)
+		}
+	}
+	if !ok && ident.Ident == asTypeFunc {
+		return "", nil, errorAtLine(line, "asType narrows dot only as a whole {{with}} pipeline, as in {{with asType .Field %q}}",
+			"pkg.Type")
+	}
+	if !ok {
+		return "", nil, errorAtLine(line, "typed mode has no Go signature for function %q; provide it with @funcs",
+			ident.Ident)
+	}
+	callee, err := g.funcExpr(ref)
+	if err != nil {
+		return "", nil, atLine(line, err)
+	}
+	if format, ok := constPrintf(ref, args); ok {
+		argExprs, err := g.evalPrintf(format, args[1:], final, line)
+		if err != nil {
+			return "", nil, err
+		}
+		return callee + "(" + strings.Join(argExprs, ", ") + ")", types.Typ[types.String], nil
+	}
+	argExprs, sig, err := g.evalArgs(ident.Ident, ref.Sig, args, final, line)
+	if err != nil {
+		return "", nil, err
+	}
+	return g.callResult(ident.Ident, fmt.Sprintf("%s(%s)", callee, strings.Join(argExprs, ", ")), sig, line)
+}
+
+// funcExpr returns the Go expression generated code calls for ref: the
+// function itself when it can be named from the generated package, or
+// its entry in an exported FuncMap asserted to the static signature.
+func (g *Generator) funcExpr(ref FuncRef) (string, error) {
+	if fn := ref.Func; fn != nil && fn.Pkg() != nil && (fn.Exported() || fn.Pkg().Name() == g.PackageName) {
+		return g.qualify(fn.Pkg(), fn.Name()), nil
+	}
+	if v := ref.MapVar; v != nil {
+		return fmt.Sprintf("%s[%q].(%s)", g.qualify(v.Pkg(), v.Name()), ref.Name, g.TypeExpr(ref.Sig)), nil
+	}
+	return "", fmt.Errorf("function %q is neither an exported Go function nor reachable through an exported FuncMap", ref.Name)
+}
+
+// qualify returns name as referenced from the generated package,
+// importing pkg under its @funcs alias, or its own name, if needed.
+func (g *Generator) qualify(pkg *types.Package, name string) string {
+	if pkg.Name() == g.PackageName {
+		return name
+	}
+	alias, ok := g.FuncAliases[pkg.Path()]
+	if !ok {
+		alias = pkg.Name()
+	}
+	return g.Imports.Add(pkg.Path(), alias) + "." + name
+}
+
+// evalArgs evaluates the arguments of a call to name and checks their
+// count and types against sig, including variadic parameters. A
+// non-nil final is the piped-in value and becomes the last argument.
+// Constants are evaluated last, as they take their type from the
+// parameter; the other arguments instantiate sig if it is generic, and
+// the signature returned is the one called.
+func (g *Generator) evalArgs(name string, sig *types.Signature, args []parse.Node, final *operand, line int) ([]string, *types.Signature, error) {
+	count := len(args)
+	if final != nil {
+		count++
+	}
+	params := sig.Params()
+	if sig.Variadic() {
+		if count < params.Len()-1 {
+			return nil, nil, errorAtLine(line, "wrong number of args for %s: want at least %d got %d",
+				name, params.Len()-1, count)
+		}
+	} else if count != params.Len() {
+		return nil, nil, errorAtLine(line, "wrong number of args for %s: want %d got %d",
+			name, params.Len(), count)
+	}
+
+	operands := make([]operand, count)
+	for i, arg := range args {
+		if isConstantNode(arg) {
+			continue
+		}
+		expr, typ, err := g.evalCommandArg(arg)
+		if err != nil {
+			return nil, nil, errorAtLine(line, "argument %d to %s: %w", i+1, name, err)
+		}
+		operands[i] = operand{expr: expr, typ: typ}
+	}
+	if final != nil {
+		operands[count-1] = *final
+	}
+	if sig.TypeParams().Len() > 0 {
+		var err error
+		if sig, err = g.instantiate(name, sig, args, operands); err != nil {
+			return nil, nil, atLine(line, err)
+		}
+	}
+
+	exprs := make([]string, count)
+	for i, arg := range args {
+		want := paramType(sig, i)
+		if isConstantNode(arg) {
+			expr, err := g.evalArg(arg, want)
+			if err != nil {
+				return nil, nil, errorAtLine(line, "argument %d to %s: %w", i+1, name, err)
+			}
+			exprs[i] = expr
+			continue
+		}
+		if !types.AssignableTo(operands[i].typ, want) {
+			return nil, nil, errorAtLine(line, "argument %d to %s: have %s, want %s", i+1, name, operands[i].typ, want)
+		}
+		exprs[i] = operands[i].expr
+	}
+	if final != nil {
+		if want := paramType(sig, len(args)); !types.AssignableTo(final.typ, want) {
+			return nil, nil, errorAtLine(line, "cannot pipe %s into %s: have %s, want %s",
+				final.expr, name, final.typ, want)
+		}
+		exprs[count-1] = final.expr
+	}
+	return exprs, sig, nil
+}
+
+// instantiate infers the type arguments of a call to the generic sig,
+// as Go would, from the arguments passed directly as a type parameter:
+// evaluated operands first, then the default types of constants.
+func (g *Generator) instantiate(name string, sig *types.Signature, args []parse.Node, operands []operand) (*types.Signature, error) {
+	tparams := sig.TypeParams()
+	targs := make([]types.Type, tparams.Len())
+	bind := func(i int, typ types.Type) {
+		if tp, ok := paramType(sig, i).(*types.TypeParam); ok && targs[tp.Index()] == nil {
+			targs[tp.Index()] = typ
+		}
+	}
+	for i, op := range operands {
+		if op.typ != nil {
+			bind(i, op.typ)
+		}
+	}
+	for i, arg := range args {
+		if _, ok := arg.(*parse.NilNode); ok || !isConstantNode(arg) {
+			continue
+		}
+		_, typ, err := g.evalCommandArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		bind(i, typ)
+	}
+	for i, targ := range targs {
+		if targ == nil {
+			return nil, fmt.Errorf("cannot infer %s for %s from its arguments", tparams.At(i).Obj().Name(), name)
+		}
+	}
+	inst, err := types.Instantiate(nil, sig, targs, true)
+	if err != nil {
+		return nil, fmt.Errorf("calling %s: %w", name, err)
+	}
+	return inst.(*types.Signature), nil
+}
+
+// paramType returns the type the i'th argument of a call to sig is
+// assigned to, accounting for a variadic final parameter.
+func paramType(sig *types.Signature, i int) types.Type {
+	params := sig.Params()
+	if sig.Variadic() && i >= params.Len()-1 {
+		return params.At(params.Len() - 1).Type().(*types.Slice).Elem()
+	}
+	return params.At(i).Type()
+}
+
+// evalArg evaluates a call argument against the parameter type it is
+// passed as. Constants take on the parameter's type, as in Go, and must
+// fit in it; any other operand must be assignable to it.
+func (g *Generator) evalArg(arg parse.Node, want types.Type) (string, error) {
+	basic, _ := want.Underlying().(*types.Basic)
+	if n, ok := arg.(*parse.NumberNode); ok && basic != nil && !constantFits(n, basic) {
+		return "", fmt.Errorf("constant %s overflows %s", n.Text, want)
+	}
+	switch a := arg.(type) {
+	case *parse.NilNode:
+		switch want.Underlying().(type) {
+		case *types.Pointer, *types.Interface, *types.Slice, *types.Map, *types.Chan, *types.Signature:
+			return "nil", nil
+		}
+		return "", fmt.Errorf("cannot use nil as %s", want)
+	case *parse.StringNode:
+		if basic != nil && basic.Info()&types.IsString != 0 {
+			return a.Quoted, nil
+		}
+	case *parse.BoolNode:
+		if basic != nil && basic.Info()&types.IsBoolean != 0 {
+			return strconv.FormatBool(a.True), nil
+		}
+	case *parse.NumberNode:
+		switch {
+		case basic == nil:
+		case basic.Info()&types.IsInteger != 0 && a.IsInt:
+			return strconv.FormatInt(a.Int64, 10), nil
+		case basic.Info()&types.IsInteger != 0 && a.IsUint:
+			return strconv.FormatUint(a.Uint64, 10), nil
+		case basic.Info()&types.IsFloat != 0 && a.IsFloat:
+			return strconv.FormatFloat(a.Float64, 'g', -1, 64), nil
+		case basic.Info()&types.IsComplex != 0 && a.IsComplex:
+			return a.Text, nil
+		}
+	}
+
+	expr, typ, err := g.evalCommandArg(arg)
+	if err != nil {
+		return "", err
+	}
+	if !types.AssignableTo(typ, want) {
+		return "", fmt.Errorf("have %s, want %s", typ, want)
+	}
+	return expr, nil
+}
+
+// sizes gives the size of int, uint and uintptr for range checks, as
+// on the machine generating, which is usually the one building.
+var sizes = types.SizesFor("gc", runtime.GOARCH)
+
+// constantFits reports whether the number n is in range for the basic
+// type t it is written as, which Go checks of constants when compiling.
+// Numbers that would not be converted to t, such as a fraction for an
+// integer type, are left to the type check.
+func constantFits(n *parse.NumberNode, t *types.Basic) bool {
+	info := t.Info()
+	switch {
+	case info&types.IsInteger != 0 && (n.IsInt || n.IsUint):
+		v := constant.MakeUint64(n.Uint64)
+		if n.IsInt {
+			v = constant.MakeInt64(n.Int64)
+		}
+		bits := uint(8 * sizes.Sizeof(t))
+		lo, hi := constant.MakeInt64(0), constant.Shift(constant.MakeInt64(1), token.SHL, bits)
+		if info&types.IsUnsigned == 0 {
+			hi = constant.Shift(constant.MakeInt64(1), token.SHL, bits-1)
+			lo = constant.UnaryOp(token.SUB, hi, 0)
+		}
+		return constant.Compare(v, token.GEQ, lo) && constant.Compare(v, token.LSS, hi)
+	case t.Kind() == types.Float32 && n.IsFloat:
+		return math.Abs(n.Float64) <= math.MaxFloat32
+	}
+	return true
+}
+
+// callResult turns a call expression into the value the template sees.
+// Like text/template, a function returns one value or a value and an
+// error; a non-nil error stops rendering with the template position.
+func (g *Generator) callResult(name, call string, sig *types.Signature, line int) (string, types.Type, error) {
+	results := sig.Results()
+	switch {
+	case results.Len() == 1:
+		return call, results.At(0).Type(), nil
+	case results.Len() == 2 && isErrorType(results.At(1).Type()):
+		tmp := fmt.Sprintf("call%d", g.NextVar())
+		g.Line("%s, err := %s", tmp, call)
+		g.checkErr(line, "error calling "+name)
+		return tmp, results.At(0).Type(), nil
+	default:
+		return "", nil, errorAtLine(line, "%s must return one value, or a value and an error", name)
+	}
+}
+
+// checkErr writes the check after a statement that assigned err,
+// wrapping the error with the template position and what failed.
+func (g *Generator) checkErr(line int, what string) {
+	prefix := strings.ReplaceAll(fmt.Sprintf("%s:%d: %s", g.TemplateName, line, what), "%", "%%")
+	g.Line("if err != nil { return fmt.Errorf(%q, err) }", prefix+": %w")
+}
+
+// isErrorType reports whether t is the predeclared error interface.
+func isErrorType(t types.Type) bool {
+	return types.Identical(t, types.Universe.Lookup("error").Type())
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"go/token"
+	"go/types"
+	"strings"
+	"text/template/parse"
+)
+
+// typedOperators maps the comparison builtins to the Go operator each
+// compiles to.
+var typedOperators = map[string]string{
+	"eq": "==",
+	"ne": "!=",
+	"lt": "<",
+	"le": "<=",
+	"gt": ">",
+	"ge": ">=",
+}
+
+// isTypedBuiltinOp reports whether name is a builtin the typed codegen
+// compiles to Go operators rather than a call. A @funcs function of the
+// same name overrides it, as Funcs does for text/template.
+func (g *Generator) isTypedBuiltinOp(name string) bool {
+	if _, ok := g.Funcs[name]; ok {
+		return false
+	}
+	_, cmp := typedOperators[name]
+	return cmp || name == "and" || name == "or" || name == "not"
+}
+
+// evalBuiltinOp evaluates a call to a comparison or logic builtin in a
+// value context, such as {{or .Title "untitled"}}.
+func (g *Generator) evalBuiltinOp(name string, args []parse.Node, final *operand, line int) (string, types.Type, error) {
+	switch name {
+	case "not":
+		operands := g.operandThunks(args, final)
+		if len(operands) != 1 {
+			return "", nil, errorAtLine(line, "wrong number of args for not: want 1 got %d", len(operands))
+		}
+		expr, typ, err := operands[0]()
+		if err != nil {
+			return "", nil, err
+		}
+		truth, err := truthExpr(expr, typ)
+		if err != nil {
+			return "", nil, atLine(line, err)
+		}
+		return negate(truth), types.Typ[types.Bool], nil
+	case "and", "or":
+		return g.evalLogicValue(name, args, final, line)
+	default:
+		return g.evalComparison(name, args, final, line)
+	}
+}
+
+// operandThunks defers the evaluation of call arguments, so and/or can
+// emit the statements of each one only where it is reached. The piped
+// value, already evaluated, comes last.
+func (g *Generator) operandThunks(args []parse.Node, final *operand) []func() (string, types.Type, error) {
+	thunks := make([]func() (string, types.Type, error), 0, len(args)+1)
+	for _, arg := range args {
+		thunks = append(thunks, func() (string, types.Type, error) { return g.evalCommandArg(arg) })
+	}
+	if final != nil {
+		thunks = append(thunks, func() (string, types.Type, error) { return final.expr, final.typ, nil })
+	}
+	return thunks
+}
+
+// evalLogicValue compiles and/or where the result is used as a value.
+// Like text/template, the result is the first argument that decides the
+// outcome, and later arguments are evaluated only when reached:
+//
+//	or1 := a
+//	if !(len(or1) > 0) {
+//		or1 = b
+//	}
+//
+// The arguments must share one type, since the result takes it. A
+// constant argument takes that type, as an untyped Go constant would,
+// and a leading one is decided here: it is either skipped or the result.
+func (g *Generator) evalLogicValue(name string, args []parse.Node, final *operand, line int) (string, types.Type, error) {
+	for len(args) > 0 && isConstantNode(args[0]) && (len(args) > 1 || final != nil) {
+		if constantTruth(args[0]) == (name == "or") {
+			return g.evalCommandArg(args[0])
+		}
+		args = args[1:]
+	}
+	operands := g.operandThunks(args, final)
+	if len(operands) == 0 {
+		return "", nil, errorAtLine(line, "wrong number of args for %s: want at least 1 got 0", name)
+	}
+	first, typ, err := operands[0]()
+	if err != nil {
+		return "", nil, err
+	}
+	if len(operands) == 1 {
+		return first, typ, nil
+	}
+
+	result := fmt.Sprintf("%s%d", name, g.NextVar())
+	g.Line("%s := %s", result, first)
+	truth, err := truthExpr(result, typ)
+	if err != nil {
+		return "", nil, atLine(line, err)
+	}
+	if name == "or" {
+		truth = negate(truth)
+	}
+	depth := g.Depth
+	for i, next := range operands[1:] {
+		g.Line("if %s {", truth)
+		g.Depth++
+		var expr string
+		if i+1 < len(args) && isConstantNode(args[i+1]) {
+			if expr, err = g.evalArg(args[i+1], typ); err != nil {
+				return "", nil, errorAtLine(line, "typed mode needs the arguments of %s to share one type to use its value: %w",
+					name, err)
+			}
+		} else {
+			var nextType types.Type
+			if expr, nextType, err = next(); err != nil {
+				return "", nil, err
+			}
+			if !types.Identical(nextType, typ) {
+				return "", nil, errorAtLine(line, "typed mode needs the arguments of %s to share one type to use its value, have %s and %s; use it in a condition instead",
+					name, typ, nextType)
+			}
+		}
+		g.Line("%s = %s", result, expr)
+	}
+	for g.Depth > depth {
+		g.Depth--
+		g.Line("}")
+	}
+	return result, typ, nil
+}
+
+// constantTruth reports the truth of a constant argument: whether it
+// is non-zero.
+func constantTruth(arg parse.Node) bool {
+	switch a := arg.(type) {
+	case *parse.StringNode:
+		return a.Text != ""
+	case *parse.BoolNode:
+		return a.True
+	case *parse.NumberNode:
+		switch {
+		case a.IsComplex:
+			return a.Complex128 != 0
+		case a.IsFloat:
+			return a.Float64 != 0
+		case a.IsUint:
+			return a.Uint64 != 0
+		}
+	}
+	return false
+}
+
+// evalTruth returns a Go boolean expression for the truth of arg. In
+// conditions the and, or and not builtins need only the truth of their
+// arguments, so they compile to &&, || and ! over mixed types.
+func (g *Generator) evalTruth(arg parse.Node) (string, error) {
+	if pipe, ok := arg.(*parse.PipeNode); ok && len(pipe.Decl) == 0 && len(pipe.Cmds) == 1 {
+		if ident, ok := pipe.Cmds[0].Args[0].(*parse.IdentifierNode); ok && g.isTypedBuiltinOp(ident.Ident) {
+			if ident.Ident == "and" || ident.Ident == "or" || ident.Ident == "not" {
+				return g.evalLogicCond(ident, pipe.Cmds[0].Args[1:])
+			}
+		}
+	}
+	expr, typ, err := g.evalCommandArg(arg)
+	if err != nil {
+		return "", err
+	}
+	truth, err := truthExpr(expr, typ)
+	if err != nil {
+		return "", atLine(lineNumberFor(g.LineIndex, int64(arg.Position())), err)
+	}
+	return truth, nil
+}
+
+// evalLogicCond compiles and, or and not used as a condition. Operands
+// that evaluate without statements join into one expression; otherwise
+// each later operand is evaluated inside an if, keeping short-circuit
+// evaluation:
+//
+//	cond1 := a != nil
+//	if cond1 {
+//		call2, err := check(b)
+//		...
+//		cond1 = len(call2) > 0
+//	}
+func (g *Generator) evalLogicCond(ident *parse.IdentifierNode, args []parse.Node) (string, error) {
+	line := lineNumberFor(g.LineIndex, int64(ident.Position()))
+	name := ident.Ident
+	if name == "not" {
+		if len(args) != 1 {
+			return "", errorAtLine(line, "wrong number of args for not: want 1 got %d", len(args))
+		}
+		truth, err := g.evalTruth(args[0])
+		if err != nil {
+			return "", err
+		}
+		return negate(truth), nil
+	}
+	if len(args) == 0 {
+		return "", errorAtLine(line, "wrong number of args for %s: want at least 1 got 0", name)
+	}
+
+	first, err := g.evalTruth(args[0])
+	if err != nil {
+		return "", err
+	}
+	truths := []string{first}
+	stmts := make([]string, len(args))
+	needsStmts := false
+	for i, arg := range args[1:] {
+		// Later operands nest one block deeper each when they need
+		// statements, so capture them at that depth.
+		g.Depth += i + 1
+		var truth string
+		stmts[i+1], err = g.capture(func() error {
+			var err error
+			truth, err = g.evalTruth(arg)
+			return err
+		})
+		g.Depth -= i + 1
+		if err != nil {
+			return "", err
+		}
+		needsStmts = needsStmts || stmts[i+1] != ""
+		truths = append(truths, truth)
+	}
+
+	op := " && "
+	if name == "or" {
+		op = " || "
+	}
+	if !needsStmts {
+		if len(truths) == 1 {
+			return truths[0], nil
+		}
+		return "(" + strings.Join(truths, op) + ")", nil
+	}
+
+	cond := fmt.Sprintf("cond%d", g.NextVar())
+	g.Line("%s := %s", cond, truths[0])
+	test := cond
+	if name == "or" {
+		test = negate(cond)
+	}
+	depth := g.Depth
+	for i := 1; i < len(truths); i++ {
+		g.Line("if %s {", test)
+		g.Depth++
+		g.Writef("%s", stmts[i])
+		g.Line("%s = %s", cond, truths[i])
+	}
+	for g.Depth > depth {
+		g.Depth--
+		g.Line("}")
+	}
+	return cond, nil
+}
+
+// evalComparison compiles eq, ne, lt, le, gt and ge to Go operators.
+// Constant arguments take the type of the first non-constant one, as
+// they would in Go, unless they don't fit in it: text/template compares
+// {{eq .Uint8 300}} by value, so such a constant keeps its own type and
+// compareExpr compares across the two. As in text/template, eq with
+// more than two arguments reports whether the first equals any of the
+// rest.
+func (g *Generator) evalComparison(name string, args []parse.Node, final *operand, line int) (string, types.Type, error) {
+	count := len(args)
+	if final != nil {
+		count++
+	}
+	if name == "eq" && count < 2 || name != "eq" && count != 2 {
+		want := "2"
+		if name == "eq" {
+			want = "at least 2"
+		}
+		return "", nil, errorAtLine(line, "wrong number of args for %s: want %s got %d", name, want, count)
+	}
+
+	operands := make([]operand, count)
+	var target types.Type
+	for i, arg := range args {
+		if isConstantNode(arg) {
+			continue
+		}
+		expr, typ, err := g.evalCommandArg(arg)
+		if err != nil {
+			return "", nil, err
+		}
+		operands[i] = operand{expr: expr, typ: typ}
+		if target == nil {
+			target = typ
+		}
+	}
+	if final != nil {
+		operands[count-1] = *final
+		if target == nil {
+			target = final.typ
+		}
+	}
+	for i, arg := range args {
+		if !isConstantNode(arg) {
+			continue
+		}
+		if target == nil || !fitsType(arg, target) {
+			expr, typ, err := g.evalCommandArg(arg)
+			if err != nil {
+				return "", nil, err
+			}
+			operands[i] = operand{expr: expr, typ: typ}
+			continue
+		}
+		expr, err := g.evalArg(arg, target)
+		if err != nil {
+			return "", nil, errorAtLine(line, "incompatible types for comparison in %s: %w", name, err)
+		}
+		operands[i] = operand{expr: expr, typ: target}
+	}
+
+	first := operands[0]
+	if len(operands) > 2 && !isSimpleExpr(first.expr) {
+		tmp := fmt.Sprintf("eq%d", g.NextVar())
+		g.Line("%s := %s", tmp, first.expr)
+		first.expr = tmp
+	}
+	var parts []string
+	for _, other := range operands[1:] {
+		expr, err := compareExpr(typedOperators[name], first, other)
+		if err != nil {
+			return "", nil, errorAtLine(line, "%s: %w", name, err)
+		}
+		parts = append(parts, expr)
+	}
+	if len(parts) == 1 {
+		return parts[0], types.Typ[types.Bool], nil
+	}
+	return "(" + strings.Join(parts, " || ") + ")", types.Typ[types.Bool], nil
+}
+
+// compareExpr renders x op y. Basic types compare by kind, as in
+// text/template: a named string type compares with string, integers of
+// different sizes compare after conversion to a common type, and signed
+// with unsigned integers compare by value. Other types need Go's own
+// comparability and support only == and !=.
+func compareExpr(op string, x, y operand) (string, error) {
+	ordered := op != "==" && op != "!="
+	bx, xBasic := x.typ.Underlying().(*types.Basic)
+	by, yBasic := y.typ.Underlying().(*types.Basic)
+	if xBasic && yBasic {
+		cx, cy := basicClass(bx), basicClass(by)
+		switch {
+		case cx == "int64" && cy == "uint64":
+			return fmt.Sprintf("templates.CompareIntUint(int64(%s), uint64(%s)) %s 0", x.expr, y.expr, op), nil
+		case cx == "uint64" && cy == "int64":
+			return fmt.Sprintf("0 %s templates.CompareIntUint(int64(%s), uint64(%s))", op, y.expr, x.expr), nil
+		}
+		if cx == "" || cx != cy {
+			return "", fmt.Errorf("incompatible types for comparison: %s and %s", x.typ, y.typ)
+		}
+		if ordered && (cx == "bool" || cx == "complex128") {
+			return "", fmt.Errorf("invalid type for comparison: %s", x.typ)
+		}
+		if types.Identical(x.typ, y.typ) {
+			return fmt.Sprintf("%s %s %s", x.expr, op, y.expr), nil
+		}
+		return fmt.Sprintf("%s(%s) %s %s(%s)", cx, x.expr, op, cx, y.expr), nil
+	}
+	if ordered {
+		return "", fmt.Errorf("invalid type for comparison: %s and %s", x.typ, y.typ)
+	}
+	if !types.Comparable(x.typ) || !types.Comparable(y.typ) {
+		return "", fmt.Errorf("incomparable types %s and %s", x.typ, y.typ)
+	}
+	if !types.AssignableTo(x.typ, y.typ) && !types.AssignableTo(y.typ, x.typ) {
+		return "", fmt.Errorf("incompatible types for comparison: %s and %s", x.typ, y.typ)
+	}
+	return fmt.Sprintf("%s %s %s", x.expr, op, y.expr), nil
+}
+
+// basicClass returns the Go type basic values of t's kind convert to
+// for comparison, or "" if they can't be compared across types.
+// Signed and unsigned integers are kept apart, since converting either
+// to the other changes some values; compareExpr compares them with
+// templates.CompareIntUint.
+func basicClass(t *types.Basic) string {
+	info := t.Info()
+	switch {
+	case info&types.IsBoolean != 0:
+		return "bool"
+	case info&types.IsString != 0:
+		return "string"
+	case info&types.IsUnsigned != 0:
+		return "uint64"
+	case info&types.IsInteger != 0:
+		return "int64"
+	case info&types.IsFloat != 0:
+		return "float64"
+	case info&types.IsComplex != 0:
+		return "complex128"
+	}
+	return ""
+}
+
+// isConstantNode reports whether arg is a literal that takes its type
+// from context.
+func isConstantNode(arg parse.Node) bool {
+	switch arg.(type) {
+	case *parse.StringNode, *parse.NumberNode, *parse.BoolNode, *parse.NilNode:
+		return true
+	}
+	return false
+}
+
+// fitsType reports whether the constant arg is in range for typ, when
+// it is a number and typ a basic type.
+func fitsType(arg parse.Node, typ types.Type) bool {
+	n, ok := arg.(*parse.NumberNode)
+	basic, isBasic := typ.Underlying().(*types.Basic)
+	return !ok || !isBasic || constantFits(n, basic)
+}
+
+// isSimpleExpr reports whether expr is an identifier or selector chain,
+// cheap and side-effect free to evaluate more than once.
+func isSimpleExpr(expr string) bool {
+	for _, part := range strings.Split(expr, ".") {
+		if !token.IsIdentifier(part) {
+			return false
+		}
+	}
+	return true
+}
+
+// negate returns the Go negation of the boolean expression expr.
+func negate(expr string) string {
+	if token.IsIdentifier(expr) {
+		return "!" + expr
+	}
+	return "!(" + expr + ")"
+}
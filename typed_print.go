@@ -0,0 +1,115 @@
+package main
+
+import (
+	"go/types"
+)
+
+// emitPrint writes the statement that prints expr, of static type typ,
+// as html/template would: escaped text, with numbers formatted like
+// fmt.Print. Strings, numbers, booleans and value Stringers are written
+// without going through an interface, so they don't allocate; other
+// types fall back to templates.WriteEscaped.
+func (g *Generator) emitPrint(expr string, typ types.Type) {
+	switch {
+	case isNamed(typ, "html/template", "HTML"):
+		g.Line("_, err = io.WriteString(writer, string(%s))", expr)
+	case isFormatter(typ):
+		// Custom formatting could print anything; leave it to fmt.
+		g.Line("err = templates.WriteEscaped(writer, %s)", expr)
+	case isValueType(typ) && hasMethod(typ, "Error"):
+		g.Line("err = templates.WriteEscapedString(writer, %s.Error())", expr)
+	case isValueType(typ) && hasMethod(typ, "String"):
+		g.Line("err = templates.WriteEscapedString(writer, %s.String())", expr)
+	default:
+		basic, ok := typ.Underlying().(*types.Basic)
+		if !ok {
+			g.Line("err = templates.WriteEscaped(writer, %s)", expr)
+			break
+		}
+		info := basic.Info()
+		switch {
+		case info&types.IsString != 0:
+			g.Line("err = templates.WriteEscapedString(writer, %s)", convert(expr, typ, types.Typ[types.String]))
+		case info&types.IsBoolean != 0:
+			g.Imports.Add("strconv", "")
+			g.Line("_, err = io.WriteString(writer, strconv.FormatBool(%s))", convert(expr, typ, types.Typ[types.Bool]))
+		case info&types.IsUnsigned != 0:
+			g.Line("err = templates.WriteUint(writer, %s)", convert(expr, typ, types.Typ[types.Uint64]))
+		case info&types.IsInteger != 0:
+			g.Line("err = templates.WriteInt(writer, %s)", convert(expr, typ, types.Typ[types.Int64]))
+		case basic.Kind() == types.Float32:
+			g.Line("err = templates.WriteFloat(writer, float64(%s), 32)", expr)
+		case info&types.IsFloat != 0:
+			g.Line("err = templates.WriteFloat(writer, %s, 64)", convert(expr, typ, types.Typ[types.Float64]))
+		default:
+			g.Line("err = templates.WriteEscaped(writer, %s)", expr)
+		}
+	}
+	g.Line("if err != nil { return err }")
+}
+
+// convert returns expr converted to the basic type to, unless it
+// already has that type.
+func convert(expr string, typ types.Type, to *types.Basic) string {
+	if types.Identical(typ, to) {
+		return expr
+	}
+	return to.Name() + "(" + expr + ")"
+}
+
+// isNamed reports whether typ is the named type pkgPath.name.
+func isNamed(typ types.Type, pkgPath, name string) bool {
+	named, ok := typ.(*types.Named)
+	if !ok || named.Obj().Pkg() == nil {
+		return false
+	}
+	return named.Obj().Pkg().Path() == pkgPath && named.Obj().Name() == name
+}
+
+// isValueType reports whether typ is neither a pointer nor an
+// interface. Methods on those are left to fmt, which prints "<nil>"
+// for a nil receiver instead of panicking.
+func isValueType(typ types.Type) bool {
+	switch typ.Underlying().(type) {
+	case *types.Pointer, *types.Interface:
+		return false
+	}
+	return true
+}
+
+// hasMethod reports whether typ's method set has a method name taking
+// no arguments and returning a single string, the shape of both
+// fmt.Stringer's String and error's Error.
+func hasMethod(typ types.Type, name string) bool {
+	sel := types.NewMethodSet(typ).Lookup(nil, name)
+	if sel == nil {
+		return false
+	}
+	sig := sel.Type().(*types.Signature)
+	if sig.Params().Len() != 0 || sig.Results().Len() != 1 {
+		return false
+	}
+	res, ok := sig.Results().At(0).Type().(*types.Basic)
+	return ok && res.Kind() == types.String
+}
+
+// isFormatter reports whether typ implements fmt.Formatter, which
+// takes precedence over String and Error when fmt prints. A type can
+// only implement it through a Format method taking fmt.State, so the
+// interface is looked up in the package of that parameter's type.
+func isFormatter(typ types.Type) bool {
+	sel := types.NewMethodSet(typ).Lookup(nil, "Format")
+	if sel == nil {
+		return false
+	}
+	params := sel.Type().(*types.Signature).Params()
+	if params.Len() == 0 || !isNamed(params.At(0).Type(), "fmt", "State") {
+		return false
+	}
+	fmtPkg := params.At(0).Type().(*types.Named).Obj().Pkg()
+	formatter, ok := fmtPkg.Scope().Lookup("Formatter").(*types.TypeName)
+	if !ok {
+		return false
+	}
+	return types.Implements(typ, formatter.Type().Underlying().(*types.Interface))
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"go/types"
+	"strconv"
+	"strings"
+	"text/template/parse"
+	"unicode/utf8"
+)
+
+// printfArg is a set of argument kinds a printf verb accepts, after the
+// table in go vet's printf check.
+type printfArg int
+
+const (
+	argBool printfArg = 1 << iota
+	argInt
+	argRune
+	argString
+	argFloat
+	argComplex
+	argPointer
+	argAny printfArg = ^0
+)
+
+// printfVerbs maps each verb fmt.Sprintf understands to the arguments
+// it formats meaningfully.
+var printfVerbs = map[rune]printfArg{
+	'b': argInt | argFloat | argComplex | argPointer,
+	'c': argRune | argInt,
+	'd': argInt | argPointer,
+	'e': argFloat | argComplex,
+	'E': argFloat | argComplex,
+	'f': argFloat | argComplex,
+	'F': argFloat | argComplex,
+	'g': argFloat | argComplex,
+	'G': argFloat | argComplex,
+	'o': argInt | argPointer,
+	'O': argInt | argPointer,
+	'p': argPointer,
+	'q': argRune | argInt | argString,
+	's': argString,
+	't': argBool,
+	'T': argAny,
+	'U': argRune | argInt,
+	'v': argAny,
+	'x': argRune | argInt | argString | argPointer | argFloat | argComplex,
+	'X': argRune | argInt | argString | argPointer | argFloat | argComplex,
+}
+
+// constPrintf returns the format of a call of ref with args when ref is
+// the builtin printf and the format is a constant, which typed mode
+// verifies at generation time and can print without building a string.
+func constPrintf(ref FuncRef, args []parse.Node) (*parse.StringNode, bool) {
+	fn := ref.Func
+	if fn == nil || fn.Pkg() == nil || fn.Pkg().Path() != "fmt" || fn.Name() != "Sprintf" || len(args) == 0 {
+		return nil, false
+	}
+	format, ok := args[0].(*parse.StringNode)
+	return format, ok
+}
+
+// evalPrintf evaluates the arguments of printf with a constant format,
+// args being those after the format, and checks them against its verbs.
+// It returns the Go arguments of the equivalent fmt call.
+func (g *Generator) evalPrintf(format *parse.StringNode, args []parse.Node, final *operand, line int) ([]string, error) {
+	exprs := []string{strconv.Quote(format.Text)}
+	var ops []operand
+	var names []string
+	for _, arg := range args {
+		if _, ok := arg.(*parse.NilNode); ok {
+			exprs = append(exprs, "nil")
+			ops = append(ops, operand{expr: "nil", typ: types.Typ[types.UntypedNil]})
+			names = append(names, "nil")
+			continue
+		}
+		expr, typ, err := g.evalCommandArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		ops = append(ops, operand{expr: expr, typ: typ})
+		names = append(names, arg.String())
+	}
+	if final != nil {
+		exprs = append(exprs, final.expr)
+		ops = append(ops, *final)
+		names = append(names, "the piped value")
+	}
+	if err := checkPrintf(format.Text, ops, names); err != nil {
+		return nil, atLine(line, err)
+	}
+	return exprs, nil
+}
+
+// emitPrintf prints an action whose last command is printf with a
+// constant format by formatting straight into an escaping writer. It
+// reports false, writing nothing, for any other pipeline.
+func (g *Generator) emitPrintf(pipe *parse.PipeNode) (bool, error) {
+	last := pipe.Cmds[len(pipe.Cmds)-1]
+	ident, ok := last.Args[0].(*parse.IdentifierNode)
+	if !ok || len(pipe.Decl) > 0 {
+		return false, nil
+	}
+	format, ok := constPrintf(g.Funcs[ident.Ident], last.Args[1:])
+	if !ok {
+		return false, nil
+	}
+
+	var prev *operand
+	for _, cmd := range pipe.Cmds[:len(pipe.Cmds)-1] {
+		expr, typ, err := g.evalCommand(cmd, prev)
+		if err != nil {
+			return true, err
+		}
+		prev = &operand{expr: expr, typ: typ}
+	}
+	args, err := g.evalPrintf(format, last.Args[2:], prev, lineNumberFor(g.LineIndex, int64(ident.Position())))
+	if err != nil {
+		return true, err
+	}
+	g.Line("_, err = %s.Fprintf(templates.HTMLEscaper{Writer: writer}, %s)", g.Imports.Add("fmt", ""), strings.Join(args, ", "))
+	g.Line("if err != nil { return err }")
+	return true, nil
+}
+
+// checkPrintf reports the first way format misuses args, named by names
+// in errors: an unknown verb, a missing or extra argument, or an
+// argument of a type its verb can't format.
+func checkPrintf(format string, args []operand, names []string) error {
+	argNum := 0
+	reordered := false
+	for i := 0; i < len(format); {
+		if format[i] != '%' {
+			i++
+			continue
+		}
+		start := i
+		i++
+		for i < len(format) && strings.IndexByte("+-# 0", format[i]) >= 0 {
+			i++
+		}
+		// index parses an explicit argument index like [2], moving
+		// argNum to it.
+		index := func() error {
+			if i >= len(format) || format[i] != '[' {
+				return nil
+			}
+			end := strings.IndexByte(format[i:], ']')
+			if end < 0 {
+				return fmt.Errorf("printf format %s has an unclosed argument index", format[start:])
+			}
+			n, err := strconv.Atoi(format[i+1 : i+end])
+			if err != nil || n < 1 || n > len(args) {
+				return fmt.Errorf("printf format %s has invalid argument index %s", format[start:i+end+1], format[i:i+end+1])
+			}
+			reordered = true
+			argNum = n - 1
+			i += end + 1
+			return nil
+		}
+		// star consumes an argument for a * width or precision.
+		star := func() error {
+			if i >= len(format) || format[i] != '*' {
+				for i < len(format) && '0' <= format[i] && format[i] <= '9' {
+					i++
+				}
+				return nil
+			}
+			i++
+			if argNum >= len(args) {
+				return fmt.Errorf("printf format %s reads arg #%d, but call has %s", format[start:i], argNum+1, plural(len(args), "arg"))
+			}
+			if basic, ok := args[argNum].typ.Underlying().(*types.Basic); !ok || basic.Info()&types.IsInteger == 0 {
+				return fmt.Errorf("printf format %s uses non-int %s as argument of *", format[start:i], names[argNum])
+			}
+			argNum++
+			return nil
+		}
+
+		if err := index(); err != nil {
+			return err
+		}
+		if err := star(); err != nil {
+			return err
+		}
+		if i < len(format) && format[i] == '.' {
+			i++
+			if err := index(); err != nil {
+				return err
+			}
+			if err := star(); err != nil {
+				return err
+			}
+		}
+		if err := index(); err != nil {
+			return err
+		}
+		if i >= len(format) {
+			return fmt.Errorf("printf format %s is missing a verb at the end", format[start:])
+		}
+
+		verb, size := utf8.DecodeRuneInString(format[i:])
+		i += size
+		directive := format[start:i]
+		if verb == '%' {
+			continue
+		}
+		if verb == 'w' {
+			return fmt.Errorf("printf does not support error-wrapping directive %s", directive)
+		}
+		accepts, ok := printfVerbs[verb]
+		if !ok {
+			return fmt.Errorf("printf format %s has unknown verb %c", directive, verb)
+		}
+		if argNum >= len(args) {
+			return fmt.Errorf("printf format %s reads arg #%d, but call has %s", directive, argNum+1, plural(len(args), "arg"))
+		}
+		if arg := args[argNum]; !printfMatches(accepts, arg.typ, true, map[types.Type]bool{}) {
+			return fmt.Errorf("printf format %s has arg %s of wrong type %s", directive, names[argNum], arg.typ)
+		}
+		argNum++
+	}
+	if !reordered && argNum < len(args) {
+		return fmt.Errorf("printf call needs %s but has %s", plural(argNum, "arg"), plural(len(args), "arg"))
+	}
+	return nil
+}
+
+// printfMatches reports whether a verb accepting kinds formats a value
+// of type typ meaningfully. fmt applies verbs to the elements of
+// collections and the fields of structs, and, at the top level only, to
+// what a pointer to one of those points at.
+func printfMatches(kinds printfArg, typ types.Type, top bool, seen map[types.Type]bool) bool {
+	if kinds == argAny || isFormatter(typ) {
+		return true
+	}
+	if kinds&argString != 0 && (hasMethod(typ, "String") || hasMethod(typ, "Error")) {
+		return true
+	}
+	if seen[typ] {
+		return true
+	}
+	seen[typ] = true
+
+	switch u := typ.Underlying().(type) {
+	case *types.Interface:
+		// The dynamic type decides at runtime.
+		return true
+	case *types.Basic:
+		info := u.Info()
+		switch {
+		case u.Kind() == types.UntypedNil, u.Kind() == types.UnsafePointer:
+			return kinds&argPointer != 0
+		case u.Kind() == types.UntypedRune:
+			return kinds&(argInt|argRune) != 0
+		case info&types.IsBoolean != 0:
+			return kinds&argBool != 0
+		case info&types.IsInteger != 0:
+			return kinds&argInt != 0
+		case info&types.IsFloat != 0:
+			return kinds&argFloat != 0
+		case info&types.IsComplex != 0:
+			return kinds&argComplex != 0
+		case info&types.IsString != 0:
+			return kinds&argString != 0
+		}
+		return false
+	case *types.Pointer:
+		if kinds == argPointer {
+			return true
+		}
+		if top {
+			switch u.Elem().Underlying().(type) {
+			case *types.Struct, *types.Array, *types.Slice, *types.Map:
+				return printfMatches(kinds, u.Elem(), false, seen)
+			}
+		}
+		// Other pointers print as addresses, which integer verbs format.
+		return kinds&(argInt|argPointer) != 0
+	case *types.Slice:
+		if kinds == argPointer {
+			return true
+		}
+		if isByte(u.Elem()) && kinds&argString != 0 {
+			return true
+		}
+		return printfMatches(kinds, u.Elem(), false, seen)
+	case *types.Array:
+		if isByte(u.Elem()) && kinds&argString != 0 {
+			return true
+		}
+		return printfMatches(kinds, u.Elem(), false, seen)
+	case *types.Map:
+		return kinds == argPointer ||
+			printfMatches(kinds, u.Key(), false, seen) && printfMatches(kinds, u.Elem(), false, seen)
+	case *types.Chan, *types.Signature:
+		return kinds&argPointer != 0
+	case *types.Struct:
+		for i := range u.NumFields() {
+			if !printfMatches(kinds, u.Field(i).Type(), false, seen) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// isByte reports whether typ is byte, or a type defined on it.
+func isByte(typ types.Type) bool {
+	basic, ok := typ.Underlying().(*types.Basic)
+	return ok && basic.Kind() == types.Byte
+}
+
+// plural formats n with noun, pluralized unless n is one.
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"strings"
+	"text/template/parse"
+)
+
+// rangeShape describes how a typed {{range}} iterates its collection:
+// the static types bound to the index and element, and how the Go loop
+// is written.
+type rangeShape struct {
+	kind      rangeKind
+	indexType types.Type // nil when the collection has no index
+	elemType  types.Type
+}
+
+type rangeKind int
+
+const (
+	rangeSlice rangeKind = iota // slices and arrays
+	rangeMap                    // maps, visited in sorted key order
+	rangeChan                   // receive-capable channels
+	rangeInt                    // integers, counting from zero
+	rangeSeq                    // iter.Seq-shaped funcs
+	rangeSeq2                   // iter.Seq2-shaped funcs
+)
+
+// rangeShapeOf classifies a collection type the way text/template's
+// walkRange does, rejecting anything it would fail on at runtime.
+func rangeShapeOf(typ types.Type) (rangeShape, error) {
+	intType := types.Typ[types.Int]
+	switch u := typ.Underlying().(type) {
+	case *types.Slice:
+		return rangeShape{kind: rangeSlice, indexType: intType, elemType: u.Elem()}, nil
+	case *types.Array:
+		return rangeShape{kind: rangeSlice, indexType: intType, elemType: u.Elem()}, nil
+	case *types.Map:
+		key, ok := u.Key().Underlying().(*types.Basic)
+		if !ok || key.Info()&types.IsOrdered == 0 {
+			return rangeShape{}, fmt.Errorf("range over %s needs an ordered key type to visit keys in sorted order", typ)
+		}
+		return rangeShape{kind: rangeMap, indexType: u.Key(), elemType: u.Elem()}, nil
+	case *types.Chan:
+		if u.Dir() == types.SendOnly {
+			return rangeShape{}, fmt.Errorf("range over send-only channel %s", typ)
+		}
+		return rangeShape{kind: rangeChan, indexType: intType, elemType: u.Elem()}, nil
+	case *types.Basic:
+		if u.Info()&types.IsInteger != 0 {
+			return rangeShape{kind: rangeInt, elemType: typ}, nil
+		}
+	case *types.Signature:
+		if yield := iterYield(u); yield != nil {
+			switch yield.Params().Len() {
+			case 1:
+				return rangeShape{kind: rangeSeq, elemType: yield.Params().At(0).Type()}, nil
+			case 2:
+				return rangeShape{kind: rangeSeq2, indexType: yield.Params().At(0).Type(),
+					elemType: yield.Params().At(1).Type()}, nil
+			}
+		}
+	}
+	return rangeShape{}, fmt.Errorf("range can't iterate over %s", typ)
+}
+
+// iterYield returns the yield parameter of an iterator function shaped
+// like iter.Seq or iter.Seq2, or nil if sig is not one.
+func iterYield(sig *types.Signature) *types.Signature {
+	if sig.Params().Len() != 1 || sig.Results().Len() != 0 {
+		return nil
+	}
+	yield, ok := sig.Params().At(0).Type().Underlying().(*types.Signature)
+	if !ok || yield.Results().Len() != 1 {
+		return nil
+	}
+	if res, ok := yield.Results().At(0).Type().Underlying().(*types.Basic); !ok || res.Kind() != types.Bool {
+		return nil
+	}
+	if n := yield.Params().Len(); n != 1 && n != 2 {
+		return nil
+	}
+	return yield
+}
+
+// emitRangeNode compiles {{range}} into a plain Go for-range loop over
+// the statically typed collection. Dot becomes the element, and the
+// declared $index/$element variables are bound with their real types.
+// {{else}} runs when the loop makes no iterations.
+func (g *Generator) emitRangeNode(n *parse.RangeNode) error {
+	line := lineNumberFor(g.LineIndex, int64(n.Position()))
+	if n.Pipe.IsAssign {
+		return errorAtLine(line, "typed mode does not yet support assigning to existing variables in {{range}}")
+	}
+
+	collExpr, collType, err := g.evalCommands(n.Pipe)
+	if err != nil {
+		return err
+	}
+	// Like text/template, range follows pointers to the collection,
+	// failing on a nil one.
+	for {
+		ptr, ok := collType.Underlying().(*types.Pointer)
+		if !ok {
+			break
+		}
+		if !isSimpleExpr(collExpr) {
+			tmp := fmt.Sprintf("ptr%d", g.NextVar())
+			g.Line("%s := %s", tmp, collExpr)
+			collExpr = tmp
+		}
+		if !g.NonNil[collExpr] {
+			msg := strings.ReplaceAll(fmt.Sprintf("%s:%d: range can't iterate over <nil>", g.TemplateName, line), "%", "%%")
+			g.Line("if %s == nil { return fmt.Errorf(%q) }", collExpr, msg)
+		}
+		collExpr, collType = "(*"+collExpr+")", ptr.Elem()
+	}
+	shape, err := rangeShapeOf(collType)
+	if err != nil {
+		return atLine(line, err)
+	}
+
+	decl := n.Pipe.Decl
+	if len(decl) > 1 && shape.indexType == nil {
+		return errorAtLine(line, "can't use %s to iterate over more than one variable", collType)
+	}
+	if shape.kind == rangeSeq2 && len(decl) < 2 {
+		// With a single variable, text/template hands out the first
+		// value an iter.Seq2 yields, just like a one-variable Go loop.
+		shape = rangeShape{kind: rangeSeq, elemType: shape.indexType}
+	}
+
+	id := g.NextVar()
+	index := fmt.Sprintf("index%d", id)
+	elem := fmt.Sprintf("elem%d", id)
+	coll := fmt.Sprintf("coll%d", id)
+	ran := fmt.Sprintf("ran%d", id)
+
+	hasElse := n.ElseList != nil
+	// Channels and iterators can't be tested for emptiness up front,
+	// so the loop records whether it ran. Everything else is guarded
+	// by an emptiness check, as is a channel, since Go blocks forever
+	// ranging over a nil one.
+	tracksRan := hasElse && (shape.kind == rangeChan || shape.kind == rangeSeq || shape.kind == rangeSeq2)
+	guarded := (hasElse && !tracksRan) || shape.kind == rangeChan
+
+	// Emit the body before the loop header so the header declares only
+	// the variables the body uses; Go rejects unused ones.
+	savedDotExpr, savedDotType := g.DotExpr, g.DotType
+	g.DotExpr, g.DotType = elem, shape.elemType
+	g.PushScope()
+	switch len(decl) {
+	case 1:
+		g.BindVar(decl[0].Ident[0], ScopeBinding{GoExpr: elem, Type: shape.elemType})
+	case 2:
+		g.BindVar(decl[0].Ident[0], ScopeBinding{GoExpr: index, Type: shape.indexType})
+		g.BindVar(decl[1].Ident[0], ScopeBinding{GoExpr: elem, Type: shape.elemType})
+	}
+	if guarded {
+		g.Depth++
+	}
+	loop := &loopState{label: fmt.Sprintf("loop%d", id)}
+	g.Loops = append(g.Loops, loop)
+	body, err := g.capture(func() error { return g.emitList(n.List) })
+	g.Loops = g.Loops[:len(g.Loops)-1]
+	if guarded {
+		g.Depth--
+	}
+	g.PopScope()
+	g.DotExpr, g.DotType = savedDotExpr, savedDotType
+	if err != nil {
+		return err
+	}
+	useIndex := usesIdent(body, index)
+	useElem := usesIdent(body, elem)
+
+	if hasElse || shape.kind == rangeChan || (shape.kind == rangeMap && (useIndex || useElem)) {
+		g.Line("%s := %s", coll, collExpr)
+	} else {
+		coll = collExpr
+	}
+	if tracksRan {
+		g.Line("%s := false", ran)
+	}
+	if guarded {
+		switch shape.kind {
+		case rangeChan:
+			g.Line("if %s != nil {", coll)
+		case rangeInt:
+			g.Line("if %s > 0 {", coll)
+		default:
+			g.Line("if len(%s) > 0 {", coll)
+		}
+		g.Depth++
+	}
+
+	// The loop is labeled only when a {{break}} needs to leave it from
+	// inside a type switch.
+	header := func(clause string) {
+		if loop.labeled {
+			g.Line("%s:", loop.label)
+		}
+		g.Line("for %s {", clause)
+	}
+	switch shape.kind {
+	case rangeSlice, rangeSeq2:
+		header(rangeClause(coll, useIndex, index, useElem, elem))
+	case rangeMap:
+		if !useIndex && !useElem {
+			header("range " + coll)
+			break
+		}
+		g.Imports.Add("maps", "")
+		g.Imports.Add("slices", "")
+		header(fmt.Sprintf("_, %s := range slices.Sorted(maps.Keys(%s))", index, coll))
+		if useElem {
+			g.Line("\t%s := %s[%s]", elem, coll, index)
+		}
+	case rangeChan:
+		if useIndex {
+			g.Line("%s := -1", index)
+		}
+		header(rangeClause(coll, false, "", useElem, elem))
+		if useIndex {
+			g.Line("\t%s++", index)
+		}
+	case rangeInt, rangeSeq:
+		header(rangeClause(coll, false, "", useElem, elem))
+	}
+	if tracksRan {
+		g.Line("\t%s = true", ran)
+	}
+	g.Writef("%s", body)
+	g.Line("}")
+
+	if guarded {
+		g.Depth--
+		if hasElse && !tracksRan {
+			g.Line("} else {")
+			if err := g.emitList(n.ElseList); err != nil {
+				return err
+			}
+		}
+		g.Line("}")
+	}
+	if tracksRan {
+		g.Line("if !%s {", ran)
+		if err := g.emitList(n.ElseList); err != nil {
+			return err
+		}
+		g.Line("}")
+	}
+	return nil
+}
+
+// rangeClause renders the "vars := range coll" part of a for statement,
+// declaring only the loop variables the body uses. Pass an empty index
+// for loops that produce a single value.
+func rangeClause(coll string, useIndex bool, index string, useElem bool, elem string) string {
+	switch {
+	case useElem && useIndex:
+		return fmt.Sprintf("%s, %s := range %s", index, elem, coll)
+	case useElem && index != "":
+		return fmt.Sprintf("_, %s := range %s", elem, coll)
+	case useElem:
+		return fmt.Sprintf("%s := range %s", elem, coll)
+	case useIndex:
+		return fmt.Sprintf("%s := range %s", index, coll)
+	default:
+		return "range " + coll
+	}
+}
+
+// usesIdent reports whether the Go source fragment src refers to the
+// identifier name. It tokenizes src, so matches inside string literals
+// and comments do not count.
+func usesIdent(src, name string) bool {
+	var s scanner.Scanner
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	s.Init(file, []byte(src), nil, 0)
+	for {
+		_, tok, lit := s.Scan()
+		if tok == token.EOF {
+			return false
+		}
+		if tok == token.IDENT && lit == name {
+			return true
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"go/types"
+)
+
+// typedSprigPkg holds typed versions of the sprig functions that have
+// no exported Go equivalent.
+const typedSprigPkg = "github.com/jtarchie/comtmpl/templates/sprig"
+
+// typedSprig maps the sprig template functions typed mode can call
+// directly to their Go functions. Sprig functions missing here, mostly
+// the list, dict and loosely typed arithmetic ones, still need @funcs.
+var typedSprig = map[string]struct{ pkg, name string }{
+	// Strings
+	"trim":       {"strings", "TrimSpace"},
+	"upper":      {"strings", "ToUpper"},
+	"lower":      {"strings", "ToLower"},
+	"title":      {"strings", "Title"},
+	"trunc":      {typedSprigPkg, "Trunc"},
+	"substr":     {typedSprigPkg, "Substr"},
+	"repeat":     {typedSprigPkg, "Repeat"},
+	"trimall":    {typedSprigPkg, "TrimAll"},
+	"trimAll":    {typedSprigPkg, "TrimAll"},
+	"trimPrefix": {typedSprigPkg, "TrimPrefix"},
+	"trimSuffix": {typedSprigPkg, "TrimSuffix"},
+	"contains":   {typedSprigPkg, "Contains"},
+	"hasPrefix":  {typedSprigPkg, "HasPrefix"},
+	"hasSuffix":  {typedSprigPkg, "HasSuffix"},
+	"replace":    {typedSprigPkg, "Replace"},
+	"splitList":  {typedSprigPkg, "SplitList"},
+	"join":       {typedSprigPkg, "Join"},
+	"indent":     {typedSprigPkg, "Indent"},
+	"nindent":    {typedSprigPkg, "Nindent"},
+	"plural":     {typedSprigPkg, "Plural"},
+	"quote":      {typedSprigPkg, "Quote"},
+	"squote":     {typedSprigPkg, "Squote"},
+	"cat":        {typedSprigPkg, "Cat"},
+	"toString":   {typedSprigPkg, "ToString"},
+	"atoi":       {typedSprigPkg, "Atoi"},
+
+	// Encodings and hashes
+	"b64enc":     {typedSprigPkg, "B64Enc"},
+	"b64dec":     {typedSprigPkg, "B64Dec"},
+	"b32enc":     {typedSprigPkg, "B32Enc"},
+	"b32dec":     {typedSprigPkg, "B32Dec"},
+	"sha1sum":    {typedSprigPkg, "Sha1Sum"},
+	"sha256sum":  {typedSprigPkg, "Sha256Sum"},
+	"adler32sum": {typedSprigPkg, "Adler32Sum"},
+
+	// Defaults and flow control
+	"default":  {typedSprigPkg, "Default"},
+	"empty":    {typedSprigPkg, "Empty"},
+	"coalesce": {typedSprigPkg, "Coalesce"},
+	"ternary":  {typedSprigPkg, "Ternary"},
+	"fail":     {typedSprigPkg, "Fail"},
+
+	// Dates
+	"now":            {"time", "Now"},
+	"date":           {typedSprigPkg, "Date"},
+	"dateInZone":     {typedSprigPkg, "DateInZone"},
+	"date_in_zone":   {typedSprigPkg, "DateInZone"},
+	"htmlDate":       {typedSprigPkg, "HTMLDate"},
+	"htmlDateInZone": {typedSprigPkg, "HTMLDateInZone"},
+	"ago":            {typedSprigPkg, "Ago"},
+	"toDate":         {typedSprigPkg, "ToDate"},
+	"mustToDate":     {typedSprigPkg, "MustToDate"},
+	"unixEpoch":      {typedSprigPkg, "UnixEpoch"},
+
+	// Regular expressions
+	"regexMatch":                 {typedSprigPkg, "RegexMatch"},
+	"mustRegexMatch":             {typedSprigPkg, "MustRegexMatch"},
+	"regexFind":                  {typedSprigPkg, "RegexFind"},
+	"mustRegexFind":              {typedSprigPkg, "MustRegexFind"},
+	"regexFindAll":               {typedSprigPkg, "RegexFindAll"},
+	"mustRegexFindAll":           {typedSprigPkg, "MustRegexFindAll"},
+	"regexReplaceAll":            {typedSprigPkg, "RegexReplaceAll"},
+	"mustRegexReplaceAll":        {typedSprigPkg, "MustRegexReplaceAll"},
+	"regexReplaceAllLiteral":     {typedSprigPkg, "RegexReplaceAllLiteral"},
+	"mustRegexReplaceAllLiteral": {typedSprigPkg, "MustRegexReplaceAllLiteral"},
+	"regexSplit":                 {typedSprigPkg, "RegexSplit"},
+	"mustRegexSplit":             {typedSprigPkg, "MustRegexSplit"},
+	"regexQuoteMeta":             {"regexp", "QuoteMeta"},
+
+	// Environment, paths and reflection
+	"env":       {"os", "Getenv"},
+	"expandenv": {"os", "ExpandEnv"},
+	"base":      {"path", "Base"},
+	"dir":       {"path", "Dir"},
+	"clean":     {"path", "Clean"},
+	"ext":       {"path", "Ext"},
+	"isAbs":     {"path", "IsAbs"},
+	"osBase":    {"path/filepath", "Base"},
+	"osClean":   {"path/filepath", "Clean"},
+	"osDir":     {"path/filepath", "Dir"},
+	"osExt":     {"path/filepath", "Ext"},
+	"osIsAbs":   {"path/filepath", "IsAbs"},
+	"deepEqual": {"reflect", "DeepEqual"},
+}
+
+// sprigFunc resolves name as a typed sprig function, for templates
+// calling it without a @funcs entry of that name. Packages are loaded
+// only for the functions a template actually calls.
+func (g *Generator) sprigFunc(name string) (FuncRef, bool, error) {
+	s, ok := typedSprig[name]
+	if !ok || g.Resolver == nil {
+		return FuncRef{}, false, nil
+	}
+	fn, err := g.Resolver.LookupFunc(s.pkg, s.name)
+	if err != nil {
+		return FuncRef{}, false, fmt.Errorf("sprig function %s: %w", name, err)
+	}
+	return FuncRef{Name: name, Sig: fn.Type().(*types.Signature), Func: fn}, true, nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"go/types"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template/parse"
+)
+
+// asTypeFunc is the template function that narrows an interface value
+// to a concrete type, as in
+//
+//	{{with asType .Block "models.TextBlock"}}{{.Text}}
+//	{{else with asType .Block "*models.ImageBlock"}}{{.URL}}
+//	{{else}}unknown block{{end}}
+//
+// A chain of such branches over the same operand compiles to one Go
+// type switch, with dot narrowed to the case's type in each branch. As
+// with the runtime asType, a branch is taken when the value has the
+// named type and is true by {{with}}'s rules, so a nil pointer is not.
+// Types are resolved like @data refs, with the template's @import
+// aliases, but must be qualified the way the runtime matches them: by
+// package name or by import path.
+const asTypeFunc = "asType"
+
+// asTypeCall returns the operand and type ref of a pipeline of the form
+// asType X "T", or ok=false for any other pipeline. A @funcs function
+// named asType is called like any other.
+func (g *Generator) asTypeCall(pipe *parse.PipeNode) (operand parse.Node, ref string, ok bool) {
+	if _, user := g.Funcs[asTypeFunc]; user || pipe == nil || len(pipe.Cmds) != 1 {
+		return nil, "", false
+	}
+	args := pipe.Cmds[0].Args
+	if len(args) != 3 {
+		return nil, "", false
+	}
+	if id, isIdent := args[0].(*parse.IdentifierNode); !isIdent || id.Ident != asTypeFunc {
+		return nil, "", false
+	}
+	s, isString := args[2].(*parse.StringNode)
+	if !isString {
+		return nil, "", false
+	}
+	return args[1], s.Text, true
+}
+
+// typeCase is one branch of a type switch.
+type typeCase struct {
+	typ  types.Type
+	with *parse.WithNode
+}
+
+// emitTypeSwitch compiles a {{with asType ...}} chain into a Go type
+// switch. The chain continues through {{else with asType}} branches on
+// the same operand; whatever else follows becomes the default case.
+func (g *Generator) emitTypeSwitch(n *parse.WithNode) error {
+	line := lineNumberFor(g.LineIndex, int64(n.Position()))
+	operand, _, _ := g.asTypeCall(n.Pipe)
+	expr, typ, err := g.evalCommandArg(operand)
+	if err != nil {
+		return atLine(line, err)
+	}
+	iface, ok := typ.Underlying().(*types.Interface)
+	if !ok {
+		return errorAtLine(line, "asType needs an interface value, but %s has type %s", operand, typ)
+	}
+
+	var (
+		cases    []typeCase
+		elseList *parse.ListNode
+	)
+	for cur := n; ; {
+		line := lineNumberFor(g.LineIndex, int64(cur.Position()))
+		if cur.Pipe.IsAssign {
+			return errorAtLine(line, "typed mode does not yet support assigning to existing variables in {{with}}")
+		}
+		_, ref, _ := g.asTypeCall(cur.Pipe)
+		caseType, err := g.resolveTypeRef(ref)
+		if err != nil {
+			return errorAtLine(line, "asType %q: %w", ref, err)
+		}
+		if names := runtimeTypeNames(caseType); !slices.Contains(names, ref) {
+			return errorAtLine(line, "asType %q: write the type as %s, the names asType matches at runtime",
+				ref, strings.Join(quoteAll(names), " or "))
+		}
+		if !types.AssertableTo(iface, caseType) {
+			return errorAtLine(line, "impossible asType: %s does not implement %s", caseType, typ)
+		}
+		for _, c := range cases {
+			if types.Identical(c.typ, caseType) {
+				return errorAtLine(line, "duplicate asType case %s", caseType)
+			}
+		}
+		cases = append(cases, typeCase{typ: caseType, with: cur})
+
+		elseList = cur.ElseList
+		if elseList == nil || len(elseList.Nodes) != 1 {
+			break
+		}
+		next, ok := elseList.Nodes[0].(*parse.WithNode)
+		if !ok {
+			break
+		}
+		if op, _, ok := g.asTypeCall(next.Pipe); !ok || op.String() != operand.String() {
+			break
+		}
+		cur = next
+	}
+
+	// Bodies are emitted first so the switch declares its variable only
+	// when some case reads it.
+	value := fmt.Sprintf("typed%d", g.NextVar())
+	matched := fmt.Sprintf("matched%d", g.NextVar())
+	if loop := g.innermostLoop(); loop != nil {
+		loop.switches++
+		defer func() { loop.switches-- }()
+	}
+	bodies := make([]string, len(cases))
+	truths := make([]string, len(cases))
+	used, tracksMatch := false, false
+	for i, c := range cases {
+		if truths[i], err = truthExpr(value, c.typ); err != nil {
+			return atLine(lineNumberFor(g.LineIndex, int64(c.with.Position())), err)
+		}
+		savedDotExpr, savedDotType := g.DotExpr, g.DotType
+		g.DotExpr, g.DotType = value, c.typ
+		g.PushScope()
+		if decl := c.with.Pipe.Decl; len(decl) > 0 {
+			g.BindVar(decl[0].Ident[0], ScopeBinding{GoExpr: value, Type: c.typ})
+		}
+		savedNonNil := g.NonNil[value]
+		if _, ok := c.typ.(*types.Pointer); ok {
+			g.markNonNil(value)
+		}
+		bodies[i], err = g.capture(func() error { return g.emitList(c.with.List) })
+		if !savedNonNil {
+			delete(g.NonNil, value)
+		}
+		g.PopScope()
+		g.DotExpr, g.DotType = savedDotExpr, savedDotType
+		if err != nil {
+			return err
+		}
+		used = used || usesIdent(bodies[i], value) || usesIdent(truths[i], value)
+		tracksMatch = tracksMatch || truths[i] != "true"
+	}
+	var elseBody string
+	if elseList != nil {
+		if elseBody, err = g.capture(func() error { return g.emitList(elseList) }); err != nil {
+			return err
+		}
+	}
+	// A case whose value turns out false falls through to the else
+	// branch, which then runs after the switch instead of as its default.
+	tracksMatch = tracksMatch && elseList != nil
+	if tracksMatch {
+		g.Line("%s := false", matched)
+	}
+
+	if used {
+		g.Line("switch %s := %s.(type) {", value, expr)
+	} else {
+		g.Line("switch %s.(type) {", expr)
+	}
+	for i, c := range cases {
+		g.Line("case %s:", g.TypeExpr(c.typ))
+		if truths[i] != "true" {
+			g.Line("if %s {", truths[i])
+		}
+		if tracksMatch {
+			g.Line("%s = true", matched)
+		}
+		g.Writef("%s", bodies[i])
+		if truths[i] != "true" {
+			g.Line("}")
+		}
+	}
+	if elseList != nil && !tracksMatch {
+		g.Line("default:")
+		g.Writef("%s", elseBody)
+	}
+	g.Line("}")
+	if tracksMatch {
+		g.Line("if !%s {", matched)
+		g.Writef("%s", elseBody)
+		g.Line("}")
+	}
+	return nil
+}
+
+// runtimeTypeNames returns the names the runtime asType matches typ by:
+// qualified by package name, as reflect prints it, and, for a named type
+// behind any pointers, by import path.
+func runtimeTypeNames(typ types.Type) []string {
+	byName := types.TypeString(typ, func(p *types.Package) string { return p.Name() })
+	stars, elem := "", typ
+	for ptr, ok := elem.(*types.Pointer); ok; ptr, ok = elem.(*types.Pointer) {
+		stars, elem = stars+"*", ptr.Elem()
+	}
+	named, ok := elem.(*types.Named)
+	if !ok || named.Obj().Pkg() == nil {
+		return []string{byName}
+	}
+	return []string{byName, stars + named.Obj().Pkg().Path() + "." + named.Obj().Name()}
+}
+
+// quoteAll returns each of ss quoted.
+func quoteAll(ss []string) []string {
+	quoted := make([]string, len(ss))
+	for i, s := range ss {
+		quoted[i] = strconv.Quote(s)
+	}
+	return quoted
+}
+
+// resolveTypeRef resolves a type written in the template, such as an
+// asType argument, like a @data ref.
+func (g *Generator) resolveTypeRef(ref string) (types.Type, error) {
+	parsed, err := ParseTypeRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	return g.Resolver.ResolveTypeRef(parsed, g.TypeAliases)
+}
+
+// loopState tracks a typed {{range}} loop while its body is emitted. A
+// {{break}} inside a type switch must name the loop, since a bare break
+// would only leave the switch.
+type loopState struct {
+	label    string
+	switches int  // type switches open around the current node
+	labeled  bool // some break named label
+}
+
+// innermostLoop returns the loop the current node is in, or nil.
+func (g *Generator) innermostLoop() *loopState {
+	if len(g.Loops) == 0 {
+		return nil
+	}
+	return g.Loops[len(g.Loops)-1]
+}
+
+// breakStmt returns the Go statement for {{break}}.
+func (g *Generator) breakStmt() string {
+	loop := g.innermostLoop()
+	if loop == nil || loop.switches == 0 {
+		return "break"
+	}
+	loop.labeled = true
+	return "break " + loop.label
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"go/ast"
+	"go/constant"
 	"go/types"
+	"path/filepath"
 
 	"golang.org/x/tools/go/packages"
 )
@@ -11,6 +14,11 @@ import (
 // FuncMap definitions used by typed codegen. It caches loaded packages so
 // repeated lookups across templates only pay the load cost once per run.
 type TypeResolver struct {
+	// Dir is the directory packages are loaded from; empty means the
+	// current working directory. It decides which go.mod resolves
+	// import paths.
+	Dir string
+
 	pkgs map[string]*packages.Package
 }
 
@@ -29,6 +37,7 @@ func (r *TypeResolver) loadPackage(importPath string) (*packages.Package, error)
 		Mode: packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles |
 			packages.NeedImports | packages.NeedDeps | packages.NeedTypes |
 			packages.NeedSyntax | packages.NeedTypesInfo,
+		Dir: r.Dir,
 	}
 	loaded, err := packages.Load(cfg, importPath)
 	if err != nil {
@@ -45,6 +54,42 @@ func (r *TypeResolver) loadPackage(importPath string) (*packages.Package, error)
 	return pkg, nil
 }
 
+// loadOutputPackage loads the package in dir that generated code is
+// written to. The file at generated, if any, is read as an empty file of
+// package pkgName: it holds the output of an earlier run, which need not
+// type-check against the types as they are now. Type errors are
+// tolerated too, since the rest of the package may refer to what that
+// file declared.
+func (r *TypeResolver) loadOutputPackage(dir, generated, pkgName string) (*packages.Package, error) {
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles |
+			packages.NeedImports | packages.NeedDeps | packages.NeedTypes |
+			packages.NeedSyntax | packages.NeedTypesInfo,
+		Dir: dir,
+	}
+	if generated != "" {
+		abs, err := filepath.Abs(generated)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Overlay = map[string][]byte{abs: []byte("package " + pkgName + "\n")}
+	}
+	loaded, err := packages.Load(cfg, ".")
+	if err != nil {
+		return nil, fmt.Errorf("load package in %s: %w", dir, err)
+	}
+	if len(loaded) == 0 {
+		return nil, fmt.Errorf("no package found in %s", dir)
+	}
+	pkg := loaded[0]
+	for _, e := range pkg.Errors {
+		if e.Kind != packages.TypeError {
+			return nil, fmt.Errorf("package in %s has errors: %v", dir, pkg.Errors)
+		}
+	}
+	return pkg, nil
+}
+
 // ResolveType returns the *types.Type for typeName declared in the
 // package at importPath. The returned type is the named type's underlying
 // type if you call .Underlying(); the named type itself is suitable for
@@ -68,3 +113,219 @@ func (r *TypeResolver) ResolveType(importPath, typeName string) (types.Type, err
 	}
 	return tn.Type(), nil
 }
+
+// ResolveTypeRef resolves a parsed @data reference to a type, looking up
+// @import aliases in aliases. Generic types are instantiated with their
+// type arguments, which must satisfy the type parameters' constraints.
+func (r *TypeResolver) ResolveTypeRef(ref TypeRef, aliases map[string]string) (types.Type, error) {
+	if ref.Elem != nil {
+		elem, err := r.ResolveTypeRef(*ref.Elem, aliases)
+		if err != nil {
+			return nil, err
+		}
+		if ref.Slice {
+			return types.NewSlice(elem), nil
+		}
+		return types.NewPointer(elem), nil
+	}
+
+	var typ types.Type
+	if ref.PathOrAlias == "" {
+		tn, ok := types.Universe.Lookup(ref.Name).(*types.TypeName)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a predeclared type; qualify it with its package", ref.Name)
+		}
+		typ = tn.Type()
+	} else {
+		importPath := ref.PathOrAlias
+		if path, ok := aliases[importPath]; ok {
+			importPath = path
+		}
+		var err error
+		if typ, err = r.ResolveType(importPath, ref.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	named, _ := typ.(*types.Named)
+	generic := named != nil && named.TypeParams().Len() > 0
+	switch {
+	case generic && len(ref.Args) == 0:
+		return nil, fmt.Errorf("generic type %s needs %d type arguments", typ, named.TypeParams().Len())
+	case !generic && len(ref.Args) > 0:
+		return nil, fmt.Errorf("type %s is not generic", typ)
+	case !generic:
+		return typ, nil
+	}
+
+	args := make([]types.Type, len(ref.Args))
+	for i, arg := range ref.Args {
+		var err error
+		if args[i], err = r.ResolveTypeRef(arg, aliases); err != nil {
+			return nil, err
+		}
+	}
+	inst, err := types.Instantiate(nil, named, args, true)
+	if err != nil {
+		return nil, fmt.Errorf("instantiate %s: %w", named, err)
+	}
+	return inst, nil
+}
+
+// LookupFunc returns the package-level function name declared in the
+// package at importPath.
+func (r *TypeResolver) LookupFunc(importPath, name string) (*types.Func, error) {
+	pkg, err := r.loadPackage(importPath)
+	if err != nil {
+		return nil, err
+	}
+	if pkg.Types == nil {
+		return nil, fmt.Errorf("package %q has no type information", importPath)
+	}
+	fn, ok := pkg.Types.Scope().Lookup(name).(*types.Func)
+	if !ok {
+		return nil, fmt.Errorf("function %q not found in package %q", name, importPath)
+	}
+	return fn, nil
+}
+
+// FuncRef is a template function resolved from Go source. Generated
+// code calls Func by name when it is set and reachable; otherwise it
+// indexes the exported FuncMap variable MapVar and asserts the entry to
+// Sig. Either way the call is type-checked against Sig at generate time.
+type FuncRef struct {
+	Name   string // name templates call it by
+	Sig    *types.Signature
+	Func   *types.Func // package-level Go function the entry refers to, if any
+	MapVar *types.Var  // exported FuncMap variable holding the entry, if any
+}
+
+// ResolveFuncs returns the template functions provided by the package at
+// importPath. Entries come from exported FuncMap variables initialized
+// with a map literal, or from exported functions that return such a
+// literal. A package with neither provides each exported function under
+// its Go name.
+func (r *TypeResolver) ResolveFuncs(importPath string) (map[string]FuncRef, error) {
+	pkg, err := r.loadPackage(importPath)
+	if err != nil {
+		return nil, err
+	}
+	if pkg.Types == nil || pkg.TypesInfo == nil {
+		return nil, fmt.Errorf("package %q has no type information", importPath)
+	}
+
+	funcs := map[string]FuncRef{}
+	add := func(lit *ast.CompositeLit, mapVar *types.Var) error {
+		for _, elt := range lit.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if !ok {
+				continue
+			}
+			key := pkg.TypesInfo.Types[kv.Key].Value
+			if key == nil || key.Kind() != constant.String {
+				return fmt.Errorf("%s: FuncMap key %s is not a constant string", importPath, types.ExprString(kv.Key))
+			}
+			name := constant.StringVal(key)
+			if _, dup := funcs[name]; dup {
+				return fmt.Errorf("%s: function %q is defined twice", importPath, name)
+			}
+			sig, ok := pkg.TypesInfo.TypeOf(kv.Value).Underlying().(*types.Signature)
+			if !ok {
+				return fmt.Errorf("%s: FuncMap entry %q is not a function", importPath, name)
+			}
+			funcs[name] = FuncRef{Name: name, Sig: sig, Func: referencedFunc(pkg.TypesInfo, kv.Value), MapVar: mapVar}
+		}
+		return nil
+	}
+
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			switch d := decl.(type) {
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					vs, ok := spec.(*ast.ValueSpec)
+					if !ok {
+						continue
+					}
+					for i, name := range vs.Names {
+						if !name.IsExported() || i >= len(vs.Values) {
+							continue
+						}
+						if lit := funcMapLiteral(pkg.TypesInfo, vs.Values[i]); lit != nil {
+							v, _ := pkg.TypesInfo.Defs[name].(*types.Var)
+							if err := add(lit, v); err != nil {
+								return nil, err
+							}
+						}
+					}
+				}
+			case *ast.FuncDecl:
+				if d.Recv != nil || !d.Name.IsExported() || d.Body == nil || len(d.Body.List) != 1 {
+					continue
+				}
+				ret, ok := d.Body.List[0].(*ast.ReturnStmt)
+				if !ok || len(ret.Results) != 1 {
+					continue
+				}
+				if lit := funcMapLiteral(pkg.TypesInfo, ret.Results[0]); lit != nil {
+					if err := add(lit, nil); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+	if len(funcs) > 0 {
+		return funcs, nil
+	}
+
+	scope := pkg.Types.Scope()
+	for _, name := range scope.Names() {
+		fn, ok := scope.Lookup(name).(*types.Func)
+		if !ok || !fn.Exported() {
+			continue
+		}
+		funcs[name] = FuncRef{Name: name, Sig: fn.Type().(*types.Signature), Func: fn}
+	}
+	return funcs, nil
+}
+
+// funcMapLiteral returns expr as a map literal if it builds a FuncMap
+// (any map[string]any type, such as text/template.FuncMap).
+func funcMapLiteral(info *types.Info, expr ast.Expr) *ast.CompositeLit {
+	lit, ok := ast.Unparen(expr).(*ast.CompositeLit)
+	if !ok {
+		return nil
+	}
+	m, ok := info.TypeOf(lit).Underlying().(*types.Map)
+	if !ok {
+		return nil
+	}
+	key, ok := m.Key().Underlying().(*types.Basic)
+	if !ok || key.Kind() != types.String {
+		return nil
+	}
+	if elem, ok := m.Elem().Underlying().(*types.Interface); !ok || !elem.Empty() {
+		return nil
+	}
+	return lit
+}
+
+// referencedFunc returns the package-level function expr names, such as
+// Greet or strings.ToUpper, or nil for closures, methods and the like.
+func referencedFunc(info *types.Info, expr ast.Expr) *types.Func {
+	var ident *ast.Ident
+	switch e := ast.Unparen(expr).(type) {
+	case *ast.Ident:
+		ident = e
+	case *ast.SelectorExpr:
+		ident = e.Sel
+	default:
+		return nil
+	}
+	fn, ok := info.Uses[ident].(*types.Func)
+	if !ok || fn.Type().(*types.Signature).Recv() != nil {
+		return nil
+	}
+	return fn
+}
@@ -51,3 +51,23 @@ func TestResolveTypeCached(t *testing.T) {
 		t.Fatal("expected package to be cached after first call")
 	}
 }
+
+// TestResolveFuncsExported covers a package without a FuncMap: its
+// exported functions are available under their Go names.
+func TestResolveFuncsExported(t *testing.T) {
+	r := NewTypeResolver()
+	funcs, err := r.ResolveFuncs("github.com/jtarchie/comtmpl/templates")
+	if err != nil {
+		t.Fatalf("resolve funcs: %v", err)
+	}
+	ref, ok := funcs["IsTrue"]
+	if !ok {
+		t.Fatalf("IsTrue missing from %v", funcs)
+	}
+	if ref.Func == nil || ref.Sig.Params().Len() != 1 || ref.Sig.Results().Len() != 2 {
+		t.Errorf("unexpected ref for IsTrue: %+v", ref)
+	}
+	if _, ok := funcs["builtins"]; ok {
+		t.Error("unexported function should not be provided")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// templateTypeDirective marks a Go type as the data type of one or more
+// templates, as an alternative to a @data comment in the template:
+//
+//	//comtmpl:template index.html
+//	type IndexData struct { ... }
+const templateTypeDirective = "//comtmpl:template"
+
+// SourceType is a data type declared for a template by a
+// //comtmpl:template comment.
+type SourceType struct {
+	Type types.Type
+	Pos  string // "file.go:line" of the comment, for error messages
+}
+
+// DiscoverTemplateTypes scans the Go files of the package in dir, the
+// one generated code goes to, for //comtmpl:template comments and
+// returns the declared type of each template name. generated is the
+// file of that package written by an earlier run, if any, which is
+// ignored. Files are parsed first, so the package is only type-checked
+// through resolver when it declares at least one mapping.
+func DiscoverTemplateTypes(resolver *TypeResolver, dir, generated, pkgName string) (map[string]SourceType, error) {
+	if dir == "" {
+		dir = "."
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+
+	type declared struct {
+		typeName string
+		pos      string
+	}
+	byTemplate := map[string]declared{}
+	fset := token.NewFileSet()
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") || (generated != "" && sameFile(path, generated)) {
+			continue
+		}
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.Contains(string(src), templateTypeDirective) {
+			continue
+		}
+		file, err := parser.ParseFile(fset, path, src, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				doc := ts.Doc
+				if doc == nil && len(gen.Specs) == 1 {
+					doc = gen.Doc
+				}
+				for _, name := range templateNames(doc) {
+					pos := fset.Position(doc.Pos())
+					at := fmt.Sprintf("%s:%d", filepath.Base(pos.Filename), pos.Line)
+					if prev, dup := byTemplate[name]; dup {
+						return nil, fmt.Errorf("%s: template %s is already declared as %s at %s",
+							at, name, prev.typeName, prev.pos)
+					}
+					if ts.TypeParams != nil {
+						return nil, fmt.Errorf("%s: generic type %s can't be declared for %s; use @data with type arguments",
+							at, ts.Name.Name, name)
+					}
+					byTemplate[name] = declared{typeName: ts.Name.Name, pos: at}
+				}
+			}
+		}
+	}
+	if len(byTemplate) == 0 {
+		return nil, nil
+	}
+
+	pkg, err := resolver.loadOutputPackage(dir, generated, pkgName)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]SourceType, len(byTemplate))
+	for name, d := range byTemplate {
+		tn, ok := pkg.Types.Scope().Lookup(d.typeName).(*types.TypeName)
+		if !ok {
+			return nil, fmt.Errorf("%s: type %s not found in package %s", d.pos, d.typeName, pkg.PkgPath)
+		}
+		found[name] = SourceType{Type: tn.Type(), Pos: d.pos}
+	}
+	return found, nil
+}
+
+// sameFile reports whether the paths a and b name the same file.
+func sameFile(a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	return err == nil && os.SameFile(aInfo, bInfo)
+}
+
+// templateNames returns the template names listed by the
+// //comtmpl:template lines of doc. A line may list several names.
+func templateNames(doc *ast.CommentGroup) []string {
+	if doc == nil {
+		return nil
+	}
+	var names []string
+	for _, c := range doc.List {
+		rest, ok := strings.CutPrefix(c.Text, templateTypeDirective)
+		if !ok || (rest != "" && rest[0] != ' ' && rest[0] != '\t') {
+			continue
+		}
+		names = append(names, strings.Fields(rest)...)
+	}
+	return names
+}